@@ -1,13 +1,19 @@
 package main
 
 import (
+	"crypto"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"syscall"
 
@@ -18,52 +24,123 @@ import (
 )
 
 func main() {
+	var bourne, csh, kill, logout bool
+	flag.BoolVar(&bourne, "s", false, "run in the background and print Bourne shell commands to set SSH_AUTH_SOCK")
+	flag.BoolVar(&csh, "c", false, "run in the background and print C shell commands to set SSH_AUTH_SOCK")
+	flag.BoolVar(&kill, "k", false, "kill the running agent and remove its socket")
+	flag.BoolVar(&logout, "logout", false, "sign out, clearing the running agent's certificate and the token cache")
+	flag.Parse()
+
+	// Pick the shell syntax for exports, guessing from $SHELL if not specified
+	shell := sshizzleagent.ShellBourne
+	if csh || (!bourne && strings.HasSuffix(os.Getenv("SHELL"), "csh")) {
+		shell = sshizzleagent.ShellCsh
+	}
+
+	if logout {
+		// Prefer the socket exported by a previous `sshizzle-agent -s/-c`
+		socket, exists := os.LookupEnv("SSH_AUTH_SOCK")
+		if !exists || socket == "" {
+			socket = config.GetSocket()
+		}
+		if err := logoutAgent(socket); err != nil {
+			log.Fatalln(fmt.Errorf("failed to logout: %s", err.Error()))
+		}
+		log.Println("Logged out")
+		return
+	}
+
+	if kill {
+		// Only sshizzle's own socket, SSH_AUTH_SOCK may belong to another agent
+		pid, err := sshizzleagent.Kill(config.GetSocket())
+		if err != nil {
+			log.Fatalln(fmt.Errorf("failed to kill agent: %s", err.Error()))
+		}
+		fmt.Print(sshizzleagent.UnsetCommands(shell, pid))
+		return
+	}
+
+	// Daemonized agents log to the sshizzle config dir
+	logFile := ""
+	if sshizzleDir, err := config.GetSSHizzleDir(); err == nil {
+		logFile = filepath.Join(sshizzleDir, "agent.log")
+	}
+
 	// Ensure environment variables are set and config directory created
 	config, err := config.Check()
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	// Generate a new SSH public/private key pair
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		log.Fatalln(fmt.Errorf("error generating new private key: %s", err.Error()))
+	if bourne || csh {
+		// Start the agent in the background
+		pid, err := sshizzleagent.Daemonize(config.Socket, logFile)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("failed to start agent: %s", err.Error()))
+		}
+		fmt.Print(sshizzleagent.ExportCommands(shell, config.Socket, pid))
+		return
 	}
 
-	// Create a signer from the key
-	signer, err := ssh.NewSignerFromKey(privateKey)
-	if err != nil {
-		log.Fatalln(fmt.Errorf("error creating signer from private key: %s", err.Error()))
+	// Generate a new SSH public/private key pair for each key type
+	for _, keyType := range config.KeyTypes {
+		privateKey, err := generateKey(keyType)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("error generating new private key: %s", err.Error()))
+		}
+
+		// Create a signer from the key
+		signer, err := ssh.NewSignerFromKey(privateKey)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("error creating signer from private key: %s", err.Error()))
+		}
+		config.Signers = append(config.Signers, signer)
 	}
-	config.Signer = signer
 
 	if err = startAgent(config); err != nil {
 		log.Fatalln(fmt.Errorf("failed to start agent: %s", err.Error()))
 	}
 }
 
-func startAgent(c *config.SSHizzleConfig) error {
-	// Ensure the socket doesn't already exist
-	if _, err := os.Stat(c.Socket); err == nil {
-		log.Fatalln(fmt.Errorf("socket %s already exists", c.Socket))
+// generateKey creates a new private key of the type specified
+func generateKey(keyType string) (crypto.PrivateKey, error) {
+	switch keyType {
+	case "ed25519":
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		return privateKey, err
+	default:
+		return rsa.GenerateKey(rand.Reader, 2048)
 	}
+}
 
-	// Create a new Unix socket and listen
-	syscall.Umask(0077)
-	listener, err := net.Listen("unix", c.Socket)
+func startAgent(c *config.SSHizzleConfig) error {
+	// Listen on the socket passed by systemd, or create our own
+	listener, activated, err := sshizzleagent.Listen(c.Socket)
 	if err != nil {
-		log.Fatalln(fmt.Errorf("error listening on socket: %s", err.Error()))
+		return err
 	}
 	defer listener.Close()
 
-	log.Println("Listening on", c.Socket)
+	if activated {
+		log.Println("Listening on socket passed by systemd")
+	} else {
+		log.Println("Listening on", c.Socket)
+	}
+
+	// Record our pid so `sshizzle-agent -k` can find us
+	if sshizzleagent.IsDaemon() {
+		if err := sshizzleagent.WritePidFile(c.Socket); err != nil {
+			return err
+		}
+		defer os.Remove(sshizzleagent.GetPidFile(c.Socket))
+	}
 
 	// Create a new sshizzle agent
 	sshizzleAgent := sshizzleagent.NewSSHizzleAgent(c)
 
 	// Catch interrupt/kill signals to exit nicely
-	sigs := make(chan os.Signal)
-	signal.Notify(sigs, os.Interrupt, os.Kill)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		_ = <-sigs
 		err := listener.Close()
@@ -81,9 +158,32 @@ func startAgent(c *config.SSHizzleConfig) error {
 			}
 			log.Fatalln(fmt.Errorf("listener error: %s", err.Error()))
 		}
-		// Don't return on EOF so socket stays open after serving each request
-		if err := agent.ServeAgent(sshizzleAgent, conn); err != nil && err.Error() != "EOF" {
-			log.Fatalln(fmt.Errorf("error serving agent on listener: %s", err.Error()))
-		}
+		// Serve each client separately, so one waiting for a confirmation prompt or a new
+		// certificate doesn't hold up the others
+		go func(conn net.Conn) {
+			if err := sshizzleAgent.ServeConn(conn); err != nil && err != io.EOF {
+				log.Println(fmt.Errorf("error serving agent connection: %s", err.Error()))
+			}
+		}(conn)
+	}
+}
+
+// logoutAgent asks the agent listening on socket to forget its certificate and tokens. If
+// no agent is running, or it isn't an sshizzle agent, the token cache is erased directly
+func logoutAgent(socket string) error {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return sshizzleagent.Logout()
+	}
+	defer conn.Close()
+	_, err = agent.NewClient(conn).Extension(sshizzleagent.LogoutExtension, nil)
+	if errors.Is(err, agent.ErrExtensionUnsupported) {
+		// e.g. SSH_AUTH_SOCK belongs to ssh-agent
+		log.Printf("Agent on %s isn't an sshizzle agent, erasing the token cache\n", socket)
+		return sshizzleagent.Logout()
+	}
+	if err != nil {
+		return fmt.Errorf("error sending logout request to agent on %s: %s", socket, err.Error())
 	}
+	return nil
 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/thalesgroup/sshizzle/internal/azure"
+	"github.com/thalesgroup/sshizzle/internal/config"
+	"github.com/thalesgroup/sshizzle/internal/sshizzleagent"
+)
+
+func main() {
+	var approve, deny string
+	flag.StringVar(&approve, "approve", "", "approve the request with this ID")
+	flag.StringVar(&deny, "deny", "", "deny the request with this ID")
+	flag.Parse()
+
+	if approve != "" && deny != "" {
+		log.Fatalln("only one of -approve and -deny can be given")
+	}
+
+	// Sign in with the same config and token cache as sshizzle-agent
+	c, err := config.Check()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	token := sshizzleagent.LoadToken()
+	if token.RefreshToken == "" {
+		if token, err = sshizzleagent.Authenticate(token, c.OauthConfig); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	opts := azure.DefaultInvokeOptions
+	opts.Timeout = c.CATimeout
+	opts.IDToken = c.IDToken
+
+	// Without a decision to make, list the requests waiting for approval
+	if approve == "" && deny == "" {
+		pending, err := azure.ListApprovals(context.Background(), c.FuncHost, c.OauthConfig, token, opts)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("failed to list requests: %s", err.Error()))
+		}
+		printApprovals(pending)
+		return
+	}
+
+	id := approve
+	if deny != "" {
+		id = deny
+	}
+	decided, err := azure.DecideApproval(context.Background(), id, approve != "", c.FuncHost, c.OauthConfig, token, opts)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("failed to decide request: %s", err.Error()))
+	}
+	log.Printf("Request %s by %s for %s %s", decided.ID, decided.Requester, strings.Join(decided.Principals, ","), decided.State)
+	if approve != "" {
+		log.Printf("Certificates can be issued until %s", time.Unix(decided.ExpiresAt, 0).Format(time.RFC3339))
+	}
+}
+
+// printApprovals prints a table of the requests, oldest first
+func printApprovals(approvals []azure.FunctionApproval) {
+	if len(approvals) == 0 {
+		fmt.Println("No requests waiting for approval")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tREQUESTER\tPRINCIPALS\tJUSTIFICATION\tREQUESTED\tEXPIRES")
+	for _, approval := range approvals {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			approval.ID,
+			approval.Requester,
+			strings.Join(approval.Principals, ","),
+			approval.Justification,
+			time.Unix(approval.CreatedAt, 0).Format(time.RFC3339),
+			time.Unix(approval.ExpiresAt, 0).Format(time.RFC3339),
+		)
+	}
+	w.Flush()
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/thalesgroup/sshizzle/internal/azure"
+	"github.com/thalesgroup/sshizzle/internal/breakglass"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+const usage = `Usage: sshizzle-breakglass <command> [flags]
+
+Request an emergency certificate from sshizzle-ca when Azure AD sign in is unavailable.
+
+Commands:
+  request   create a request for a certificate for a public key
+  approve   approve a request with a break-glass private key
+  submit    send an approved request to sshizzle-ca and save the certificate
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "request":
+		err = request(os.Args[2:])
+	case "approve":
+		err = approve(os.Args[2:])
+	case "submit":
+		err = submit(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// request creates a new request file for a public key
+func request(args []string) error {
+	flags := flag.NewFlagSet("request", flag.ExitOnError)
+	keyFile := flags.String("key", "", "public key to request a certificate for, e.g. ~/.ssh/id_ed25519.pub")
+	reason := flags.String("reason", "", "why the certificate is needed, e.g. an incident number")
+	out := flags.String("out", "breakglass-request.json", "file to write the request to")
+	_ = flags.Parse(args)
+
+	if *keyFile == "" {
+		return errors.New("-key is required")
+	}
+	data, err := ioutil.ReadFile(filepath.Clean(*keyFile))
+	if err != nil {
+		return fmt.Errorf("error reading public key: %s", err.Error())
+	}
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return fmt.Errorf("error parsing public key: %s", err.Error())
+	}
+
+	r, err := breakglass.NewRequest(publicKey, *reason)
+	if err != nil {
+		return err
+	}
+	if err := writeRequest(*out, r); err != nil {
+		return err
+	}
+	log.Printf("Request written to %s, it must be approved and submitted within %s\n", *out, breakglass.MaxAge)
+	return nil
+}
+
+// approve signs a request with one of the break-glass private keys
+func approve(args []string) error {
+	flags := flag.NewFlagSet("approve", flag.ExitOnError)
+	requestFile := flags.String("request", "breakglass-request.json", "request to approve")
+	keyFile := flags.String("key", "", "break-glass private key to approve the request with")
+	_ = flags.Parse(args)
+
+	if *keyFile == "" {
+		return errors.New("-key is required")
+	}
+	r, err := readRequest(*requestFile)
+	if err != nil {
+		return err
+	}
+	signer, err := loadSigner(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	// Show the approver exactly what they're approving
+	fmt.Fprintf(os.Stderr, "Public key: %s\nReason:     %s\nCreated:    %s\n",
+		r.PublicKey, r.Reason, time.Unix(r.RequestedAt, 0).Format(time.RFC3339))
+
+	if err := r.Approve(signer); err != nil {
+		return err
+	}
+	if err := writeRequest(*requestFile, r); err != nil {
+		return err
+	}
+	log.Printf("Approved with %s, the request now has %d approvals\n", ssh.FingerprintSHA256(signer.PublicKey()), len(r.Approvals))
+	return nil
+}
+
+// submit sends an approved request to the CA and writes the certificate
+func submit(args []string) error {
+	flags := flag.NewFlagSet("submit", flag.ExitOnError)
+	requestFile := flags.String("request", "breakglass-request.json", "approved request to submit")
+	funcHost := flags.String("host", os.Getenv("AZ_FUNC_HOST"), "host name of the sshizzle-ca function app")
+	out := flags.String("out", "breakglass-cert.pub", "file to write the certificate to")
+	_ = flags.Parse(args)
+
+	if *funcHost == "" {
+		return errors.New("-host or AZ_FUNC_HOST is required")
+	}
+	r, err := readRequest(*requestFile)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: azure.DefaultInvokeOptions.Timeout}
+	response, err := client.Post("https://"+*funcHost+"/api/break-glass", "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("error contacting sshizzle-ca: %s", err.Error())
+	}
+	defer response.Body.Close()
+
+	result := &azure.FunctionResponse{}
+	if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+		return fmt.Errorf("invalid response from sshizzle-ca (HTTP %d): %s", response.StatusCode, err.Error())
+	}
+	if result.Error != nil {
+		return fmt.Errorf("request %s denied (HTTP %d) [%s]: %s", result.RequestID, response.StatusCode, result.Error.Code, result.Error.Message)
+	}
+	if len(result.Certificates) != 1 {
+		return fmt.Errorf("sshizzle-ca returned %d certificates", len(result.Certificates))
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(result.Certificates[0].Certificate)
+	if err != nil {
+		return err
+	}
+	certificate, err := ssh.ParsePublicKey(decoded)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(*out, ssh.MarshalAuthorizedKey(certificate), 0600); err != nil {
+		return fmt.Errorf("error writing certificate: %s", err.Error())
+	}
+	log.Printf("Certificate for %s written to %s, valid until %s\n",
+		strings.Join(result.Certificates[0].Principals, ","), *out,
+		time.Unix(int64(result.Certificates[0].ValidBefore), 0).Format(time.RFC3339))
+	log.Printf("Connect with: ssh -i <private key> -o CertificateFile=%s <user>@<host>\n", *out)
+	return nil
+}
+
+// loadSigner reads a private key, prompting for its passphrase if it's encrypted
+func loadSigner(keyFile string) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(filepath.Clean(keyFile))
+	if err != nil {
+		return nil, fmt.Errorf("error reading private key: %s", err.Error())
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		fmt.Fprintf(os.Stderr, "Enter passphrase for %s: ", keyFile)
+		passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		return ssh.ParsePrivateKeyWithPassphrase(data, passphrase)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing private key: %s", err.Error())
+	}
+	return signer, nil
+}
+
+// readRequest reads a request file
+func readRequest(path string) (*breakglass.Request, error) {
+	data, err := ioutil.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, fmt.Errorf("error reading request: %s", err.Error())
+	}
+	r := &breakglass.Request{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, fmt.Errorf("error parsing request: %s", err.Error())
+	}
+	return r, nil
+}
+
+// writeRequest writes a request file
+func writeRequest(path string, r *breakglass.Request) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("error writing request: %s", err.Error())
+	}
+	return nil
+}
@@ -4,24 +4,36 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
-	"github.com/Azure/azure-sdk-for-go/services/keyvault/v7.0/keyvault"
-	"github.com/Azure/go-autorest/autorest"
 	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/thalesgroup/sshizzle/internal/approval"
 	az "github.com/thalesgroup/sshizzle/internal/azure"
+	"github.com/thalesgroup/sshizzle/internal/breakglass"
+	"github.com/thalesgroup/sshizzle/internal/breakglass/tablecache"
+	"github.com/thalesgroup/sshizzle/internal/justification"
+	"github.com/thalesgroup/sshizzle/internal/ledger"
+	"github.com/thalesgroup/sshizzle/internal/ledger/sqlite"
+	"github.com/thalesgroup/sshizzle/internal/ledger/table"
+	"github.com/thalesgroup/sshizzle/internal/notify"
+	"github.com/thalesgroup/sshizzle/internal/oidc"
+	"github.com/thalesgroup/sshizzle/internal/ratelimit"
 	"github.com/thalesgroup/sshizzle/internal/signer"
+	"github.com/thalesgroup/sshizzle/internal/vault"
 	"golang.org/x/crypto/ssh"
 )
 
-func httpTriggerHandler(ctx context.Context) func(w http.ResponseWriter, r *http.Request) {
+func httpTriggerHandler(ctx context.Context, caSigner signer.CASigner, principals *signer.PrincipalMapper, limiter *ratelimit.Limiter, issued ledger.Ledger, notifier *notify.Notifier, approvals *approval.Workflow, justifications *justification.Policy, sourceAddresses []string) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Get details of this function invocation
 		invocationDetail := signer.FunctionInvocation{
@@ -29,8 +41,9 @@ func httpTriggerHandler(ctx context.Context) func(w http.ResponseWriter, r *http
 			InvocationID:        r.Header.Get("X-Azure-Functions-InvocationId"),
 			ClientPrincipalID:   r.Header.Get("X-Ms-Client-Principal-Id"),
 			ClientPrincipalName: r.Header.Get("X-Ms-Client-Principal-Name"),
-			ClientIP:            strings.Split(r.Header.Get("X-Forwarded-For"), ":")[0],
+			ClientIP:            signer.ClientIP(r.Header.Get("X-Forwarded-For")),
 		}
+		requestID := invocationDetail.InvocationID
 
 		// Initialise a payload object to parse the JSON payload
 		payload := &az.FunctionPayload{}
@@ -38,67 +51,858 @@ func httpTriggerHandler(ctx context.Context) func(w http.ResponseWriter, r *http
 		// Decode the JSON body into our payload
 		err := json.NewDecoder(r.Body).Decode(&payload)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, requestID, http.StatusBadRequest, az.ErrorCodeInvalidRequest, "request body is not valid JSON")
 			return
 		}
+		if payload.Version > az.APIVersion {
+			writeError(w, requestID, http.StatusBadRequest, az.ErrorCodeUnsupportedVersion, fmt.Sprintf("API version %d is not supported, the latest is %d", payload.Version, az.APIVersion))
+			return
+		}
+
+		// Azure App Service Authentication should reject unauthenticated requests before we see them
+		if invocationDetail.ClientPrincipalName == "" {
+			writeError(w, requestID, http.StatusUnauthorized, az.ErrorCodeUnauthenticated, "request is not authenticated")
+			return
+		}
+
+		// Let anyone interested know when policy stops a user getting certificates
+		notifyDenied := func(principals []string, reason string) {
+			notifier.Notify(&notify.Event{
+				Type:          notify.EventDenied,
+				RequestID:     requestID,
+				Requester:     invocationDetail.ClientPrincipalName,
+				ClientIP:      invocationDetail.ClientIP,
+				Principals:    principals,
+				Reason:        reason,
+				Justification: strings.TrimSpace(payload.Justification),
+			})
+		}
 
-		// Decode the public key from base64 (URL encoding)
-		decoded, err := base64.RawURLEncoding.DecodeString(payload.PublicKey)
+		// Work out the user's own principal from their identity
+		if header := r.Header.Get("X-Ms-Client-Principal"); header != "" {
+			if invocationDetail.Claims, err = az.ParseClientPrincipal(header); err != nil {
+				log.Printf("request %s: %s\n", requestID, err.Error())
+			}
+		}
+		if invocationDetail.Principal, err = principals.Principal(&invocationDetail); err != nil {
+			log.Printf("request %s: %s\n", requestID, err.Error())
+			notifyDenied(payload.Principals, "unable to determine principal: "+err.Error())
+			writeError(w, requestID, http.StatusForbidden, az.ErrorCodePolicyDenied, "unable to determine your principal: "+err.Error())
+			return
+		}
+
+		// Stop any one user or address from requesting too many certificates
+		allowed, retryAfter, err := limiter.Allow(ctx, invocationDetail.ClientPrincipalID, invocationDetail.ClientIP)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			// Don't lock everyone out if the rate limit store is unavailable
+			log.Printf("request %s: %s\n", requestID, err.Error())
+		} else if !allowed {
+			notifyDenied([]string{invocationDetail.Principal}, "rate limited")
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			writeError(w, requestID, http.StatusTooManyRequests, az.ErrorCodeRateLimited, "too many certificate requests, try again later")
+			return
+		}
+
+		// Check we've been given a sensible number of keys to sign
+		encodedKeys := payload.Keys()
+		if len(encodedKeys) == 0 || len(encodedKeys) > az.MaxPublicKeys {
+			writeError(w, requestID, http.StatusBadRequest, az.ErrorCodeInvalidRequest, fmt.Sprintf("between 1 and %d public keys must be given", az.MaxPublicKeys))
+			return
+		}
+
+		publicKeys := make([]ssh.PublicKey, 0, len(encodedKeys))
+		for _, encodedKey := range encodedKeys {
+			// Decode the public key from base64 (URL encoding)
+			decoded, err := base64.RawURLEncoding.DecodeString(encodedKey)
+			if err != nil {
+				writeError(w, requestID, http.StatusBadRequest, az.ErrorCodeInvalidPublicKey, "public key is not valid base64")
+				return
+			}
+
+			// Create a PublicKey from the payload
+			publicKey, err := ssh.ParsePublicKey(decoded)
+			if err != nil {
+				writeError(w, requestID, http.StatusBadRequest, az.ErrorCodeInvalidPublicKey, err.Error())
+				return
+			}
+			publicKeys = append(publicKeys, publicKey)
+		}
+
+		// Principals other than the user's own must be approved by someone else first
+		var certOptions signer.CertificateOptions
+		username := invocationDetail.Principal
+		for _, principal := range payload.Principals {
+			if principal == username {
+				continue
+			}
+			if !approvals.IsPrivileged(principal) {
+				notifyDenied([]string{principal}, fmt.Sprintf("principal '%s' can't be requested", principal))
+				writeError(w, requestID, http.StatusForbidden, az.ErrorCodePolicyDenied, fmt.Sprintf("certificates for principal '%s' can't be requested", principal))
+				return
+			}
+			certOptions.Principals = append(certOptions.Principals, principal)
+		}
+
+		// Some principals need a reason, such as a change ticket, which is recorded in the certificates
+		certOptions.Justification = strings.TrimSpace(payload.Justification)
+		if err := justifications.Validate(certOptions.Justification); err != nil {
+			writeError(w, requestID, http.StatusBadRequest, az.ErrorCodeInvalidRequest, err.Error())
 			return
 		}
+		if certOptions.Justification == "" {
+			if principal := justifications.Required(append([]string{username}, certOptions.Principals...)); principal != "" {
+				notifyDenied(append([]string{username}, certOptions.Principals...), fmt.Sprintf("no justification given for principal '%s'", principal))
+				writeError(w, requestID, http.StatusForbidden, az.ErrorCodePolicyDenied, fmt.Sprintf("a justification is required for principal '%s'", principal))
+				return
+			}
+		}
 
-		// Create a PublicKey from the payload
-		publicKey, err := ssh.ParsePublicKey(decoded)
+		// Optionally restrict where the certificates can be used from
+		certOptions.SourceAddress, err = signer.SourceAddress(sourceAddresses, invocationDetail.ClientIP)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Printf("request %s: %s from '%s'\n", requestID, err.Error(), r.Header.Get("X-Forwarded-For"))
+			notifyDenied(append([]string{username}, certOptions.Principals...), err.Error())
+			writeError(w, requestID, http.StatusForbidden, az.ErrorCodePolicyDenied, err.Error())
 			return
 		}
 
-		// Trim the keyvault endpoint to remove the trailing slash
-		keyvaultEndpoint := strings.TrimSuffix(azure.PublicCloud.KeyVaultEndpoint, "/")
+		if len(certOptions.Principals) > 0 {
+			request, err := approvals.Request(ctx, payload.ApprovalID, invocationDetail.ClientPrincipalName, invocationDetail.ClientPrincipalID, certOptions.Principals, certOptions.Justification)
+			if err != nil {
+				log.Printf("request %s: %s\n", requestID, err.Error())
+				writeError(w, requestID, http.StatusServiceUnavailable, az.ErrorCodeCAUnavailable, "unable to check approval")
+				return
+			}
+			switch request.State {
+			case approval.StatePending:
+				// Let the approvers know about new requests
+				if request.ID != payload.ApprovalID {
+					log.Printf("request %s: approval %s for %s requested by %s\n", requestID, request.ID, strings.Join(request.Principals, ","), request.Requester)
+					notifier.Notify(&notify.Event{
+						Type:          notify.EventPending,
+						RequestID:     requestID,
+						Requester:     request.Requester,
+						ClientIP:      invocationDetail.ClientIP,
+						Principals:    request.Principals,
+						ApprovalID:    request.ID,
+						Justification: request.Justification,
+					})
+				}
+				writeJSON(w, requestID, http.StatusAccepted, &az.FunctionResponse{
+					Version:   az.APIVersion,
+					RequestID: requestID,
+					Approval:  functionApproval(request),
+				})
+				return
+			case approval.StateDenied:
+				notifyDenied(request.Principals, "denied by "+request.DecidedBy)
+				writeError(w, requestID, http.StatusForbidden, az.ErrorCodePolicyDenied, fmt.Sprintf("request for %s was denied by %s", strings.Join(request.Principals, ","), request.DecidedBy))
+				return
+			}
+			certOptions.ApprovalID = request.ID
+			certOptions.ApprovedBy = request.DecidedBy
+		}
+
+		// The public key is cached, so this only reaches the key store occasionally
+		if _, err := caSigner.PublicKey(ctx); err != nil {
+			log.Printf("request %s: %s\n", requestID, err.Error())
+			writeError(w, requestID, http.StatusServiceUnavailable, az.ErrorCodeCAUnavailable, "unable to get CA public key from key store")
+			return
+		}
 
-		// Get a service principal token from the MSI valid against the keyvault endpoint
-		spToken, err := az.GetServicePrincipalTokenFromMSI(ctx, keyvaultEndpoint)
+		// Go and sign our public keys!
+		signed, err := signer.SignCertificates(&invocationDetail, caSigner, publicKeys, certOptions)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Printf("request %s: %s\n", requestID, err.Error())
+			writeError(w, requestID, http.StatusServiceUnavailable, az.ErrorCodeCAUnavailable, "unable to sign certificate")
 			return
 		}
 
-		// Create an authorizer using the new Service Principal token
-		authorizer := autorest.NewBearerAuthorizer(spToken)
+		// Don't hand out certificates that can't be traced back to this request later
+		if issued != nil {
+			records := ledger.NewRecords(signed, requestID, invocationDetail.ClientPrincipalName, invocationDetail.ClientPrincipalID, invocationDetail.ClientIP)
+			if err := issued.Record(ctx, records); err != nil {
+				log.Printf("request %s: %s\n", requestID, err.Error())
+				writeError(w, requestID, http.StatusServiceUnavailable, az.ErrorCodeCAUnavailable, "unable to record certificate")
+				return
+			}
+		}
 
-		// Create a KeyVault client and assign an authorizer
-		kvClient := keyvault.New()
-		kvClient.Authorizer = authorizer
+		// Let anyone interested know, without waiting for them
+		event := &notify.Event{
+			Type:          notify.EventIssued,
+			RequestID:     requestID,
+			Requester:     invocationDetail.ClientPrincipalName,
+			ClientIP:      invocationDetail.ClientIP,
+			Justification: certOptions.Justification,
+		}
+		for _, certificate := range signed {
+			event.Principals = append(event.Principals, certificate.ValidPrincipals...)
+			event.Serials = append(event.Serials, certificate.Serial)
+		}
+		notifier.Notify(event)
 
-		// Go and sign our public key!
-		keyvaultName := os.Getenv("KV_NAME")
-		signed, err := signer.SignCertificate(&invocationDetail, &kvClient, keyvaultName, "sshizzle", publicKey)
+		// Create the response to the request in the version the client asked for
+		funcResponse := az.NewFunctionResponse(requestID, signed)
+		if payload.Version < 2 {
+			funcResponse = &az.FunctionResponse{
+				Response: base64.RawURLEncoding.EncodeToString(signed[0].Marshal()),
+			}
+		}
+		writeJSON(w, requestID, http.StatusOK, funcResponse)
+	}
+}
+
+func breakGlassHandler(ctx context.Context, caSigner signer.CASigner, limiter *ratelimit.Limiter, issued ledger.Ledger, notifier *notify.Notifier, breakGlass *breakGlassConfig, sourceAddresses []string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Break-glass requests are made without signing in, as Azure AD may be unavailable
+		invocationDetail := signer.FunctionInvocation{
+			UserAgent:    r.Header.Get("User-Agent"),
+			InvocationID: r.Header.Get("X-Azure-Functions-InvocationId"),
+			ClientIP:     signer.ClientIP(r.Header.Get("X-Forwarded-For")),
+		}
+		requestID := invocationDetail.InvocationID
+
+		if breakGlass == nil {
+			writeError(w, requestID, http.StatusNotFound, az.ErrorCodeInvalidRequest, "break-glass certificates are not enabled")
+			return
+		}
+
+		// Make guessing at approvals slow. Unlike signed in requests, fail closed if the rate
+		// limit store is unavailable, as anyone can reach this endpoint
+		allowed, retryAfter, err := limiter.AllowBreakGlass(ctx, invocationDetail.ClientIP)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Printf("request %s: %s\n", requestID, err.Error())
+			writeError(w, requestID, http.StatusServiceUnavailable, az.ErrorCodeCAUnavailable, "unable to check the rate limit")
+			return
+		}
+		if !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			writeError(w, requestID, http.StatusTooManyRequests, az.ErrorCodeRateLimited, "too many certificate requests, try again later")
 			return
 		}
 
-		// Create the response to the request
-		funcResponse := az.FunctionResponse{
-			Response: base64.RawURLEncoding.EncodeToString(signed.Marshal()),
+		request := &breakglass.Request{}
+		if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+			writeError(w, requestID, http.StatusBadRequest, az.ErrorCodeInvalidRequest, "request body is not valid JSON")
+			return
+		}
+		publicKey, err := request.Key()
+		if err != nil {
+			writeError(w, requestID, http.StatusBadRequest, az.ErrorCodeInvalidPublicKey, err.Error())
+			return
+		}
+
+		// Check enough of the break-glass key holders approved this request
+		approvers, err := breakGlass.verifier.Verify(ctx, request)
+		if err != nil {
+			log.Printf("request %s: BREAK-GLASS request from %s denied: %s\n", requestID, invocationDetail.ClientIP, err.Error())
+			notifier.Notify(&notify.Event{
+				Type:       notify.EventDenied,
+				RequestID:  requestID,
+				Requester:  "break-glass",
+				ClientIP:   invocationDetail.ClientIP,
+				Principals: []string{breakGlass.principal},
+				Reason:     err.Error(),
+			})
+			writeError(w, requestID, http.StatusForbidden, az.ErrorCodePolicyDenied, err.Error())
+			return
+		}
+
+		sourceAddress, err := signer.SourceAddress(sourceAddresses, invocationDetail.ClientIP)
+		if err != nil {
+			log.Printf("request %s: %s from '%s'\n", requestID, err.Error(), r.Header.Get("X-Forwarded-For"))
+			notifier.Notify(&notify.Event{
+				Type:       notify.EventDenied,
+				RequestID:  requestID,
+				Requester:  "break-glass",
+				ClientIP:   invocationDetail.ClientIP,
+				Principals: []string{breakGlass.principal},
+				Reason:     err.Error(),
+			})
+			writeError(w, requestID, http.StatusForbidden, az.ErrorCodePolicyDenied, err.Error())
+			return
 		}
 
-		// Marshal response into JSON
-		js, err := json.Marshal(funcResponse)
+		// The public key is cached, so this only reaches the key store occasionally
+		if _, err := caSigner.PublicKey(ctx); err != nil {
+			log.Printf("request %s: %s\n", requestID, err.Error())
+			writeError(w, requestID, http.StatusServiceUnavailable, az.ErrorCodeCAUnavailable, "unable to get CA public key from key store")
+			return
+		}
+		certificate, err := signer.SignBreakGlassCertificate(&invocationDetail, caSigner, publicKey, breakGlass.principal, breakGlass.validity, request.Reason, approvers, sourceAddress)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Printf("request %s: %s\n", requestID, err.Error())
+			writeError(w, requestID, http.StatusServiceUnavailable, az.ErrorCodeCAUnavailable, "unable to sign certificate")
 			return
 		}
+		signed := []*ssh.Certificate{certificate}
+
+		if issued != nil {
+			records := ledger.NewRecords(signed, requestID, "break-glass", strings.Join(approvers, ","), invocationDetail.ClientIP)
+			if err := issued.Record(ctx, records); err != nil {
+				log.Printf("request %s: %s\n", requestID, err.Error())
+				writeError(w, requestID, http.StatusServiceUnavailable, az.ErrorCodeCAUnavailable, "unable to record certificate")
+				return
+			}
+		}
+
+		notifier.Notify(&notify.Event{
+			Type:       notify.EventBreakGlass,
+			RequestID:  requestID,
+			Requester:  strings.Join(approvers, ","),
+			ClientIP:   invocationDetail.ClientIP,
+			Principals: certificate.ValidPrincipals,
+			Serials:    []uint64{certificate.Serial},
+			Reason:     request.Reason,
+		})
+
+		writeJSON(w, requestID, http.StatusOK, az.NewFunctionResponse(requestID, signed))
+	}
+}
+
+func approvalsHandler(ctx context.Context, approvals *approval.Workflow) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Azure-Functions-InvocationId")
+		principalID := r.Header.Get("X-Ms-Client-Principal-Id")
+		principalName := r.Header.Get("X-Ms-Client-Principal-Name")
+
+		if principalName == "" {
+			writeError(w, requestID, http.StatusUnauthorized, az.ErrorCodeUnauthenticated, "request is not authenticated")
+			return
+		}
+		if !approvals.IsApprover(principalName, principalID) {
+			writeError(w, requestID, http.StatusForbidden, az.ErrorCodePolicyDenied, "not permitted to approve requests")
+			return
+		}
+
+		// List the requests waiting for approval
+		if r.Method == http.MethodGet {
+			pending, err := approvals.Pending(ctx)
+			if err != nil {
+				log.Printf("request %s: %s\n", requestID, err.Error())
+				writeError(w, requestID, http.StatusServiceUnavailable, az.ErrorCodeCAUnavailable, "unable to list approvals")
+				return
+			}
+			response := &az.FunctionResponse{
+				Version:   az.APIVersion,
+				RequestID: requestID,
+				Approvals: []az.FunctionApproval{},
+			}
+			for _, request := range pending {
+				response.Approvals = append(response.Approvals, *functionApproval(request))
+			}
+			writeJSON(w, requestID, http.StatusOK, response)
+			return
+		}
+
+		// Otherwise approve or deny a request
+		payload := &az.ApprovalPayload{}
+		if err := json.NewDecoder(r.Body).Decode(payload); err != nil || payload.ID == "" {
+			writeError(w, requestID, http.StatusBadRequest, az.ErrorCodeInvalidRequest, "request body must contain the id of the request to approve")
+			return
+		}
+		request, err := approvals.Decide(ctx, payload.ID, principalName, principalID, payload.Approve)
+		if errors.Is(err, approval.ErrNotFound) {
+			writeError(w, requestID, http.StatusNotFound, az.ErrorCodeInvalidRequest, err.Error())
+			return
+		}
+		if err != nil {
+			writeError(w, requestID, http.StatusConflict, az.ErrorCodeInvalidRequest, err.Error())
+			return
+		}
+		log.Printf("request %s: approval %s for %s requested by %s %s by %s\n", requestID, request.ID, strings.Join(request.Principals, ","), request.Requester, request.State, principalName)
+
+		writeJSON(w, requestID, http.StatusOK, &az.FunctionResponse{
+			Version:   az.APIVersion,
+			RequestID: requestID,
+			Approval:  functionApproval(request),
+		})
+	}
+}
+
+// functionApproval describes an approval request in an API response
+func functionApproval(request *approval.Request) *az.FunctionApproval {
+	return &az.FunctionApproval{
+		ID:            request.ID,
+		State:         request.State,
+		Requester:     request.Requester,
+		Principals:    request.Principals,
+		CreatedAt:     request.CreatedAt.Unix(),
+		ExpiresAt:     request.ExpiresAt.Unix(),
+		DecidedBy:     request.DecidedBy,
+		Justification: request.Justification,
+	}
+}
+
+func lookupHandler(ctx context.Context, issued ledger.Ledger, readers map[string]bool) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Azure-Functions-InvocationId")
+		principalID := r.Header.Get("X-Ms-Client-Principal-Id")
+		principalName := r.Header.Get("X-Ms-Client-Principal-Name")
+
+		// Only the configured readers may see who was issued what
+		if principalName == "" {
+			writeError(w, requestID, http.StatusUnauthorized, az.ErrorCodeUnauthenticated, "request is not authenticated")
+			return
+		}
+		if !readers[strings.ToLower(principalID)] && !readers[strings.ToLower(principalName)] {
+			log.Printf("request %s: ledger lookup by %s denied\n", requestID, principalName)
+			writeError(w, requestID, http.StatusForbidden, az.ErrorCodePolicyDenied, "not permitted to read the certificate ledger")
+			return
+		}
+		if issued == nil {
+			writeError(w, requestID, http.StatusNotFound, az.ErrorCodeInvalidRequest, "the certificate ledger is not enabled")
+			return
+		}
+
+		query, err := ledger.ParseQuery(r.URL.Query())
+		if err != nil {
+			writeError(w, requestID, http.StatusBadRequest, az.ErrorCodeInvalidRequest, err.Error())
+			return
+		}
+		records, err := issued.Lookup(ctx, query)
+		if err != nil {
+			log.Printf("request %s: %s\n", requestID, err.Error())
+			writeError(w, requestID, http.StatusServiceUnavailable, az.ErrorCodeCAUnavailable, "unable to read the certificate ledger")
+			return
+		}
+		log.Printf("request %s: ledger lookup by %s: %s\n", requestID, principalName, query.Values().Encode())
+
+		writeJSON(w, requestID, http.StatusOK, &az.FunctionResponse{
+			Version:   az.APIVersion,
+			RequestID: requestID,
+			Records:   functionRecords(records),
+		})
+	}
+}
+
+// functionRecords describes ledger records in an API response. az.FunctionRecord has the same
+// fields as ledger.Record, so this stops compiling if they drift apart
+func functionRecords(records []ledger.Record) []az.FunctionRecord {
+	result := make([]az.FunctionRecord, 0, len(records))
+	for _, record := range records {
+		result = append(result, az.FunctionRecord(record))
+	}
+	return result
+}
+
+// newCASigner returns a signer for the CA key in the Vault transit engine if VAULT_ADDR is set,
+// otherwise in Azure Key Vault
+func newCASigner(cloud azure.Environment) (signer.CASigner, error) {
+	if os.Getenv("VAULT_ADDR") == "" {
+		return newKeyVaultSigner(cloud)
+	}
+	config, err := vault.ConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if config.Key == "" {
+		config.Key = "sshizzle"
+	}
+	return vault.NewTransitSigner(*config)
+}
+
+// newKeyVaultSigner returns a signer for the CA key in the KV_HSM_NAME managed HSM if set, or
+// otherwise the KV_NAME Key Vault, authorized with the function's managed identity or another
+// credential from the environment, see az.NewDefaultCredential. KV_KEY_VERSION pins the version of
+// the key. It's shared by all invocations, so the access token and public key are cached between them
+func newKeyVaultSigner(cloud azure.Environment) (*az.KeyVaultSigner, error) {
+	credential, err := az.NewDefaultCredential(cloud.ActiveDirectoryEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	keyVersion := os.Getenv("KV_KEY_VERSION")
+	if hsmName := os.Getenv("KV_HSM_NAME"); hsmName != "" {
+		hsmURL, err := az.ManagedHSMURL(cloud, hsmName)
+		if err != nil {
+			return nil, err
+		}
+		authorizer := az.NewAuthorizer(credential, az.ManagedHSMResource(cloud))
+		return az.NewKeyVaultSigner(az.NewKeyVaultClient(authorizer, true), hsmURL, "sshizzle", keyVersion), nil
+	}
+	authorizer := az.NewAuthorizer(credential, az.KeyVaultResource(cloud))
+	return az.NewKeyVaultSigner(az.NewKeyVaultClient(authorizer, false), az.KeyVaultURL(cloud, os.Getenv("KV_NAME")), "sshizzle", keyVersion), nil
+}
+
+// breakGlassConfig controls the issue of emergency certificates
+type breakGlassConfig struct {
+	verifier  *breakglass.Verifier
+	principal string
+	validity  time.Duration
+}
+
+// newBreakGlassConfig reads the BREAK_GLASS_* app settings, or returns nil if break-glass
+// certificates aren't enabled
+func newBreakGlassConfig() (*breakGlassConfig, error) {
+	keys, err := breakglass.ParseKeys(os.Getenv("BREAK_GLASS_KEYS"))
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	// A single offline credential is enough unless a threshold is given
+	threshold := 1
+	if value := os.Getenv("BREAK_GLASS_THRESHOLD"); value != "" {
+		if threshold, err = strconv.Atoi(value); err != nil {
+			return nil, fmt.Errorf("invalid BREAK_GLASS_THRESHOLD '%s'", value)
+		}
+	}
+
+	// Requests can only be used once, on any instance if they share a table
+	var used breakglass.ReplayCache
+	switch os.Getenv("BREAK_GLASS_STORE") {
+	case "", "memory":
+		used = breakglass.NewMemoryCache()
+	case "table":
+		// Default to the storage account used by the function app itself
+		connectionString := os.Getenv("BREAK_GLASS_STORAGE_CONNECTION_STRING")
+		if connectionString == "" {
+			connectionString = os.Getenv("AzureWebJobsStorage")
+		}
+		tableName := os.Getenv("BREAK_GLASS_TABLE")
+		if tableName == "" {
+			tableName = "sshizzlebreakglass"
+		}
+		if used, err = tablecache.NewCache(connectionString, tableName); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("invalid BREAK_GLASS_STORE '%s', must be 'memory' or 'table'", os.Getenv("BREAK_GLASS_STORE"))
+	}
+	verifier, err := breakglass.NewVerifier(keys, threshold, used)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &breakGlassConfig{
+		verifier:  verifier,
+		principal: breakGlassPrincipal(),
+		validity:  15 * time.Minute,
+	}
+	if value := os.Getenv("BREAK_GLASS_VALIDITY"); value != "" {
+		config.validity, err = time.ParseDuration(value)
+		if err != nil || config.validity <= 0 || config.validity > breakglass.MaxValidity {
+			return nil, fmt.Errorf("invalid BREAK_GLASS_VALIDITY '%s', must be a duration of up to %s", value, breakglass.MaxValidity)
+		}
+	}
+	return config, nil
+}
 
-		// Set the content-type and write the response
-		w.Header().Set("Content-Type", "application/json")
-		_, err = w.Write(js)
+// breakGlassPrincipal returns the principal break-glass certificates are issued for
+func breakGlassPrincipal() string {
+	if principal := os.Getenv("BREAK_GLASS_PRINCIPAL"); principal != "" {
+		return principal
+	}
+	return breakglass.DefaultPrincipal
+}
+
+// oidcConfig authenticates requests with ID tokens from an OIDC provider instead of App Service
+// Authentication
+type oidcConfig struct {
+	verifier *oidc.Verifier
+	// groups the user must be in one of, or empty to allow anyone the provider signs in
+	groups []string
+	// verifiedEmail is true if principals are derived from the email claim, which the provider
+	// must then have verified
+	verifiedEmail bool
+}
+
+// newOIDCConfig reads the OIDC_* app settings, or returns nil if requests are authenticated by
+// App Service Authentication
+func newOIDCConfig(ctx context.Context) (*oidcConfig, error) {
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return nil, nil
+	}
+	clientID := os.Getenv("OIDC_CLIENT_ID")
+	if clientID == "" {
+		return nil, errors.New("OIDC_CLIENT_ID must be set with OIDC_ISSUER")
+	}
+	usernameClaim := os.Getenv("OIDC_USERNAME_CLAIM")
+	if usernameClaim == "" {
+		usernameClaim = "email"
+	}
+	groupsClaim := os.Getenv("OIDC_GROUPS_CLAIM")
+	if groupsClaim == "" {
+		groupsClaim = "groups"
+	}
+	provider, err := oidc.Discover(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+	return &oidcConfig{
+		verifier:      oidc.NewVerifier(provider, clientID, usernameClaim, groupsClaim),
+		groups:        splitList(os.Getenv("OIDC_GROUPS")),
+		verifiedEmail: os.Getenv("USERNAME_CLAIM") == "email",
+	}, nil
+}
+
+// withOIDC verifies the ID token requests are made with, and passes the user on to the
+// handlers in the same headers App Service Authentication uses. Requests without a token are
+// passed on unauthenticated, for break-glass certificates
+func withOIDC(next http.Handler, config *oidcConfig) http.Handler {
+	if config == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Azure-Functions-InvocationId")
+		// Nothing sets these headers in front of us, so don't trust the client's
+		r.Header.Del("X-Ms-Client-Principal")
+		r.Header.Del("X-Ms-Client-Principal-Id")
+		r.Header.Del("X-Ms-Client-Principal-Name")
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token != "" {
+			identity, err := config.verifier.Verify(r.Context(), token)
+			if err != nil {
+				log.Printf("request %s: %s\n", requestID, err.Error())
+				writeError(w, requestID, http.StatusUnauthorized, az.ErrorCodeUnauthenticated, "request is not authenticated")
+				return
+			}
+			if config.verifiedEmail && !identity.EmailVerified {
+				log.Printf("request %s: email address of %s isn't verified\n", requestID, identity.Username)
+				writeError(w, requestID, http.StatusForbidden, az.ErrorCodePolicyDenied, "your email address hasn't been verified by the identity provider")
+				return
+			}
+			if !identity.InGroup(config.groups) {
+				log.Printf("request %s: %s is not in any of the groups %s\n", requestID, identity.Username, strings.Join(config.groups, ","))
+				writeError(w, requestID, http.StatusForbidden, az.ErrorCodePolicyDenied, "you are not in a group allowed to use sshizzle")
+				return
+			}
+			r.Header.Set("X-Ms-Client-Principal-Id", identity.Subject)
+			r.Header.Set("X-Ms-Client-Principal-Name", identity.Username)
+			r.Header.Set("X-Ms-Client-Principal", az.EncodeClientPrincipal("oidc", identity.Claims))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// newPrincipalMapper reads the USERNAME_* app settings. Without them the principal is the
+// user's principal name up to the "@". Users are never given the break-glass principal or
+// one of the APPROVAL_PRINCIPALS as their own
+func newPrincipalMapper() (*signer.PrincipalMapper, error) {
+	claim := os.Getenv("USERNAME_CLAIM")
+	pattern := os.Getenv("USERNAME_PATTERN")
+	domains := splitList(os.Getenv("USERNAME_DOMAINS"))
+	tableFile := os.Getenv("USERNAME_TABLE")
+	var table map[string]string
+	if tableFile != "" {
+		var err error
+		if table, err = signer.LoadPrincipalTable(tableFile); err != nil {
+			return nil, err
+		}
+	}
+	mapper, err := signer.NewPrincipalMapper(claim, pattern, os.Getenv("USERNAME_REPLACEMENT"), domains, table)
+	if err != nil {
+		return nil, err
+	}
+	mapper.Reserve(breakGlassPrincipal())
+	mapper.Reserve(splitList(os.Getenv("APPROVAL_PRINCIPALS"))...)
+	return mapper, nil
+}
+
+// newJustificationPolicy creates the policy for justifications from the JUSTIFICATION_PATTERN and
+// JUSTIFICATION_PRINCIPALS app settings
+func newJustificationPolicy() (*justification.Policy, error) {
+	return justification.NewPolicy(os.Getenv("JUSTIFICATION_PATTERN"), splitList(os.Getenv("JUSTIFICATION_PRINCIPALS")))
+}
+
+// newApprovalWorkflow creates the approval workflow from the APPROVAL_* app settings, or returns
+// nil if no principals require approval
+func newApprovalWorkflow() (*approval.Workflow, error) {
+	principals := splitList(os.Getenv("APPROVAL_PRINCIPALS"))
+	if len(principals) == 0 {
+		return nil, nil
+	}
+	approvers := splitList(os.Getenv("APPROVERS"))
+	if len(approvers) == 0 {
+		return nil, errors.New("APPROVERS must be set if APPROVAL_PRINCIPALS is")
+	}
+
+	timeout, err := durationSetting("APPROVAL_TIMEOUT", 15*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	grant, err := durationSetting("APPROVAL_GRANT", time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	var store approval.Store
+	switch os.Getenv("APPROVAL_STORE") {
+	case "", "memory":
+		store = approval.NewMemoryStore()
+	case "table":
+		// Default to the storage account used by the function app itself
+		connectionString := os.Getenv("APPROVAL_STORAGE_CONNECTION_STRING")
+		if connectionString == "" {
+			connectionString = os.Getenv("AzureWebJobsStorage")
+		}
+		tableName := os.Getenv("APPROVAL_TABLE")
+		if tableName == "" {
+			tableName = "sshizzleapprovals"
+		}
+		store, err = approval.NewTableStore(connectionString, tableName)
 		if err != nil {
-			log.Println(fmt.Errorf("error writing response: %s", err.Error()))
+			return nil, err
 		}
+	default:
+		return nil, fmt.Errorf("invalid APPROVAL_STORE '%s', must be 'memory' or 'table'", os.Getenv("APPROVAL_STORE"))
+	}
+	return approval.NewWorkflow(store, principals, approvers, timeout, grant), nil
+}
+
+// durationSetting reads a duration from an app setting, or returns the default if not set
+func durationSetting(name string, defaultValue time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("invalid %s '%s', must be a duration such as 15m", name, value)
+	}
+	return duration, nil
+}
+
+// splitList splits a comma separated app setting, ignoring empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// newLedger creates the certificate ledger from the LEDGER_* app settings, or returns nil if
+// the ledger isn't configured
+func newLedger() (ledger.Ledger, error) {
+	switch os.Getenv("LEDGER_STORE") {
+	case "":
+		return nil, nil
+	case "sqlite":
+		path := os.Getenv("LEDGER_SQLITE_PATH")
+		if path == "" {
+			path = "sshizzle-ledger.db"
+		}
+		return sqlite.NewLedger(path)
+	case "table":
+		// Default to the storage account used by the function app itself
+		connectionString := os.Getenv("LEDGER_STORAGE_CONNECTION_STRING")
+		if connectionString == "" {
+			connectionString = os.Getenv("AzureWebJobsStorage")
+		}
+		tableName := os.Getenv("LEDGER_TABLE")
+		if tableName == "" {
+			tableName = "sshizzleledger"
+		}
+		return table.NewLedger(connectionString, tableName)
+	default:
+		return nil, fmt.Errorf("invalid LEDGER_STORE '%s', must be 'sqlite' or 'table'", os.Getenv("LEDGER_STORE"))
+	}
+}
+
+// ledgerReaders returns the principal IDs and names in LEDGER_READERS, which may query the ledger
+func ledgerReaders() map[string]bool {
+	readers := make(map[string]bool)
+	for _, reader := range strings.Split(os.Getenv("LEDGER_READERS"), ",") {
+		if reader = strings.TrimSpace(reader); reader != "" {
+			readers[strings.ToLower(reader)] = true
+		}
+	}
+	return readers
+}
+
+// newNotifier creates a notifier for the webhooks in the NOTIFY_WEBHOOKS app setting, or
+// returns nil if there aren't any
+func newNotifier() (*notify.Notifier, error) {
+	value := os.Getenv("NOTIFY_WEBHOOKS")
+	if value == "" {
+		return nil, nil
+	}
+	webhooks, err := notify.ParseWebhooks(value)
+	if err != nil {
+		return nil, err
+	}
+	return notify.NewNotifier(webhooks), nil
+}
+
+// newRateLimiter creates a rate limiter from the RATE_LIMIT_* app settings, or returns nil
+// if rate limiting isn't configured
+func newRateLimiter() (*ratelimit.Limiter, error) {
+	principalLimit, err := ratelimit.ParseLimit(os.Getenv("RATE_LIMIT_PRINCIPAL"))
+	if err != nil {
+		return nil, err
+	}
+	ipLimit, err := ratelimit.ParseLimit(os.Getenv("RATE_LIMIT_IP"))
+	if err != nil {
+		return nil, err
+	}
+	breakGlassLimit, err := ratelimit.ParseLimit(os.Getenv("RATE_LIMIT_BREAK_GLASS"))
+	if err != nil {
+		return nil, err
+	}
+	if !principalLimit.Enabled() && !ipLimit.Enabled() && !breakGlassLimit.Enabled() {
+		return nil, nil
+	}
+
+	var store ratelimit.Store
+	switch os.Getenv("RATE_LIMIT_STORE") {
+	case "", "memory":
+		store = ratelimit.NewMemoryStore()
+	case "table":
+		// Default to the storage account used by the function app itself
+		connectionString := os.Getenv("RATE_LIMIT_STORAGE_CONNECTION_STRING")
+		if connectionString == "" {
+			connectionString = os.Getenv("AzureWebJobsStorage")
+		}
+		tableName := os.Getenv("RATE_LIMIT_TABLE")
+		if tableName == "" {
+			tableName = "sshizzleratelimits"
+		}
+		store, err = ratelimit.NewTableStore(connectionString, tableName)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("invalid RATE_LIMIT_STORE '%s', must be 'memory' or 'table'", os.Getenv("RATE_LIMIT_STORE"))
+	}
+	return ratelimit.NewLimiter(store, principalLimit, ipLimit, breakGlassLimit), nil
+}
+
+// writeError writes a structured error response
+func writeError(w http.ResponseWriter, requestID string, status int, code string, message string) {
+	writeJSON(w, requestID, status, &az.FunctionResponse{
+		Version:   az.APIVersion,
+		RequestID: requestID,
+		Error: &az.FunctionError{
+			Code:    code,
+			Message: message,
+		},
+	})
+}
+
+// writeJSON writes a response as JSON, echoing the request ID in the headers
+func writeJSON(w http.ResponseWriter, requestID string, status int, response *az.FunctionResponse) {
+	// Marshal response into JSON
+	js, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Set the content-type and write the response
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Request-Id", requestID)
+	w.WriteHeader(status)
+	_, err = w.Write(js)
+	if err != nil {
+		log.Println(fmt.Errorf("error writing response: %s", err.Error()))
 	}
 }
 
@@ -109,12 +913,71 @@ func main() {
 	if exists {
 		log.Printf("FUNCTIONS_HTTPWORKER_PORT: %s\n", httpInvokerPort)
 	}
+	cloud, err := az.ParseEnvironment(os.Getenv(az.EnvironmentVariable))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	caSigner, err := newCASigner(cloud)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("error configuring CA key: %s", err.Error()))
+	}
+
+	limiter, err := newRateLimiter()
+	if err != nil {
+		log.Fatalln(fmt.Errorf("error configuring rate limits: %s", err.Error()))
+	}
+
+	issued, err := newLedger()
+	if err != nil {
+		log.Fatalln(fmt.Errorf("error configuring certificate ledger: %s", err.Error()))
+	}
+
+	notifier, err := newNotifier()
+	if err != nil {
+		log.Fatalln(fmt.Errorf("error configuring notifications: %s", err.Error()))
+	}
+
+	breakGlass, err := newBreakGlassConfig()
+	if err != nil {
+		log.Fatalln(fmt.Errorf("error configuring break-glass certificates: %s", err.Error()))
+	}
+
+	approvals, err := newApprovalWorkflow()
+	if err != nil {
+		log.Fatalln(fmt.Errorf("error configuring approvals: %s", err.Error()))
+	}
+
+	justifications, err := newJustificationPolicy()
+	if err != nil {
+		log.Fatalln(fmt.Errorf("error configuring justifications: %s", err.Error()))
+	}
+
+	principals, err := newPrincipalMapper()
+	if err != nil {
+		log.Fatalln(fmt.Errorf("error configuring principals: %s", err.Error()))
+	}
+
+	// Optionally bind certificates to the client's address or the corporate network
+	sourceAddresses, err := signer.ParseSourceAddresses(splitList(os.Getenv("SOURCE_ADDRESS")))
+	if err != nil {
+		log.Fatalln(fmt.Errorf("error configuring SOURCE_ADDRESS: %s", err.Error()))
+	}
+
+	// Authenticate requests with an OIDC provider if one is configured
+	oidcAuth, err := newOIDCConfig(ctx)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("error configuring OIDC: %s", err.Error()))
+	}
+
 	mux := http.NewServeMux()
-	mux.HandleFunc("/sign-agent-key", httpTriggerHandler(ctx))
+	mux.HandleFunc("/sign-agent-key", httpTriggerHandler(ctx, caSigner, principals, limiter, issued, notifier, approvals, justifications, sourceAddresses))
+	mux.HandleFunc("/approvals", approvalsHandler(ctx, approvals))
+	mux.HandleFunc("/break-glass", breakGlassHandler(ctx, caSigner, limiter, issued, notifier, breakGlass, sourceAddresses))
+	mux.HandleFunc("/lookup-certificates", lookupHandler(ctx, issued, ledgerReaders()))
 
 	server := &http.Server{
 		Addr:           ":" + httpInvokerPort,
-		Handler:        mux,
+		Handler:        withOIDC(mux, oidcAuth),
 		ReadTimeout:    10 * time.Second,
 		WriteTimeout:   10 * time.Second,
 		MaxHeaderBytes: 1 << 20,
@@ -135,12 +998,14 @@ func main() {
 		if err := server.Shutdown(shutdownCtx); err != nil {
 			log.Fatalf("HTTP server shutdown error: %v\n", err)
 		}
+		// Deliver any notifications still waiting
+		notifier.Close(shutdownCtx)
 		shutdownCancel()
 		close(idleConnsClosed)
 	}()
 
 	log.Println("Go server Listening...on httpInvokerPort:", httpInvokerPort)
-	err := server.ListenAndServe()
+	err = server.ListenAndServe()
 	if err != nil && err != http.ErrServerClosed {
 		log.Fatalln(err)
 	}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// stateFile records the files sshizzle-host has changed, and what they were before, so they can
+// be restored by `sshizzle-host uninstall`
+const stateFile = "/var/lib/sshizzle/host-state.json"
+
+// fileChange is a file sshizzle-host writes, or removes if content is nil
+type fileChange struct {
+	path    string
+	content []byte
+	mode    os.FileMode
+	// restore is true if the file is put back as it was on uninstall. sshd_config isn't, as
+	// the admin may edit it in the meantime, so only the sshizzle block is taken out of it
+	restore bool
+}
+
+// changeSet is a list of file changes, applied together
+type changeSet []fileChange
+
+// savedFile is the state of a file before sshizzle-host first changed it
+type savedFile struct {
+	Existed bool        `json:"existed"`
+	Content []byte      `json:"content,omitempty"`
+	Mode    os.FileMode `json:"mode,omitempty"`
+}
+
+// hostState is the content of the state file
+type hostState struct {
+	Files map[string]*savedFile `json:"files"`
+}
+
+// loadState reads the state file, returning an empty state if there isn't one
+func loadState() (*hostState, error) {
+	state := &hostState{Files: make(map[string]*savedFile)}
+	data, exists, err := readFile(stateFile)
+	if err != nil || !exists {
+		return state, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("unable to read %s: %s", stateFile, err.Error())
+	}
+	if state.Files == nil {
+		state.Files = make(map[string]*savedFile)
+	}
+	return state, nil
+}
+
+// save writes the state file
+func (s *hostState) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(stateFile), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(stateFile, data, 0600)
+}
+
+// diff writes a unified diff of the changes to w, returning false if nothing would change
+func (c changeSet) diff(w io.Writer) (bool, error) {
+	changed := false
+	for _, change := range c {
+		current, exists, err := readFile(change.path)
+		if err != nil {
+			return false, err
+		}
+		if exists == (change.content != nil) && bytes.Equal(current, change.content) {
+			continue
+		}
+		changed = true
+		from, to := change.path, change.path
+		if !exists {
+			from = "/dev/null"
+		}
+		if change.content == nil {
+			to = "/dev/null"
+		}
+		_, _ = fmt.Fprintf(w, "--- %s\n+++ %s\n", from, to)
+		_, _ = io.WriteString(w, unifiedDiff(string(current), string(change.content)))
+	}
+	return changed, nil
+}
+
+// apply makes the changes, recording the original state of files to restore in state, then
+// checks the new sshd config with `sshd -t`, putting everything back if it's invalid. It returns
+// false if nothing needed to change
+func (c changeSet) apply(state *hostState) (bool, error) {
+	var applied []fileChange
+	var previous [][]byte
+	rollback := func(cause error) error {
+		for i := len(applied) - 1; i >= 0; i-- {
+			change := applied[i]
+			change.content = previous[i]
+			// A failed rollback leaves the files as they are; sshd is only reloaded on success
+			_ = change.write()
+		}
+		return cause
+	}
+
+	for _, change := range c {
+		current, exists, err := readFile(change.path)
+		if err != nil {
+			return false, rollback(err)
+		}
+		if exists == (change.content != nil) && bytes.Equal(current, change.content) {
+			continue
+		}
+		if _, ok := state.Files[change.path]; change.restore && !ok {
+			saved := &savedFile{Existed: exists, Content: current}
+			if info, err := os.Stat(change.path); err == nil {
+				saved.Mode = info.Mode().Perm()
+			}
+			state.Files[change.path] = saved
+		}
+		// Keep the mode of files being replaced
+		if info, err := os.Stat(change.path); err == nil {
+			change.mode = info.Mode().Perm()
+		}
+		if err := change.write(); err != nil {
+			return false, rollback(err)
+		}
+		applied = append(applied, change)
+		if exists {
+			previous = append(previous, current)
+		} else {
+			previous = append(previous, nil)
+		}
+	}
+	if len(applied) == 0 {
+		return false, nil
+	}
+	if err := validateSSHD(); err != nil {
+		return false, rollback(err)
+	}
+	return true, nil
+}
+
+// write makes a single change
+func (f fileChange) write() error {
+	if f.content == nil {
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to remove %s: %s", f.path, err.Error())
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+		return fmt.Errorf("unable to create %s: %s", filepath.Dir(f.path), err.Error())
+	}
+	if err := writeFileAtomic(f.path, f.content, f.mode); err != nil {
+		return fmt.Errorf("unable to write %s: %s", f.path, err.Error())
+	}
+	return nil
+}
+
+// writeFileAtomic writes a file by renaming a temporary file over it, so sshd never reads a
+// partially written file
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	// Only does anything if the rename doesn't happen
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		from     string
+		to       string
+		expected string
+	}{
+		{name: "unchanged", from: "a\nb\n", to: "a\nb\n", expected: ""},
+		{name: "new file", from: "", to: "a\nb\n", expected: "@@ -0,0 +1,2 @@\n+a\n+b\n"},
+		{name: "removed file", from: "a\n", to: "", expected: "@@ -1,1 +0,0 @@\n-a\n"},
+		{name: "changed line", from: "a\nb\nc\n", to: "a\nB\nc\n", expected: "@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n"},
+		{
+			name:     "context limited",
+			from:     "1\n2\n3\n4\n5\n6\n7\n8\n9\n",
+			to:       "1\n2\n3\n4\nfive\n6\n7\n8\n9\n",
+			expected: "@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n",
+		},
+		{
+			name:     "separate hunks",
+			from:     "a\n1\n2\n3\n4\n5\n6\n7\n8\nb\n",
+			to:       "A\n1\n2\n3\n4\n5\n6\n7\n8\nB\n",
+			expected: "@@ -1,4 +1,4 @@\n-a\n+A\n 1\n 2\n 3\n@@ -7,4 +7,4 @@\n 6\n 7\n 8\n-b\n+B\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if diff := unifiedDiff(test.from, test.to); diff != test.expected {
+				t.Errorf("got:\n%s\nexpected:\n%s", diff, test.expected)
+			}
+		})
+	}
+}
+
+func TestChangeSetDiff(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "existing")
+	if err := os.WriteFile(existing, []byte("a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	changes := changeSet{
+		{path: existing, content: []byte("a\n")},
+		{path: filepath.Join(dir, "new"), content: []byte("b\n")},
+	}
+	var out bytes.Buffer
+	changed, err := changes.diff(&out)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !changed {
+		t.Fatal("expected a change")
+	}
+	expected := "--- /dev/null\n+++ " + filepath.Join(dir, "new") + "\n@@ -0,0 +1,1 @@\n+b\n"
+	if out.String() != expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", out.String(), expected)
+	}
+
+	out.Reset()
+	if changed, err := changes[:1].diff(&out); err != nil || changed || out.Len() != 0 {
+		t.Errorf("expected no changes, got %t %v %q", changed, err, out.String())
+	}
+}
+
+func TestChangeSetApply(t *testing.T) {
+	tests := []struct {
+		name     string
+		validate error
+		changed  bool
+	}{
+		{name: "valid config", changed: true},
+		{name: "invalid config rolled back", validate: errors.New("sshd config is invalid")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			existing := filepath.Join(dir, "sshd_config")
+			created := filepath.Join(dir, "sshd_config.d", "50-sshizzle.conf")
+			removed := filepath.Join(dir, "old")
+			if err := os.WriteFile(existing, []byte("Port 22\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(removed, []byte("old\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			validated := false
+			original := validateSSHD
+			validateSSHD = func() error {
+				validated = true
+				return test.validate
+			}
+			defer func() { validateSSHD = original }()
+
+			state := &hostState{Files: make(map[string]*savedFile)}
+			changes := changeSet{
+				{path: existing, content: []byte("Port 2222\n"), mode: 0644},
+				{path: created, content: []byte("TrustedUserCAKeys /etc/ssh/user_ca.pub\n"), mode: 0644, restore: true},
+				{path: removed, content: nil, restore: true},
+			}
+			changed, err := changes.apply(state)
+			if !validated {
+				t.Fatal("sshd config wasn't validated")
+			}
+			if test.validate != nil {
+				if err == nil || !strings.Contains(err.Error(), "invalid") {
+					t.Fatalf("expected validation error, got %v", err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if changed != test.changed {
+				t.Fatalf("got changed %t, expected %t", changed, test.changed)
+			}
+
+			content, _, _ := readFile(existing)
+			_, createdExists, _ := readFile(created)
+			_, removedExists, _ := readFile(removed)
+			if test.validate != nil {
+				if string(content) != "Port 22\n" || createdExists || !removedExists {
+					t.Fatalf("files weren't rolled back: %q, created %t, removed %t", content, createdExists, !removedExists)
+				}
+				return
+			}
+			if string(content) != "Port 2222\n" || !createdExists || removedExists {
+				t.Fatalf("files weren't changed: %q, created %t, removed %t", content, createdExists, !removedExists)
+			}
+			// The mode of replaced files is kept
+			if info, err := os.Stat(existing); err != nil || info.Mode().Perm() != 0600 {
+				t.Errorf("mode of %s changed", existing)
+			}
+			// Only files to restore on uninstall are recorded, as they were
+			if _, ok := state.Files[existing]; ok {
+				t.Error("sshd_config recorded to restore")
+			}
+			if saved := state.Files[created]; saved == nil || saved.Existed {
+				t.Error("created file not recorded as new")
+			}
+			if saved := state.Files[removed]; saved == nil || !saved.Existed || string(saved.Content) != "old\n" {
+				t.Error("removed file not recorded with its content")
+			}
+
+			// Applying again changes nothing, and doesn't need validating
+			validated = false
+			if changed, err := changes.apply(state); err != nil || changed || validated {
+				t.Errorf("expected no changes, got %t %v", changed, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around each change
+const diffContext = 3
+
+// diffLine is a line of a diff, prefixed with ' ', '-' or '+'
+type diffLine struct {
+	op   byte
+	text string
+}
+
+// unifiedDiff returns the hunks of a unified diff between two texts. Config files are small, so
+// the longest common subsequence is found directly
+func unifiedDiff(from string, to string) string {
+	a, b := splitLines(from), splitLines(to)
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var lines []diffLine
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, diffLine{' ', a[i]})
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] > lcs[i+1][j]):
+			lines = append(lines, diffLine{'+', b[j]})
+			j++
+		default:
+			lines = append(lines, diffLine{'-', a[i]})
+			i++
+		}
+	}
+
+	// Group the changes into hunks with some context
+	var out strings.Builder
+	for start := 0; start < len(lines); {
+		if lines[start].op == ' ' {
+			start++
+			continue
+		}
+		first := start - diffContext
+		if first < 0 {
+			first = 0
+		}
+		// Extend the hunk until there are more than two contexts' worth of unchanged lines
+		last, unchanged := start, 0
+		for k := start; k < len(lines) && unchanged <= 2*diffContext; k++ {
+			if lines[k].op == ' ' {
+				unchanged++
+			} else {
+				last, unchanged = k, 0
+			}
+		}
+		end := last + diffContext + 1
+		if end > len(lines) {
+			end = len(lines)
+		}
+
+		// Line numbers of the hunk in each text
+		fromLine, toLine := 1, 1
+		for _, line := range lines[:first] {
+			if line.op != '+' {
+				fromLine++
+			}
+			if line.op != '-' {
+				toLine++
+			}
+		}
+		fromCount, toCount := 0, 0
+		for _, line := range lines[first:end] {
+			if line.op != '+' {
+				fromCount++
+			}
+			if line.op != '-' {
+				toCount++
+			}
+		}
+		// Empty ranges start at the line before, as in diff -u
+		if fromCount == 0 {
+			fromLine--
+		}
+		if toCount == 0 {
+			toLine--
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", fromLine, fromCount, toLine, toCount)
+		for _, line := range lines[first:end] {
+			fmt.Fprintf(&out, "%c%s\n", line.op, line.text)
+		}
+		start = end
+	}
+	return out.String()
+}
+
+// splitLines splits text into lines, without the final newline
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
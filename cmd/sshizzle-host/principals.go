@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+
+	"github.com/thalesgroup/sshizzle/internal/principals"
+)
+
+// runPrincipals prints the principals that can log in as an account, one per line, for sshd's
+// AuthorizedPrincipalsCommand
+func runPrincipals(args []string) {
+	flags := flag.NewFlagSet("principals", flag.ExitOnError)
+	policyFile := flags.String("policy", principals.DefaultPolicyFile, "principals policy file")
+	accountName := flags.Bool("account-name", false, "allow certificates for the account's own name, as well as the policy's principals")
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		log.Fatalln("usage: sshizzle-host principals [-policy file] [-account-name] <account>")
+	}
+	account := flags.Arg(0)
+
+	policy, err := principals.LoadPolicy(*policyFile)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, principal := range policy.Principals(account, unixGroups(account), *accountName) {
+		fmt.Println(principal)
+	}
+}
+
+// unixGroups returns the names of the groups the account is a member of, or none if they can't
+// be looked up
+func unixGroups(account string) []string {
+	u, err := user.Lookup(account)
+	if err != nil {
+		return nil
+	}
+	ids, err := u.GroupIds()
+	if err != nil {
+		return nil
+	}
+	groups := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if group, err := user.LookupGroupId(id); err == nil {
+			groups = append(groups, group.Name)
+		}
+	}
+	return groups
+}
+
+// principalsCommand checks the policy file and returns the AuthorizedPrincipalsCommand that runs
+// this binary with it, allowing each account's own name if accountName is true
+func principalsCommand(policyFile string, accountName bool) (string, error) {
+	if _, err := principals.LoadPolicy(policyFile); err != nil {
+		return "", err
+	}
+	policyFile, err := filepath.Abs(policyFile)
+	if err != nil {
+		return "", err
+	}
+	// sshd needs the absolute path of the command, which must be owned by root
+	executable, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("unable to find the sshizzle-host binary: %s", err.Error())
+	}
+	if executable, err = filepath.EvalSymlinks(executable); err != nil {
+		return "", fmt.Errorf("unable to find the sshizzle-host binary: %s", err.Error())
+	}
+	if accountName {
+		return fmt.Sprintf("%s principals -policy %s -account-name %%u", executable, policyFile), nil
+	}
+	return fmt.Sprintf("%s principals -policy %s %%u", executable, policyFile), nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// Files configuring sshd
+const (
+	sshdConfigFile = "/etc/ssh/sshd_config"
+	sshdDropInDir  = "/etc/ssh/sshd_config.d"
+	sshdDropInFile = sshdDropInDir + "/50-sshizzle.conf"
+	caKeyFile      = "/etc/ssh/user_ca.pub"
+	revokedKeyFile = "/etc/ssh/sshizzle_revoked_keys"
+)
+
+// Markers around the config sshizzle-host manages in sshd_config, when drop-ins aren't supported
+const (
+	blockBegin = "# BEGIN sshizzle, managed by sshizzle-host"
+	blockEnd   = "# END sshizzle"
+)
+
+// dropInHeader starts the drop-in sshizzle-host writes
+const dropInHeader = "# Managed by sshizzle-host, changes will be overwritten\n"
+
+var (
+	includeDropIns = regexp.MustCompile(`(?i)^\s*Include\s+.*sshd_config\.d/\*\.conf`)
+	matchBlock     = regexp.MustCompile(`(?i)^\s*Match\s`)
+)
+
+// hostConfig is the sshd config sshizzle-host manages
+type hostConfig struct {
+	// principalsCommand is the AuthorizedPrincipalsCommand, if a principals policy is used
+	principalsCommand string
+	// revokedKeys is true if sshd checks keys against the KRL
+	revokedKeys bool
+	// breakGlassUsers are the accounts break-glass certificates can log in as
+	breakGlassUsers []string
+}
+
+// directives returns the sshd config for the CA, KRL, principals policy and break-glass accounts
+func (c *hostConfig) directives() string {
+	config := fmt.Sprintf("TrustedUserCAKeys %s\n", caKeyFile)
+	if c.revokedKeys {
+		config += fmt.Sprintf("RevokedKeys %s\n", revokedKeyFile)
+	}
+	if c.principalsCommand != "" {
+		config += fmt.Sprintf("AuthorizedPrincipalsCommand %s\nAuthorizedPrincipalsCommandUser nobody\n", c.principalsCommand)
+	}
+	// Match blocks apply to the end of the file, so come last
+	if len(c.breakGlassUsers) > 0 {
+		config += fmt.Sprintf("Match User %s\n\tAuthorizedPrincipalsFile %s/%%u\n", strings.Join(c.breakGlassUsers, ","), breakGlassPrincipalsDir)
+	}
+	return config
+}
+
+// supportsDropIns returns true if sshd_config includes sshd_config.d/*.conf before any Match
+// block, so a drop-in applies to every connection
+func supportsDropIns(sshdConfig string) bool {
+	for _, line := range strings.Split(sshdConfig, "\n") {
+		if matchBlock.MatchString(line) {
+			return false
+		}
+		if includeDropIns.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// withBlock returns sshdConfig with the sshizzle block replaced by one containing directives,
+// or removed if directives is empty. The block goes before the first Match block, so it
+// applies to every connection. The line appended by the first versions is removed too
+func withBlock(sshdConfig string, directives string) string {
+	lines := strings.Split(strings.TrimSuffix(sshdConfig, "\n"), "\n")
+
+	// Take out the current block
+	var kept []string
+	inBlock := false
+	for _, line := range lines {
+		switch {
+		case line == blockBegin:
+			inBlock = true
+		case line == blockEnd && inBlock:
+			inBlock = false
+		case !inBlock:
+			kept = append(kept, line)
+		}
+	}
+	kept = removeLegacy(kept)
+	if directives == "" {
+		return strings.Join(kept, "\n") + "\n"
+	}
+
+	block := append([]string{blockBegin}, strings.Split(strings.TrimSuffix(directives, "\n"), "\n")...)
+	block = append(block, blockEnd)
+	at := len(kept)
+	for i, line := range kept {
+		if matchBlock.MatchString(line) {
+			at = i
+			break
+		}
+	}
+	result := append(append(append([]string{}, kept[:at]...), block...), kept[at:]...)
+	return strings.Join(result, "\n") + "\n"
+}
+
+// legacyCALine is the line the first version of sshizzle-host appended to sshd_config
+const legacyCALine = "TrustedUserCAKeys " + caKeyFile
+
+// removeLegacy removes the line the first version of sshizzle-host appended to sshd_config. The
+// same line in a Match block is the admin's own, so it's left alone
+func removeLegacy(lines []string) []string {
+	for i, line := range lines {
+		if matchBlock.MatchString(line) {
+			break
+		}
+		if line == legacyCALine {
+			return append(append([]string{}, lines[:i]...), lines[i+1:]...)
+		}
+	}
+	return lines
+}
+
+// sshdChanges returns the changes that configure sshd with directives, in a drop-in if
+// sshd_config includes them, otherwise in a block in sshd_config
+func sshdChanges(directives string) (changeSet, error) {
+	sshdConfig, exists, err := readFile(sshdConfigFile)
+	if err != nil || !exists {
+		return nil, fmt.Errorf("unable to read %s", sshdConfigFile)
+	}
+	if supportsDropIns(string(sshdConfig)) {
+		return changeSet{
+			{path: sshdDropInFile, content: []byte(dropInHeader + directives), mode: 0644, restore: true},
+			// Take out any block or lines from before drop-ins were supported
+			{path: sshdConfigFile, content: []byte(withBlock(string(sshdConfig), "")), mode: 0644},
+		}, nil
+	}
+	return changeSet{
+		{path: sshdConfigFile, content: []byte(withBlock(string(sshdConfig), directives)), mode: 0644},
+	}, nil
+}
+
+// validateSSHD checks the sshd config with `sshd -t`. It's a variable so tests can replace it
+var validateSSHD = func() error {
+	sshd, err := exec.LookPath("sshd")
+	if err != nil {
+		sshd = "/usr/sbin/sshd"
+	}
+	// #nosec
+	output, err := exec.Command(sshd, "-t").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("sshd config is invalid: %s", strings.TrimSpace(string(output)+" "+err.Error()))
+	}
+	return nil
+}
+
+// reloadSSHD asks sshd to reload its config, which is ssh.service on Debian based systems
+func reloadSSHD() error {
+	var err error
+	for _, service := range []string{"sshd", "ssh"} {
+		if err = exec.Command("systemctl", "reload", service).Run(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// readFile returns the contents of a file and whether it exists
+func readFile(path string) ([]byte, bool, error) {
+	// #nosec
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
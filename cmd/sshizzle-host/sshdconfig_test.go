@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSupportsDropIns(t *testing.T) {
+	tests := []struct {
+		name       string
+		sshdConfig string
+		expected   bool
+	}{
+		{name: "include first", sshdConfig: "Include /etc/ssh/sshd_config.d/*.conf\nPort 22\n", expected: true},
+		{name: "relative include", sshdConfig: "  include sshd_config.d/*.conf\n", expected: true},
+		{name: "no include", sshdConfig: "Port 22\n", expected: false},
+		{name: "include after Match", sshdConfig: "Match User git\n\tForceCommand git-shell\nInclude /etc/ssh/sshd_config.d/*.conf\n", expected: false},
+		{name: "commented include", sshdConfig: "#Include /etc/ssh/sshd_config.d/*.conf\n", expected: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if supportsDropIns(test.sshdConfig) != test.expected {
+				t.Errorf("expected %t", test.expected)
+			}
+		})
+	}
+}
+
+func TestWithBlock(t *testing.T) {
+	directives := "TrustedUserCAKeys /etc/ssh/user_ca.pub\nRevokedKeys /etc/ssh/sshizzle_revoked_keys\n"
+	block := blockBegin + "\nTrustedUserCAKeys /etc/ssh/user_ca.pub\nRevokedKeys /etc/ssh/sshizzle_revoked_keys\n" + blockEnd + "\n"
+
+	tests := []struct {
+		name       string
+		sshdConfig string
+		directives string
+		expected   string
+	}{
+		{
+			name:       "added at the end",
+			sshdConfig: "Port 22\n",
+			directives: directives,
+			expected:   "Port 22\n" + block,
+		},
+		{
+			name:       "added before Match blocks",
+			sshdConfig: "Port 22\nMatch User git\n\tForceCommand git-shell\n",
+			directives: directives,
+			expected:   "Port 22\n" + block + "Match User git\n\tForceCommand git-shell\n",
+		},
+		{
+			name:       "replaced",
+			sshdConfig: "Port 22\n" + blockBegin + "\nTrustedUserCAKeys /old\n" + blockEnd + "\nMatch User git\n",
+			directives: directives,
+			expected:   "Port 22\n" + block + "Match User git\n",
+		},
+		{
+			name:       "removed",
+			sshdConfig: "Port 22\n" + block + "Match User git\n",
+			directives: "",
+			expected:   "Port 22\nMatch User git\n",
+		},
+		{
+			name:       "line appended by the first version removed",
+			sshdConfig: "Port 22\nTrustedUserCAKeys /etc/ssh/user_ca.pub\n",
+			directives: directives,
+			expected:   "Port 22\n" + block,
+		},
+		{
+			name:       "line appended by the first version removed without a block",
+			sshdConfig: "Port 22\nTrustedUserCAKeys /etc/ssh/user_ca.pub\n",
+			directives: "",
+			expected:   "Port 22\n",
+		},
+		{
+			name:       "line in a Match block kept",
+			sshdConfig: "Port 22\nMatch Group admins\n\tTrustedUserCAKeys /etc/ssh/user_ca.pub\n",
+			directives: "",
+			expected:   "Port 22\nMatch Group admins\n\tTrustedUserCAKeys /etc/ssh/user_ca.pub\n",
+		},
+		{
+			name:       "line after a Match block kept",
+			sshdConfig: "Match Group admins\n\tPasswordAuthentication no\nTrustedUserCAKeys /etc/ssh/user_ca.pub\n",
+			directives: "",
+			expected:   "Match Group admins\n\tPasswordAuthentication no\nTrustedUserCAKeys /etc/ssh/user_ca.pub\n",
+		},
+		{
+			name:       "other CA keys kept",
+			sshdConfig: "TrustedUserCAKeys /etc/ssh/other_ca.pub\n",
+			directives: "",
+			expected:   "TrustedUserCAKeys /etc/ssh/other_ca.pub\n",
+		},
+		{
+			name:       "unchanged without a block",
+			sshdConfig: "Port 22\n# sshizzle break-glass access\nMatch User root\n\tAuthorizedPrincipalsFile /etc/ssh/principals\n",
+			directives: "",
+			expected:   "Port 22\n# sshizzle break-glass access\nMatch User root\n\tAuthorizedPrincipalsFile /etc/ssh/principals\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := withBlock(test.sshdConfig, test.directives)
+			if result != test.expected {
+				t.Errorf("got:\n%s\nexpected:\n%s", result, test.expected)
+			}
+			// Applying the same directives again changes nothing
+			if again := withBlock(result, test.directives); again != result {
+				t.Errorf("not idempotent, got:\n%s", again)
+			}
+		})
+	}
+}
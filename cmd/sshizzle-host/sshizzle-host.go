@@ -1,135 +1,252 @@
 package main
 
 import (
+	"context"
+	"crypto/rsa"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"strings"
-	"time"
 
-	"github.com/Azure/azure-sdk-for-go/services/keyvault/v7.0/keyvault"
 	"github.com/Azure/go-autorest/autorest"
-	"github.com/Azure/go-autorest/autorest/azure"
 	"github.com/Azure/go-autorest/autorest/azure/auth"
 	az "github.com/thalesgroup/sshizzle/internal/azure"
+	"github.com/thalesgroup/sshizzle/internal/breakglass"
+	"github.com/thalesgroup/sshizzle/internal/signer"
+	"github.com/thalesgroup/sshizzle/internal/vault"
 	"golang.org/x/crypto/ssh"
 )
 
-var kvResource string = strings.Trim(azure.PublicCloud.KeyVaultEndpoint, "/")
+// Directory containing the principals files for accounts break-glass certificates can use
+const breakGlassPrincipalsDir = "/etc/ssh/sshizzle_principals"
 
 func main() {
-	var keyvaultName string
-	flag.StringVar(&keyvaultName, "kvName", "kv-sshizzle", "specify the keyvault name")
-	flag.Parse()
-
-	if os.Getenv("KV_NAME") != "" {
-		keyvaultName = os.Getenv("KV_NAME")
+	// Subcommands run by sshd, to keep the CA keys up to date or to remove sshizzle, rather than
+	// during setup
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "principals":
+			runPrincipals(os.Args[2:])
+			return
+		case "uninstall":
+			runUninstall(os.Args[2:])
+			return
+		case "sync":
+			runSync(os.Args[2:])
+			return
+		}
 	}
 
-	// Setup an authoriser for KeyVault resources using the users credentials from
-	// the Azure CLI
-	var authorizer autorest.Authorizer
-	var err error
+	var store keyStore
+	var breakGlassUsers, breakGlassPrincipal, policyFile string
+	var krl krlSource
+	var dryRun, accountName bool
+	store.register(flag.CommandLine)
+	flag.StringVar(&breakGlassUsers, "break-glass-user", "", "comma separated accounts that break-glass certificates can log in as")
+	flag.StringVar(&breakGlassPrincipal, "break-glass-principal", breakglass.DefaultPrincipal, "principal of break-glass certificates issued by sshizzle-ca")
+	flag.StringVar(&policyFile, "policy", "", "principals policy file to configure as sshd's AuthorizedPrincipalsCommand")
+	flag.BoolVar(&accountName, "account-name", false, "with -policy, also allow each account to be logged in to with a certificate for its own name")
+	krl.register(flag.CommandLine)
+	flag.BoolVar(&dryRun, "dry-run", false, "show the changes that would be made, without making them")
+	flag.Parse()
 
-	// Check if we've got an MSI, and use it if we do
-	if checkMSI() {
-		msiConf := auth.NewMSIConfig()
-		msiConf.Resource = kvResource
-		authorizer, err = msiConf.Authorizer()
-	} else {
-		authorizer, err = auth.NewAuthorizerFromCLIWithResource(kvResource)
-	}
-	// We need to exit if this doesn't work!
-	if err != nil {
-		log.Fatalln("Unable to authorize access to KeyVault service using `az` CLI credentials, please ensure you're logged in with `az account list` or there is an MSI present")
-	}
-	// Setup a KeyVault client
-	kvClient := keyvault.New()
-	kvClient.Authorizer = authorizer
-	// Create a KeyVault Signer
-	kvSigner := az.NewKeyVaultSigner(&kvClient, keyvaultName, "sshizzle")
+	caKeys := store.keySet()
 	// Get the crypto.PublicKey back from the Signer
-	publicKey := kvSigner.Public()
+	publicKey := caKeys.Public()
 	// Convert to an SSH public key
 	sshKey, err := ssh.NewPublicKey(publicKey)
 	if err != nil {
-		log.Fatalln("No public key received from key vault")
+		log.Fatalln("No public key received from key store")
 	}
 	// Dump key to stdout in correct format
 	sshKeyOutput := string(ssh.MarshalAuthorizedKey(sshKey))
 	// Write some output to give the user a warm-fuzzy feeling
-	log.Printf("Got CA public key:\n\n%s\n", sshKeyOutput)
-	log.Printf("Writing key to `/etc/ssh/user_ca.pub`")
-	// Write the CA public key to a sensible location
-	keyFile := "/etc/ssh/user_ca.pub"
-	// #nosec
-	if err = ioutil.WriteFile(keyFile, ssh.MarshalAuthorizedKey(sshKey), 0644); err != nil {
-		log.Printf("unable to write sshizzle-ca public key to %s\n", keyFile)
-	}
-	log.Printf("Key written, checking sshd config...")
-	// We need to add a line to the sshd config for it to use the CA
-	sshdConfig, err := ioutil.ReadFile("/etc/ssh/sshd_config")
+	log.Printf("Got CA public key version %s:\n\n%s\n", caKeys.KeyVersion(), sshKeyOutput)
+	// The CA public keys, including other versions being rotated, and the KRL go in sensible
+	// locations
+	changes, err := trustChanges(context.Background(), caKeys, krl)
 	if err != nil {
-		log.Fatalln("Unable to read `/etc/ssh/sshd_config`")
+		log.Fatalln(err)
 	}
-	caConfigLine := "TrustedUserCAKeys /etc/ssh/user_ca.pub"
-	// Check if the SSH daemon has already been configured
-	configured := strings.Contains(string(sshdConfig), caConfigLine)
-	if configured {
-		log.Println("SSH daemon already configured")
-	} else {
-		// #nosec
-		f, err := os.OpenFile("/etc/ssh/sshd_config", os.O_APPEND|os.O_WRONLY, 0644)
-		if err != nil {
-			log.Fatalln("Unable to open `/etc/ssh/sshd_config` for appending")
+	config := &hostConfig{revokedKeys: krl.location != ""}
+
+	// Map accounts to the principals that can log in as them
+	if policyFile != "" {
+		if config.principalsCommand, err = principalsCommand(policyFile, accountName); err != nil {
+			log.Fatalln(err)
 		}
-		// #nosec
-		defer f.Close()
-		if _, err := f.WriteString(fmt.Sprintf("%s\n", caConfigLine)); err != nil {
-			log.Fatalln("Unable to append to `/etc/ssh/sshd_config`")
+	}
+
+	// Allow break-glass certificates to log in as the accounts specified
+	if breakGlassUsers != "" {
+		accounts, breakGlassChanges, err := configureBreakGlass(breakGlassUsers, breakGlassPrincipal)
+		if err != nil {
+			log.Fatalln(err)
 		}
-		log.Println("SSH daemon configured.")
-		log.Println("Restarting SSH Daemon")
+		config.breakGlassUsers = accounts
+		changes = append(changes, breakGlassChanges...)
+	}
 
-		err = exec.Command("systemctl", "restart", "sshd").Run()
+	sshdConfigChanges, err := sshdChanges(config.directives())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	changes = append(changes, sshdConfigChanges...)
+
+	if dryRun {
+		changed, err := changes.diff(os.Stdout)
 		if err != nil {
-			log.Println("Couldn't restart SSH Daemon, try it yourself...")
+			log.Fatalln(err)
 		}
-		log.Println("SSH Daemon restarted")
+		if !changed {
+			log.Println("SSH daemon already configured")
+		}
+		return
+	}
+
+	state, err := loadState()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	changed, err := changes.apply(state)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if !changed {
+		log.Println("SSH daemon already configured")
+		log.Println("Done")
+		return
+	}
+	if err := state.save(); err != nil {
+		log.Printf("unable to record the changes made in %s, so uninstall can't restore them: %s\n", stateFile, err.Error())
+	}
+	log.Println("SSH daemon configured.")
+	log.Println("Reloading SSH Daemon")
+	if err := reloadSSHD(); err != nil {
+		log.Println("Couldn't reload SSH Daemon, try it yourself...")
+	} else {
+		log.Println("SSH Daemon reloaded")
 	}
 	log.Println("Done")
-	os.Exit(0)
 }
 
-// Function to check whether or not this is being run on a machine with an Azure Managed System Identity
-func checkMSI() bool {
-	// This URL should return a token if there is an MSI
-	msiURL := "http://169.254.169.254/metadata/identity/oauth2/token"
-	// Setup the request
-	req, err := http.NewRequest("GET", msiURL, nil)
+// caKeySet is the CA key in a key store, including the versions hosts should trust
+type caKeySet interface {
+	signer.CASigner
+	PublicKeys(ctx context.Context) ([]*rsa.PublicKey, error)
+}
+
+// keyStore is where the CA key is kept, chosen with the same flags and environment variables
+// for setup and sync
+type keyStore struct {
+	keyvaultName string
+	hsmName      string
+	keyVersion   string
+	environment  string
+}
+
+// register adds the key store flags to a flag set
+func (k *keyStore) register(flags *flag.FlagSet) {
+	flags.StringVar(&k.keyvaultName, "kvName", "kv-sshizzle", "specify the keyvault name")
+	flags.StringVar(&k.hsmName, "hsmName", "", "specify a managed HSM name to use instead of a keyvault")
+	flags.StringVar(&k.keyVersion, "keyVersion", "", "specify the version of the CA key, defaulting to the latest")
+	flags.StringVar(&k.environment, "environment", os.Getenv(az.EnvironmentVariable), "Azure cloud of the keyvault: public, usgovernment, china or a JSON file of endpoints")
+}
+
+// keySet returns the CA key from the Vault transit engine if VAULT_ADDR is set, otherwise Key Vault
+func (k *keyStore) keySet() caKeySet {
+	if os.Getenv("VAULT_ADDR") != "" {
+		return newVaultSigner()
+	}
+	if os.Getenv("KV_NAME") != "" {
+		k.keyvaultName = os.Getenv("KV_NAME")
+	}
+	if os.Getenv("KV_HSM_NAME") != "" {
+		k.hsmName = os.Getenv("KV_HSM_NAME")
+	}
+	if os.Getenv("KV_KEY_VERSION") != "" {
+		k.keyVersion = os.Getenv("KV_KEY_VERSION")
+	}
+	return newKeyVaultSigner(k.keyvaultName, k.hsmName, k.keyVersion, k.environment)
+}
+
+// newKeyVaultSigner returns a signer for the CA key in Key Vault, or a managed HSM if hsmName is set
+func newKeyVaultSigner(keyvaultName string, hsmName string, keyVersion string, environment string) *az.KeyVaultSigner {
+	cloud, err := az.ParseEnvironment(environment)
 	if err != nil {
-		return false
-	}
-	// Add some query parameters to the URL
-	q := req.URL.Query()
-	q.Add("resource", kvResource)
-	q.Add("api-version", "2018-02-01")
-	req.URL.RawQuery = q.Encode()
-	// Add the metadata header to the request
-	req.Header.Add("Metadata", "true")
-	// Setup a client and do the request
-	client := &http.Client{Timeout: time.Second * 2}
-	res, err := client.Do(req)
+		log.Fatalln(err)
+	}
+	kvResource := az.KeyVaultResource(cloud)
+	kvURL := az.KeyVaultURL(cloud, keyvaultName)
+	if hsmName != "" {
+		kvResource = az.ManagedHSMResource(cloud)
+		if kvURL, err = az.ManagedHSMURL(cloud, hsmName); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	// Setup an authoriser for KeyVault resources, using a managed identity or service principal
+	// if there is one, otherwise the users credentials from the Azure CLI
+	var authorizer autorest.Authorizer
+	credential, err := az.NewDefaultCredential(cloud.ActiveDirectoryEndpoint)
 	if err != nil {
-		return false
+		log.Fatalln(err)
 	}
-	// Check status code - if 200 we have an MSI
-	if res.StatusCode > 299 {
-		return false
+	ctx, cancel := context.WithTimeout(context.Background(), az.KeyVaultRequestTimeout)
+	_, err = credential.GetToken(ctx, kvResource)
+	cancel()
+	if err == nil {
+		authorizer = az.NewAuthorizer(credential, kvResource)
+	} else {
+		authorizer, err = auth.NewAuthorizerFromCLIWithResource(kvResource)
+	}
+	// We need to exit if this doesn't work!
+	if err != nil {
+		log.Fatalln("Unable to authorize access to KeyVault service using `az` CLI credentials, please ensure you're logged in with `az account list` or there is an MSI present")
+	}
+	// Setup a KeyVault client
+	kvClient := az.NewKeyVaultClient(authorizer, hsmName != "")
+	// Create a KeyVault Signer
+	return az.NewKeyVaultSigner(kvClient, kvURL, "sshizzle", keyVersion)
+}
+
+// newVaultSigner returns a signer for the CA key in the Vault transit engine, configured with the
+// same environment variables as sshizzle-ca
+func newVaultSigner() *vault.TransitSigner {
+	config, err := vault.ConfigFromEnv()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if config.Key == "" {
+		config.Key = "sshizzle"
+	}
+	transitSigner, err := vault.NewTransitSigner(*config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return transitSigner
+}
+
+// configureBreakGlass returns the accounts given and the changes to write a principals file for
+// each, accepting both certificates issued to the account's own user and break-glass certificates
+func configureBreakGlass(users string, principal string) ([]string, changeSet, error) {
+	var accounts []string
+	var changes changeSet
+	for _, user := range strings.Split(users, ",") {
+		user = strings.TrimSpace(user)
+		if user == "" || strings.ContainsAny(user, "/ ") {
+			return nil, nil, fmt.Errorf("invalid break-glass user '%s'", user)
+		}
+		changes = append(changes, fileChange{
+			path:    filepath.Join(breakGlassPrincipalsDir, user),
+			content: []byte(user + "\n" + principal + "\n"),
+			mode:    0644,
+			restore: true,
+		})
+		log.Printf("Break-glass certificates for %s can log in as %s\n", principal, user)
+		accounts = append(accounts, user)
 	}
-	return true
+	return accounts, changes, nil
 }
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Limits on fetching the KRL
+const (
+	krlTimeout = 30 * time.Second
+	krlMaxSize = 16 << 20
+)
+
+// krlMagic starts a binary OpenSSH KRL, see PROTOCOL.krl
+var krlMagic = []byte("SSHKRL\n\x00")
+
+// runSync updates the CA public keys and KRL sshd trusts, reloading sshd if they've changed.
+// It runs once, for a systemd timer, unless an interval is given
+func runSync(args []string) {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	var store keyStore
+	store.register(flags)
+	var krl krlSource
+	krl.register(flags)
+	interval := flags.Duration("interval", 0, "sync repeatedly at this interval, rather than once")
+	dryRun := flags.Bool("dry-run", false, "show the changes that would be made, without making them")
+	_ = flags.Parse(args)
+
+	caKeys := store.keySet()
+	if *interval <= 0 {
+		if err := syncTrust(caKeys, krl, *dryRun); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	for {
+		// Keep going on failure, the files sshd is using are left as they are
+		if err := syncTrust(caKeys, krl, *dryRun); err != nil {
+			log.Println(err)
+		}
+		time.Sleep(*interval)
+	}
+}
+
+// syncTrust fetches the CA public keys and KRL, and updates them if they've changed
+func syncTrust(caKeys caKeySet, krl krlSource, dryRun bool) error {
+	changes, err := trustChanges(context.Background(), caKeys, krl)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		changed, err := changes.diff(os.Stdout)
+		if err == nil && !changed {
+			log.Println("CA keys and KRL are up to date")
+		}
+		return err
+	}
+
+	state, err := loadState()
+	if err != nil {
+		return err
+	}
+	changed, err := changes.apply(state)
+	if err != nil {
+		return err
+	}
+	if !changed {
+		log.Println("CA keys and KRL are up to date")
+		return nil
+	}
+	if err := state.save(); err != nil {
+		log.Printf("unable to record the changes made in %s, so uninstall can't restore them: %s\n", stateFile, err.Error())
+	}
+	if err := reloadSSHD(); err != nil {
+		return fmt.Errorf("CA keys and KRL updated, but couldn't reload SSH Daemon: %s", err.Error())
+	}
+	log.Println("CA keys and KRL updated, SSH Daemon reloaded")
+	return nil
+}
+
+// trustChanges returns the changes writing the CA public keys, and the KRL if one is set
+func trustChanges(ctx context.Context, caKeys caKeySet, krlSource krlSource) (changeSet, error) {
+	publicKeys, err := caKeys.PublicKeys(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get CA public keys from key store: %s", err.Error())
+	}
+	var trusted bytes.Buffer
+	for _, publicKey := range publicKeys {
+		sshKey, err := ssh.NewPublicKey(publicKey)
+		if err != nil {
+			return nil, err
+		}
+		trusted.Write(ssh.MarshalAuthorizedKey(sshKey))
+	}
+	changes := changeSet{{path: caKeyFile, content: trusted.Bytes(), mode: 0644, restore: true}}
+
+	if krlSource.location != "" {
+		krl, err := fetchKRL(ctx, krlSource)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, fileChange{path: revokedKeyFile, content: krl, mode: 0644, restore: true})
+	}
+	return changes, nil
+}
+
+// krlSource is where the KRL is fetched from, and optionally its pinned SHA-256 checksum
+type krlSource struct {
+	location string
+	sha256   string
+}
+
+// register adds the KRL flags to a flag set
+func (k *krlSource) register(flags *flag.FlagSet) {
+	flags.StringVar(&k.location, "krl-url", "", "https URL or path of a KRL, or list of public keys, for sshd to revoke")
+	flags.StringVar(&k.sha256, "krl-sha256", "", "hex SHA-256 checksum the KRL must have, required for http URLs")
+}
+
+// krlClient fetches KRLs over HTTPS
+var krlClient = http.DefaultClient
+
+// fetchKRL gets a KRL from a URL or file, and checks it's a binary KRL or a list of public keys
+// revoking at least one key, as sshd refuses every key if it can't read its RevokedKeys, and an
+// empty KRL would quietly un-revoke every key. Plain http URLs are only allowed with a checksum
+func fetchKRL(ctx context.Context, source krlSource) ([]byte, error) {
+	var krl []byte
+	switch {
+	case strings.HasPrefix(source.location, "http://") && source.sha256 == "":
+		return nil, errors.New("KRL URL must be https, or have its checksum pinned with -krl-sha256")
+	case strings.HasPrefix(source.location, "https://") || strings.HasPrefix(source.location, "http://"):
+		ctx, cancel := context.WithTimeout(ctx, krlTimeout)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, source.location, nil)
+		if err != nil {
+			return nil, err
+		}
+		res, err := krlClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("unable to fetch KRL: %s", err.Error())
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unable to fetch KRL: %s", res.Status)
+		}
+		if krl, err = io.ReadAll(io.LimitReader(res.Body, krlMaxSize+1)); err != nil {
+			return nil, fmt.Errorf("unable to fetch KRL: %s", err.Error())
+		}
+	default:
+		var err error
+		if krl, err = os.ReadFile(filepath.Clean(source.location)); err != nil {
+			return nil, fmt.Errorf("unable to read KRL: %s", err.Error())
+		}
+	}
+	if len(krl) > krlMaxSize {
+		return nil, fmt.Errorf("KRL is larger than %d bytes", krlMaxSize)
+	}
+	if source.sha256 != "" {
+		sum := sha256.Sum256(krl)
+		if !strings.EqualFold(hex.EncodeToString(sum[:]), source.sha256) {
+			return nil, errors.New("KRL doesn't match the checksum given with -krl-sha256")
+		}
+	}
+
+	if bytes.HasPrefix(krl, krlMagic) {
+		revoked, err := krlRevokes(krl)
+		if err != nil {
+			return nil, err
+		}
+		if !revoked {
+			return nil, errors.New("KRL doesn't revoke any keys")
+		}
+		return krl, nil
+	}
+	keys := 0
+	for i, line := range strings.Split(string(krl), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line)); err != nil {
+			return nil, fmt.Errorf("line %d of KRL isn't a public key, and it isn't a binary KRL", i+1)
+		}
+		keys++
+	}
+	if keys == 0 {
+		return nil, errors.New("KRL is empty")
+	}
+	return krl, nil
+}
+
+// KRL section types, see PROTOCOL.krl
+const (
+	krlSectionCertificates = 1
+	krlSectionSignature    = 4
+)
+
+// krlRevokes reads the sections of a binary KRL, returning true if any of them revoke a key or
+// certificate
+func krlRevokes(krl []byte) (bool, error) {
+	// The header is the magic, the format and KRL versions, the generated date and flags, then
+	// reserved and comment strings
+	rest := krl[len(krlMagic):]
+	var header struct {
+		FormatVersion uint32
+		KRLVersion    uint64
+		GeneratedDate uint64
+		Flags         uint64
+		Reserved      string
+		Comment       string
+		Rest          []byte `ssh:"rest"`
+	}
+	if err := ssh.Unmarshal(rest, &header); err != nil {
+		return false, errors.New("KRL header is invalid")
+	}
+	rest = header.Rest
+
+	revoked := false
+	for len(rest) > 0 {
+		sectionType := rest[0]
+		var section struct {
+			Data []byte
+			Rest []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(rest[1:], &section); err != nil {
+			return false, errors.New("KRL section is invalid")
+		}
+		rest = section.Rest
+		switch sectionType {
+		case krlSectionSignature:
+			// Signature sections have the signing key then the signature, and revoke nothing
+			var signature struct {
+				Signature []byte
+				Rest      []byte `ssh:"rest"`
+			}
+			if err := ssh.Unmarshal(rest, &signature); err != nil {
+				return false, errors.New("KRL signature section is invalid")
+			}
+			rest = signature.Rest
+		case krlSectionCertificates:
+			// The CA key and a reserved string are followed by subsections revoking certificates
+			var certificates struct {
+				CAKey    []byte
+				Reserved string
+				Rest     []byte `ssh:"rest"`
+			}
+			if err := ssh.Unmarshal(section.Data, &certificates); err != nil {
+				return false, errors.New("KRL certificate section is invalid")
+			}
+			revoked = revoked || len(certificates.Rest) > 0
+		default:
+			revoked = revoked || len(section.Data) > 0
+		}
+	}
+	return revoked, nil
+}
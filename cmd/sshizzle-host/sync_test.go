@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// buildKRL returns a binary KRL with the sections given, each a type followed by its data
+func buildKRL(sections ...[]byte) []byte {
+	krl := append([]byte{}, krlMagic...)
+	krl = append(krl, ssh.Marshal(struct {
+		FormatVersion uint32
+		KRLVersion    uint64
+		GeneratedDate uint64
+		Flags         uint64
+		Reserved      string
+		Comment       string
+	}{FormatVersion: 1, KRLVersion: 1})...)
+	for _, section := range sections {
+		krl = append(krl, section...)
+	}
+	return krl
+}
+
+// krlSection returns a KRL section of the type given
+func krlSection(sectionType byte, data []byte) []byte {
+	return append([]byte{sectionType}, ssh.Marshal(struct{ Data []byte }{data})...)
+}
+
+func TestFetchKRL(t *testing.T) {
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyList := "# revoked\n" + string(ssh.MarshalAuthorizedKey(sshKey))
+	caKey := ssh.Marshal(struct {
+		CAKey    []byte
+		Reserved string
+	}{CAKey: sshKey.Marshal()})
+
+	explicitKey := buildKRL(krlSection(2, ssh.Marshal(struct{ Key []byte }{sshKey.Marshal()})))
+	// A certificate section revoking serial 5
+	serials := buildKRL(krlSection(1, append(caKey, append([]byte{0x20}, ssh.Marshal(struct{ Serial uint64 }{5})...)...)))
+	checksum := func(content string) string {
+		sum := sha256.Sum256([]byte(content))
+		return hex.EncodeToString(sum[:])
+	}
+
+	tests := []struct {
+		name    string
+		scheme  string
+		content string
+		status  int
+		sha256  string
+		err     string
+	}{
+		{name: "list of keys", scheme: "https", content: keyList},
+		{name: "binary KRL revoking a key", scheme: "https", content: string(explicitKey)},
+		{name: "binary KRL revoking a serial", scheme: "https", content: string(serials)},
+		{name: "file", scheme: "file", content: keyList},
+		{name: "matching checksum", scheme: "https", content: keyList, sha256: strings.ToUpper(checksum(keyList))},
+		{name: "http with checksum", scheme: "http", content: keyList, sha256: checksum(keyList)},
+		{name: "http without checksum", scheme: "http", content: keyList, err: "must be https"},
+		{name: "different checksum", scheme: "https", content: keyList, sha256: checksum("other"), err: "doesn't match the checksum"},
+		{name: "empty body", scheme: "https", content: "", err: "KRL is empty"},
+		{name: "only comments", scheme: "https", content: "# nothing revoked\n", err: "KRL is empty"},
+		{name: "binary KRL revoking nothing", scheme: "https", content: string(buildKRL()), err: "doesn't revoke any keys"},
+		{name: "certificate section revoking nothing", scheme: "https", content: string(buildKRL(krlSection(1, caKey))), err: "doesn't revoke any keys"},
+		{name: "truncated binary KRL", scheme: "https", content: string(explicitKey[:len(explicitKey)-4]), err: "section is invalid"},
+		{name: "not a KRL", scheme: "https", content: "<html></html>", err: "line 1 of KRL isn't a public key"},
+		{name: "HTTP error", scheme: "https", status: http.StatusNotFound, err: "404"},
+		{name: "missing file", scheme: "file", err: "unable to read KRL"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if test.status != 0 {
+					w.WriteHeader(test.status)
+				}
+				_, _ = w.Write([]byte(test.content))
+			})
+			source := krlSource{sha256: test.sha256}
+			switch test.scheme {
+			case "https":
+				server := httptest.NewTLSServer(handler)
+				defer server.Close()
+				krlClient = server.Client()
+				defer func() { krlClient = http.DefaultClient }()
+				source.location = server.URL
+			case "http":
+				server := httptest.NewServer(handler)
+				defer server.Close()
+				source.location = server.URL
+			default:
+				source.location = filepath.Join(t.TempDir(), "krl")
+				if test.err == "" {
+					if err := os.WriteFile(source.location, []byte(test.content), 0600); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			krl, err := fetchKRL(context.Background(), source)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if string(krl) != test.content {
+				t.Fatal("KRL doesn't match the content fetched")
+			}
+		})
+	}
+}
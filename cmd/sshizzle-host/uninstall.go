@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"sort"
+)
+
+// runUninstall removes the sshizzle config from sshd and puts back the files sshizzle-host
+// changed as they were before it was first run
+func runUninstall(args []string) {
+	flags := flag.NewFlagSet("uninstall", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "show the changes that would be made, without making them")
+	_ = flags.Parse(args)
+
+	state, err := loadState()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if len(state.Files) == 0 {
+		log.Printf("No record of the files sshizzle-host changed in %s, only removing its sshd config\n", stateFile)
+	}
+	paths := make([]string, 0, len(state.Files))
+	for path := range state.Files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var changes changeSet
+	for _, path := range paths {
+		saved := state.Files[path]
+		change := fileChange{path: path, mode: saved.Mode}
+		if saved.Existed {
+			// Empty files are saved without content
+			change.content = append([]byte{}, saved.Content...)
+		}
+		changes = append(changes, change)
+	}
+	sshdConfig, exists, err := readFile(sshdConfigFile)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if exists {
+		changes = append(changes, fileChange{path: sshdConfigFile, content: []byte(withBlock(string(sshdConfig), "")), mode: 0644})
+	}
+
+	if *dryRun {
+		changed, err := changes.diff(os.Stdout)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if !changed {
+			log.Println("Nothing to uninstall")
+		}
+		return
+	}
+	changed, err := changes.apply(&hostState{Files: make(map[string]*savedFile)})
+	if err != nil {
+		log.Fatalln(err)
+	}
+	// Only removed if sshizzle-host created it and nothing else is in it
+	_ = os.Remove(breakGlassPrincipalsDir)
+	if err := os.Remove(stateFile); err != nil && !os.IsNotExist(err) {
+		log.Fatalln(err)
+	}
+	if !changed {
+		log.Println("Nothing to uninstall")
+		return
+	}
+	if err := reloadSSHD(); err != nil {
+		log.Println("Couldn't reload SSH Daemon, try it yourself...")
+	}
+	log.Println("sshizzle removed from SSH Daemon")
+}
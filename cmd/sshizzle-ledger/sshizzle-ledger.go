@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/thalesgroup/sshizzle/internal/azure"
+	"github.com/thalesgroup/sshizzle/internal/config"
+	"github.com/thalesgroup/sshizzle/internal/ledger"
+	"github.com/thalesgroup/sshizzle/internal/ledger/sqlite"
+	"github.com/thalesgroup/sshizzle/internal/sshizzleagent"
+)
+
+func main() {
+	var serial uint64
+	var user, from, to, db string
+	var limit int
+	var asJSON bool
+	flag.Uint64Var(&serial, "serial", 0, "show the certificate with this serial number")
+	flag.StringVar(&user, "user", "", "show certificates issued to this user principal name")
+	flag.StringVar(&from, "from", "", "only show certificates issued after this time (RFC 3339, or a duration such as 24h ago)")
+	flag.StringVar(&to, "to", "", "only show certificates issued before this time (RFC 3339, or a duration such as 1h ago)")
+	flag.IntVar(&limit, "limit", ledger.MaxRecords, "maximum number of certificates to show")
+	flag.StringVar(&db, "db", "", "read a local SQLite ledger instead of querying sshizzle-ca")
+	flag.BoolVar(&asJSON, "json", false, "print the certificates as JSON")
+	flag.Parse()
+
+	query := ledger.Query{
+		Serial:    serial,
+		Requester: user,
+		Limit:     limit,
+	}
+	var err error
+	if query.From, err = parseTime(from); err != nil {
+		log.Fatalln(fmt.Errorf("invalid -from: %s", err.Error()))
+	}
+	if query.To, err = parseTime(to); err != nil {
+		log.Fatalln(fmt.Errorf("invalid -to: %s", err.Error()))
+	}
+	if err := query.Validate(); err != nil {
+		log.Fatalln(fmt.Errorf("invalid query: %s, see -h", err.Error()))
+	}
+
+	var records []ledger.Record
+	if db != "" {
+		records, err = lookupLocal(db, query)
+	} else {
+		records, err = lookupRemote(query)
+	}
+	if err != nil {
+		log.Fatalln(fmt.Errorf("failed to lookup certificates: %s", err.Error()))
+	}
+
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(records); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	printRecords(records)
+}
+
+// parseTime parses an absolute RFC 3339 time, or a duration before now
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if ago, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-ago), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// lookupLocal queries a SQLite ledger on disk, for a CA running outside of Azure
+func lookupLocal(path string, query ledger.Query) ([]ledger.Record, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	sqliteLedger, err := sqlite.NewLedger(path)
+	if err != nil {
+		return nil, err
+	}
+	defer sqliteLedger.Close()
+	return sqliteLedger.Lookup(context.Background(), query)
+}
+
+// lookupRemote queries sshizzle-ca, signing in with the same config and token cache as
+// sshizzle-agent
+func lookupRemote(query ledger.Query) ([]ledger.Record, error) {
+	c, err := config.Check()
+	if err != nil {
+		return nil, err
+	}
+
+	// A cached refresh token is used by the client to get a new access token if required
+	token := sshizzleagent.LoadToken()
+	if token.RefreshToken == "" {
+		if token, err = sshizzleagent.Authenticate(token, c.OauthConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	opts := azure.DefaultInvokeOptions
+	opts.Timeout = c.CATimeout
+	opts.IDToken = c.IDToken
+	functionRecords, err := azure.LookupCertificates(context.Background(), query.Values(), c.FuncHost, c.OauthConfig, token, opts)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]ledger.Record, 0, len(functionRecords))
+	for _, record := range functionRecords {
+		records = append(records, ledger.Record(record))
+	}
+	return records, nil
+}
+
+// printRecords prints a table of the certificates, most recently issued first
+func printRecords(records []ledger.Record) {
+	if len(records) == 0 {
+		fmt.Println("No certificates found")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SERIAL\tISSUED\tREQUESTER\tPRINCIPALS\tVALID BEFORE\tFINGERPRINT\tCLIENT IP\tREQUEST")
+	for _, record := range records {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			record.Serial,
+			record.IssuedAt.Local().Format(time.RFC3339),
+			record.Requester,
+			strings.Join(record.Principals, ","),
+			record.ValidBefore.Local().Format(time.RFC3339),
+			record.Fingerprint,
+			record.ClientIP,
+			record.RequestID,
+		)
+	}
+	w.Flush()
+}
@@ -0,0 +1,213 @@
+package approval
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// States of an approval request
+const (
+	StatePending  = "pending"
+	StateApproved = "approved"
+	StateDenied   = "denied"
+)
+
+// Errors returned by a Store
+var (
+	ErrNotFound = errors.New("approval request not found")
+	ErrConflict = errors.New("approval request was changed by someone else")
+)
+
+// Request is a request for certificates with privileged principals, which must be approved by
+// someone other than the requester before the certificates are issued
+type Request struct {
+	ID          string
+	Requester   string
+	RequesterID string
+	Principals  []string
+	// Justification given by the requester, for the approvers
+	Justification string
+	State         string
+	CreatedAt     time.Time
+	// ExpiresAt is when a pending request expires, or an approved request can no longer be
+	// used to issue certificates
+	ExpiresAt time.Time
+	DecidedBy string
+	DecidedAt time.Time
+
+	// version is used by stores to detect concurrent updates
+	version string
+}
+
+// Expired reports whether the request can no longer be approved or used
+func (r *Request) Expired() bool {
+	return time.Now().After(r.ExpiresAt)
+}
+
+// Store persists approval requests for a Workflow
+type Store interface {
+	// Create adds a new request
+	Create(ctx context.Context, request *Request) error
+	// Get returns the request with the ID, or ErrNotFound
+	Get(ctx context.Context, id string) (*Request, error)
+	// Update saves changes to a request, returning ErrConflict if it has been changed since
+	// it was read
+	Update(ctx context.Context, request *Request) error
+	// Pending returns the requests waiting for approval
+	Pending(ctx context.Context) ([]*Request, error)
+}
+
+// Workflow parks requests for privileged principals until they are approved
+type Workflow struct {
+	store      Store
+	privileged map[string]bool
+	approvers  map[string]bool
+	// Timeout is how long a request waits for approval
+	timeout time.Duration
+	// Grant is how long certificates can be issued for after a request is approved
+	grant time.Duration
+}
+
+// NewWorkflow returns a Workflow requiring one of the approvers, given as Azure AD principal
+// names or object IDs, to approve requests for the privileged principals
+func NewWorkflow(store Store, privileged []string, approvers []string, timeout time.Duration, grant time.Duration) *Workflow {
+	w := &Workflow{
+		store:      store,
+		privileged: make(map[string]bool),
+		approvers:  make(map[string]bool),
+		timeout:    timeout,
+		grant:      grant,
+	}
+	for _, principal := range privileged {
+		w.privileged[principal] = true
+	}
+	for _, approver := range approvers {
+		w.approvers[strings.ToLower(approver)] = true
+	}
+	return w
+}
+
+// IsPrivileged reports whether certificates for the principal require approval
+func (w *Workflow) IsPrivileged(principal string) bool {
+	return w != nil && w.privileged[principal]
+}
+
+// IsApprover reports whether the Azure AD principal may approve requests
+func (w *Workflow) IsApprover(name string, id string) bool {
+	return w != nil && (w.approvers[strings.ToLower(name)] || w.approvers[strings.ToLower(id)])
+}
+
+// Request returns the existing request with the ID if it belongs to the requester, is for the
+// same principals and justification, and hasn't expired. Otherwise a new pending request is
+// created, so an approval can't be reused for a different reason than the approver saw
+func (w *Workflow) Request(ctx context.Context, id string, requester string, requesterID string, principals []string, justification string) (*Request, error) {
+	principals = normalise(principals)
+	if id != "" {
+		request, err := w.store.Get(ctx, id)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+		if err == nil && request.RequesterID == requesterID && equal(request.Principals, principals) && request.Justification == justification && !request.Expired() {
+			return request, nil
+		}
+	}
+
+	now := time.Now().UTC()
+	request := &Request{
+		ID:            uuid.New().String(),
+		Requester:     requester,
+		RequesterID:   requesterID,
+		Principals:    principals,
+		Justification: justification,
+		State:         StatePending,
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(w.timeout),
+	}
+	if err := w.store.Create(ctx, request); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// Decide approves or denies a pending request. Approvers can't decide their own requests
+func (w *Workflow) Decide(ctx context.Context, id string, approver string, approverID string, approve bool) (*Request, error) {
+	if !w.IsApprover(approver, approverID) {
+		return nil, errors.New("not permitted to approve requests")
+	}
+	request, err := w.store.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if request.RequesterID == approverID || strings.EqualFold(request.Requester, approver) {
+		return nil, errors.New("requests can't be approved by the requester")
+	}
+	if request.State != StatePending {
+		return nil, fmt.Errorf("request has already been %s by %s", request.State, request.DecidedBy)
+	}
+	if request.Expired() {
+		return nil, errors.New("request has expired")
+	}
+
+	request.DecidedBy = approver
+	request.DecidedAt = time.Now().UTC()
+	request.State = StateDenied
+	if approve {
+		request.State = StateApproved
+		request.ExpiresAt = request.DecidedAt.Add(w.grant)
+	}
+	if err := w.store.Update(ctx, request); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// Pending returns the requests waiting for approval, oldest first
+func (w *Workflow) Pending(ctx context.Context) ([]*Request, error) {
+	requests, err := w.store.Pending(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pending := make([]*Request, 0, len(requests))
+	for _, request := range requests {
+		if request.State == StatePending && !request.Expired() {
+			pending = append(pending, request)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].CreatedAt.Before(pending[j].CreatedAt)
+	})
+	return pending, nil
+}
+
+// normalise sorts and removes duplicate principals, so requests can be compared
+func normalise(principals []string) []string {
+	seen := make(map[string]bool)
+	var result []string
+	for _, principal := range principals {
+		if !seen[principal] {
+			seen[principal] = true
+			result = append(result, principal)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// equal reports whether two normalised lists of principals are the same
+func equal(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
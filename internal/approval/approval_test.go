@@ -0,0 +1,270 @@
+package approval
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestWorkflow returns a Workflow using a MemoryStore, where root needs approval by bob or
+// the approver-id object
+func newTestWorkflow() (*Workflow, *MemoryStore) {
+	store := NewMemoryStore()
+	return NewWorkflow(store, []string{"root"}, []string{"Bob@example.com", "approver-id"}, time.Hour, 10*time.Minute), store
+}
+
+// expire moves the expiry of a stored request into the past
+func expire(t *testing.T, store *MemoryStore, id string) {
+	t.Helper()
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	request, ok := store.requests[id]
+	if !ok {
+		t.Fatalf("request %s not found", id)
+	}
+	request.ExpiresAt = time.Now().Add(-time.Second)
+	store.requests[id] = request
+}
+
+func TestIsPrivilegedAndApprover(t *testing.T) {
+	workflow, _ := newTestWorkflow()
+	if !workflow.IsPrivileged("root") || workflow.IsPrivileged("alice") {
+		t.Error("expected only root to be privileged")
+	}
+	if !workflow.IsApprover("bob@EXAMPLE.com", "") || !workflow.IsApprover("", "APPROVER-ID") || workflow.IsApprover("alice@example.com", "alice-id") {
+		t.Error("expected approvers to be matched by name or ID, ignoring case")
+	}
+	var disabled *Workflow
+	if disabled.IsPrivileged("root") || disabled.IsApprover("bob@example.com", "") {
+		t.Error("expected nothing to need approval without a workflow")
+	}
+}
+
+func TestRequest(t *testing.T) {
+	ctx := context.Background()
+	workflow, _ := newTestWorkflow()
+
+	request, err := workflow.Request(ctx, "", "alice@example.com", "alice-id", []string{"root", "alice", "root"}, "incident 42")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if request.State != StatePending || request.ID == "" {
+		t.Fatalf("expected a new pending request, got %+v", request)
+	}
+	if !reflect.DeepEqual(request.Principals, []string{"alice", "root"}) {
+		t.Errorf("got principals %v, expected them sorted without duplicates", request.Principals)
+	}
+	if d := time.Until(request.ExpiresAt); d < 59*time.Minute || d > time.Hour {
+		t.Errorf("request expires in %s, expected the timeout", d)
+	}
+
+	tests := []struct {
+		name          string
+		id            string
+		requesterID   string
+		principals    []string
+		justification string
+		reused        bool
+	}{
+		{name: "same request", id: request.ID, requesterID: "alice-id", principals: []string{"alice", "root"}, justification: "incident 42", reused: true},
+		{name: "principals in another order", id: request.ID, requesterID: "alice-id", principals: []string{"root", "alice"}, justification: "incident 42", reused: true},
+		{name: "different justification", id: request.ID, requesterID: "alice-id", principals: []string{"alice", "root"}, justification: "incident 43"},
+		{name: "different principals", id: request.ID, requesterID: "alice-id", principals: []string{"root"}, justification: "incident 42"},
+		{name: "different requester", id: request.ID, requesterID: "mallory-id", principals: []string{"alice", "root"}, justification: "incident 42"},
+		{name: "unknown ID", id: "unknown", requesterID: "alice-id", principals: []string{"alice", "root"}, justification: "incident 42"},
+		{name: "no ID", requesterID: "alice-id", principals: []string{"alice", "root"}, justification: "incident 42"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := workflow.Request(ctx, test.id, "requester", test.requesterID, test.principals, test.justification)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if (result.ID == request.ID) != test.reused {
+				t.Fatalf("got request %s, expected reused %t", result.ID, test.reused)
+			}
+			if !test.reused && (result.State != StatePending || result.Justification != test.justification) {
+				t.Errorf("expected a new pending request for the justification, got %+v", result)
+			}
+		})
+	}
+}
+
+func TestApprovalReuse(t *testing.T) {
+	ctx := context.Background()
+	workflow, store := newTestWorkflow()
+	request, err := workflow.Request(ctx, "", "alice@example.com", "alice-id", []string{"root"}, "incident 42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	approved, err := workflow.Decide(ctx, request.ID, "bob@example.com", "bob-id", true)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if approved.State != StateApproved || approved.DecidedBy != "bob@example.com" {
+		t.Fatalf("expected the request to be approved by bob, got %+v", approved)
+	}
+	if d := time.Until(approved.ExpiresAt); d < 9*time.Minute || d > 10*time.Minute {
+		t.Errorf("approval expires in %s, expected the grant", d)
+	}
+
+	// The approval is used for the same justification
+	reused, err := workflow.Request(ctx, request.ID, "alice@example.com", "alice-id", []string{"root"}, "incident 42")
+	if err != nil || reused.ID != request.ID || reused.State != StateApproved {
+		t.Fatalf("expected the approved request, got %+v %v", reused, err)
+	}
+	// But not for another reason than the approver saw
+	other, err := workflow.Request(ctx, request.ID, "alice@example.com", "alice-id", []string{"root"}, "something else")
+	if err != nil || other.ID == request.ID || other.State != StatePending {
+		t.Fatalf("expected a new pending request, got %+v %v", other, err)
+	}
+	// Nor once the grant has expired
+	expire(t, store, request.ID)
+	expired, err := workflow.Request(ctx, request.ID, "alice@example.com", "alice-id", []string{"root"}, "incident 42")
+	if err != nil || expired.ID == request.ID || expired.State != StatePending {
+		t.Fatalf("expected a new pending request, got %+v %v", expired, err)
+	}
+}
+
+func TestDecide(t *testing.T) {
+	tests := []struct {
+		name       string
+		approver   string
+		approverID string
+		approve    bool
+		// byApprover is true if the request is made by an approver, bob with the approver-id object
+		byApprover bool
+		expire     bool
+		decided    bool
+		id         string
+		state      string
+		err        string
+	}{
+		{name: "approved", approver: "bob@example.com", approverID: "bob-id", approve: true, state: StateApproved},
+		{name: "approved by object ID", approver: "carol@example.com", approverID: "approver-id", approve: true, state: StateApproved},
+		{name: "denied", approver: "bob@example.com", approverID: "bob-id", state: StateDenied},
+		{name: "not an approver", approver: "mallory@example.com", approverID: "mallory-id", approve: true, err: "not permitted"},
+		{name: "self-approval by ID", approver: "someone@example.com", approverID: "approver-id", approve: true, byApprover: true, err: "can't be approved by the requester"},
+		{name: "self-approval by name", approver: "BOB@example.com", approverID: "other-id", approve: true, byApprover: true, err: "can't be approved by the requester"},
+		{name: "expired", approver: "bob@example.com", approverID: "bob-id", approve: true, expire: true, err: "request has expired"},
+		{name: "already decided", approver: "bob@example.com", approverID: "bob-id", approve: true, decided: true, err: "already been denied"},
+		{name: "unknown request", approver: "bob@example.com", approverID: "bob-id", approve: true, id: "unknown", err: ErrNotFound.Error()},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			workflow, store := newTestWorkflow()
+			requester, requesterID := "alice@example.com", "alice-id"
+			if test.byApprover {
+				requester, requesterID = "bob@example.com", "approver-id"
+			}
+			request, err := workflow.Request(ctx, "", requester, requesterID, []string{"root"}, "incident 42")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.expire {
+				expire(t, store, request.ID)
+			}
+			if test.decided {
+				if _, err := workflow.Decide(ctx, request.ID, "approver", "approver-id", false); err != nil {
+					t.Fatal(err)
+				}
+			}
+			id := request.ID
+			if test.id != "" {
+				id = test.id
+			}
+
+			decided, err := workflow.Decide(ctx, id, test.approver, test.approverID, test.approve)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				// The request is left as it was
+				if stored, err := store.Get(ctx, request.ID); err == nil && !test.decided && stored.State != StatePending {
+					t.Errorf("request was changed to %s", stored.State)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if decided.State != test.state || decided.DecidedBy != test.approver || decided.DecidedAt.IsZero() {
+				t.Errorf("unexpected decision %+v", decided)
+			}
+			stored, err := store.Get(ctx, request.ID)
+			if err != nil || stored.State != test.state {
+				t.Errorf("decision wasn't stored, got %+v %v", stored, err)
+			}
+		})
+	}
+}
+
+func TestDeniedNotReused(t *testing.T) {
+	ctx := context.Background()
+	workflow, _ := newTestWorkflow()
+	request, err := workflow.Request(ctx, "", "alice@example.com", "alice-id", []string{"root"}, "incident 42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := workflow.Decide(ctx, request.ID, "bob@example.com", "bob-id", false); err != nil {
+		t.Fatal(err)
+	}
+	// A denied request is returned as it is, so the requester sees it was denied
+	denied, err := workflow.Request(ctx, request.ID, "alice@example.com", "alice-id", []string{"root"}, "incident 42")
+	if err != nil || denied.State != StateDenied {
+		t.Fatalf("expected the denied request, got %+v %v", denied, err)
+	}
+	pending, err := workflow.Pending(ctx)
+	if err != nil || len(pending) != 0 {
+		t.Fatalf("expected no pending requests, got %v %v", pending, err)
+	}
+}
+
+func TestPending(t *testing.T) {
+	ctx := context.Background()
+	workflow, store := newTestWorkflow()
+	var ids []string
+	for _, justification := range []string{"first", "second", "expired", "approved"} {
+		request, err := workflow.Request(ctx, "", "alice@example.com", "alice-id", []string{"root"}, justification)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, request.ID)
+		time.Sleep(time.Millisecond)
+	}
+	expire(t, store, ids[2])
+	if _, err := workflow.Decide(ctx, ids[3], "bob@example.com", "bob-id", true); err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := workflow.Pending(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(pending) != 2 || pending[0].ID != ids[0] || pending[1].ID != ids[1] {
+		t.Fatalf("expected the first and second requests oldest first, got %+v", pending)
+	}
+}
+
+func TestMemoryStoreConflict(t *testing.T) {
+	ctx := context.Background()
+	workflow, store := newTestWorkflow()
+	request, err := workflow.Request(ctx, "", "alice@example.com", "alice-id", []string{"root"}, "incident 42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two approvers read the request at the same time, and only the first decision is saved
+	first, _ := store.Get(ctx, request.ID)
+	second, _ := store.Get(ctx, request.ID)
+	first.State = StateApproved
+	if err := store.Update(ctx, first); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	second.State = StateDenied
+	if err := store.Update(ctx, second); err != ErrConflict {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+}
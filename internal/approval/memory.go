@@ -0,0 +1,76 @@
+package approval
+
+import (
+	"context"
+	"strconv"
+	"sync"
+)
+
+// MemoryStore keeps requests in memory. Requests are lost when the function restarts, and
+// aren't shared between instances of the function
+type MemoryStore struct {
+	mu       sync.Mutex
+	requests map[string]Request
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		requests: make(map[string]Request),
+	}
+}
+
+// Create adds a new request
+func (s *MemoryStore) Create(ctx context.Context, request *Request) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	request.version = "1"
+	s.requests[request.ID] = *request
+	return nil
+}
+
+// Get returns a copy of the request with the ID
+func (s *MemoryStore) Get(ctx context.Context, id string) (*Request, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	request, ok := s.requests[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &request, nil
+}
+
+// Update saves the request if it hasn't been changed since it was read
+func (s *MemoryStore) Update(ctx context.Context, request *Request) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.requests[request.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	if current.version != request.version {
+		return ErrConflict
+	}
+	version, _ := strconv.Atoi(request.version)
+	request.version = strconv.Itoa(version + 1)
+	s.requests[request.ID] = *request
+	return nil
+}
+
+// Pending returns the requests waiting for approval, discarding any that have expired
+func (s *MemoryStore) Pending(ctx context.Context) ([]*Request, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var pending []*Request
+	for id, request := range s.requests {
+		if request.Expired() {
+			delete(s.requests, id)
+			continue
+		}
+		if request.State == StatePending {
+			r := request
+			pending = append(pending, &r)
+		}
+	}
+	return pending, nil
+}
@@ -0,0 +1,167 @@
+package approval
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+// Partition containing all approval requests
+const tablePartition = "approval"
+
+// Timeout in seconds for each request to Table Storage
+const tableTimeout = 10
+
+// TableStore keeps requests in Azure Table Storage, so they are shared between all instances
+// of the function. Each request is an entity with its ID as the row key
+type TableStore struct {
+	table *storage.Table
+}
+
+// NewTableStore returns a TableStore using the storage account in the connection string,
+// creating the table if required. Use "UseDevelopmentStorage=true" for the local emulator
+func NewTableStore(connectionString string, tableName string) (*TableStore, error) {
+	client, err := storage.NewClientFromConnectionString(connectionString)
+	if err != nil {
+		return nil, fmt.Errorf("error creating table storage client: %s", err.Error())
+	}
+	tableService := client.GetTableService()
+	table := tableService.GetTableReference(tableName)
+	if err := table.Create(tableTimeout, storage.EmptyPayload, nil); err != nil && !isStatus(err, http.StatusConflict) {
+		return nil, fmt.Errorf("error creating table %s: %s", tableName, err.Error())
+	}
+	return &TableStore{table: table}, nil
+}
+
+// Create inserts an entity for the request
+func (s *TableStore) Create(ctx context.Context, request *Request) error {
+	entity := s.table.GetEntityReference(tablePartition, request.ID)
+	entity.Properties = requestProperties(request)
+	// Ask for the entity back so we get its ETag
+	if err := entity.Insert(storage.FullMetadata, nil); err != nil {
+		return err
+	}
+	request.version = entity.OdataEtag
+	return nil
+}
+
+// Get reads the request with the ID
+func (s *TableStore) Get(ctx context.Context, id string) (*Request, error) {
+	// Row keys can't contain some characters, and IDs are always UUIDs
+	if strings.ContainsAny(id, "/\\#?'") {
+		return nil, ErrNotFound
+	}
+	entity := s.table.GetEntityReference(tablePartition, id)
+	err := entity.Get(tableTimeout, storage.FullMetadata, nil)
+	if isStatus(err, http.StatusNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return entityRequest(entity), nil
+}
+
+// Update replaces the request's entity, using its ETag to detect concurrent changes
+func (s *TableStore) Update(ctx context.Context, request *Request) error {
+	entity := s.table.GetEntityReference(tablePartition, request.ID)
+	entity.Properties = requestProperties(request)
+	entity.OdataEtag = request.version
+	err := entity.Update(false, nil)
+	// The storage package doesn't wrap the error when the ETag doesn't match
+	if isStatus(err, http.StatusPreconditionFailed) || (err != nil && strings.HasPrefix(err.Error(), "Etag didn't match")) {
+		return ErrConflict
+	}
+	if err != nil {
+		return err
+	}
+	request.version = entity.OdataEtag
+	return nil
+}
+
+// Pending returns the requests waiting for approval which haven't expired
+func (s *TableStore) Pending(ctx context.Context) ([]*Request, error) {
+	filter := fmt.Sprintf("PartitionKey eq '%s' and State eq '%s' and ExpiresAt gt datetime'%s'",
+		tablePartition, StatePending, time.Now().UTC().Format(time.RFC3339))
+	result, err := s.table.QueryEntities(tableTimeout, storage.FullMetadata, &storage.QueryOptions{Filter: filter})
+	var pending []*Request
+	for {
+		if err != nil {
+			return nil, err
+		}
+		for _, entity := range result.Entities {
+			pending = append(pending, entityRequest(entity))
+		}
+		if result.NextLink == nil || ctx.Err() != nil {
+			break
+		}
+		result, err = result.NextResults(nil)
+	}
+	return pending, ctx.Err()
+}
+
+// requestProperties converts a request to entity properties
+func requestProperties(request *Request) map[string]interface{} {
+	properties := map[string]interface{}{
+		"Requester":     request.Requester,
+		"RequesterID":   request.RequesterID,
+		"Principals":    strings.Join(request.Principals, ","),
+		"Justification": request.Justification,
+		"State":         request.State,
+		"CreatedAt":     request.CreatedAt.UTC(),
+		"ExpiresAt":     request.ExpiresAt.UTC(),
+		"DecidedBy":     request.DecidedBy,
+	}
+	if !request.DecidedAt.IsZero() {
+		properties["DecidedAt"] = request.DecidedAt.UTC()
+	}
+	return properties
+}
+
+// entityRequest converts an entity read from Table Storage into a Request
+func entityRequest(entity *storage.Entity) *Request {
+	stringProperty := func(name string) string {
+		value, _ := entity.Properties[name].(string)
+		return value
+	}
+	request := &Request{
+		ID:            entity.RowKey,
+		Requester:     stringProperty("Requester"),
+		RequesterID:   stringProperty("RequesterID"),
+		Justification: stringProperty("Justification"),
+		State:         stringProperty("State"),
+		CreatedAt:     timeProperty(entity.Properties["CreatedAt"]),
+		ExpiresAt:     timeProperty(entity.Properties["ExpiresAt"]),
+		DecidedBy:     stringProperty("DecidedBy"),
+		DecidedAt:     timeProperty(entity.Properties["DecidedAt"]),
+		version:       entity.OdataEtag,
+	}
+	if principals := stringProperty("Principals"); principals != "" {
+		request.Principals = strings.Split(principals, ",")
+	}
+	return request
+}
+
+// timeProperty converts a time read from Table Storage, which is decoded from JSON
+func timeProperty(value interface{}) time.Time {
+	switch v := value.(type) {
+	case time.Time:
+		return v.UTC()
+	case string:
+		t, _ := time.Parse(time.RFC3339Nano, v)
+		return t.UTC()
+	default:
+		return time.Time{}
+	}
+}
+
+// isStatus reports whether err is a Table Storage error with the status code specified
+func isStatus(err error, statusCode int) bool {
+	var storageErr storage.AzureStorageServiceError
+	return errors.As(err, &storageErr) && storageErr.StatusCode == statusCode
+}
@@ -5,85 +5,621 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/thalesgroup/sshizzle/internal/oidc"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/oauth2"
 )
 
+// APIVersion is the current version of the sign function's request and response schema.
+// Requests without a version are treated as version 1, and receive a version 1 response
+const APIVersion = 2
+
+// Error codes returned by the sign function in version 2 responses
+const (
+	ErrorCodeInvalidRequest     = "invalid_request"
+	ErrorCodeInvalidPublicKey   = "invalid_public_key"
+	ErrorCodeUnsupportedVersion = "unsupported_version"
+	ErrorCodeUnauthenticated    = "unauthenticated"
+	ErrorCodePolicyDenied       = "policy_denied"
+	ErrorCodeRateLimited        = "rate_limited"
+	ErrorCodeCAUnavailable      = "ca_unavailable"
+	ErrorCodeInternal           = "internal_error"
+)
+
+// MaxPublicKeys is the maximum number of public keys that can be signed in one request
+const MaxPublicKeys = 4
+
 // FunctionPayload is the payload structure for the Azure Function
 type FunctionPayload struct {
-	PublicKey string `json:"public_key"`
+	Version int `json:"version,omitempty"`
+	// PublicKey is a single key to sign, as sent by version 1 clients
+	PublicKey string `json:"public_key,omitempty"`
+	// PublicKeys to sign in version 2 requests, each receiving its own certificate
+	PublicKeys []string `json:"public_keys,omitempty"`
+	// Principals requested in addition to the user's own, which may require approval
+	Principals []string `json:"principals,omitempty"`
+	// ApprovalID of an earlier request for the principals, which is pending or approved
+	ApprovalID string `json:"approval_id,omitempty"`
+	// Justification for the request, such as a change ticket, recorded in the certificates
+	Justification string `json:"justification,omitempty"`
+}
+
+// ApprovalPayload is the payload used to approve or deny a request for privileged principals
+type ApprovalPayload struct {
+	Version int    `json:"version,omitempty"`
+	ID      string `json:"id"`
+	Approve bool   `json:"approve"`
 }
 
 // FunctionResponse is the structure for a response from the Azure Function
 type FunctionResponse struct {
-	Response string `json:"response"`
+	Version   int    `json:"version,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	// Response contains the certificate in version 1 responses
+	Response string `json:"response,omitempty"`
+	// CAPublicKey and Certificates, in the same order as the public keys, in version 2 responses
+	CAPublicKey  string                `json:"ca_public_key,omitempty"`
+	Certificates []FunctionCertificate `json:"certificates,omitempty"`
+	// Records of issued certificates returned by the lookup function
+	Records []FunctionRecord `json:"records,omitempty"`
+	// Approval is set instead of the certificates if the request is waiting for approval
+	Approval *FunctionApproval `json:"approval,omitempty"`
+	// Approvals lists the requests waiting for approval, for approvers
+	Approvals []FunctionApproval `json:"approvals,omitempty"`
+	// Error is set instead of the certificates if the request failed
+	Error *FunctionError `json:"error,omitempty"`
+}
+
+// FunctionCertificate describes a certificate in a version 2 response
+type FunctionCertificate struct {
+	Certificate string   `json:"certificate"`
+	Serial      uint64   `json:"serial"`
+	KeyID       string   `json:"key_id"`
+	Principals  []string `json:"principals"`
+	ValidAfter  uint64   `json:"valid_after"`
+	ValidBefore uint64   `json:"valid_before"`
+}
+
+// FunctionRecord describes a certificate in the ledger, in a lookup response
+type FunctionRecord struct {
+	Serial      uint64    `json:"serial"`
+	KeyID       string    `json:"key_id"`
+	Principals  []string  `json:"principals"`
+	Fingerprint string    `json:"fingerprint"`
+	ValidAfter  time.Time `json:"valid_after"`
+	ValidBefore time.Time `json:"valid_before"`
+	IssuedAt    time.Time `json:"issued_at"`
+	RequestID   string    `json:"request_id"`
+	// Requester is the Azure AD principal that requested the certificate
+	Requester   string `json:"requester"`
+	RequesterID string `json:"requester_id"`
+	ClientIP    string `json:"client_ip"`
+}
+
+// FunctionApproval describes a request for privileged principals which must be approved
+type FunctionApproval struct {
+	ID         string   `json:"id"`
+	State      string   `json:"state"`
+	Requester  string   `json:"requester"`
+	Principals []string `json:"principals"`
+	CreatedAt  int64    `json:"created_at"`
+	// ExpiresAt is when a pending request expires, or an approval can no longer be used
+	ExpiresAt int64  `json:"expires_at"`
+	DecidedBy string `json:"decided_by,omitempty"`
+	// Justification given by the requester
+	Justification string `json:"justification,omitempty"`
+}
+
+// FunctionError describes why a request to the Azure Function failed
+type FunctionError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ClientPrincipal is the X-Ms-Client-Principal header set by App Service Authentication,
+// describing the signed in user's claims
+type ClientPrincipal struct {
+	AuthType string                 `json:"auth_typ"`
+	Claims   []ClientPrincipalClaim `json:"claims"`
+	NameType string                 `json:"name_typ"`
+	RoleType string                 `json:"role_typ"`
+}
+
+// ClientPrincipalClaim is a claim in the ClientPrincipal. Claims with several values are repeated
+type ClientPrincipalClaim struct {
+	Type  string `json:"typ"`
+	Value string `json:"val"`
+}
+
+// ParseClientPrincipal returns the claims from an X-Ms-Client-Principal header
+func ParseClientPrincipal(header string) (map[string][]string, error) {
+	data, err := base64.StdEncoding.DecodeString(header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode client principal: %s", err.Error())
+	}
+	var principal ClientPrincipal
+	if err := json.Unmarshal(data, &principal); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal client principal: %s", err.Error())
+	}
+	claims := make(map[string][]string)
+	for _, claim := range principal.Claims {
+		claims[claim.Type] = append(claims[claim.Type], claim.Value)
+	}
+	return claims, nil
+}
+
+// EncodeClientPrincipal returns an X-Ms-Client-Principal header for the claims
+func EncodeClientPrincipal(authType string, claims map[string][]string) string {
+	principal := ClientPrincipal{AuthType: authType, Claims: []ClientPrincipalClaim{}}
+	for claimType, values := range claims {
+		for _, value := range values {
+			principal.Claims = append(principal.Claims, ClientPrincipalClaim{Type: claimType, Value: value})
+		}
+	}
+	data, _ := json.Marshal(&principal)
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+// NewFunctionResponse creates a version 2 response describing the signed certificates
+func NewFunctionResponse(requestID string, certificates []*ssh.Certificate) *FunctionResponse {
+	response := &FunctionResponse{
+		Version:   APIVersion,
+		RequestID: requestID,
+	}
+	for _, certificate := range certificates {
+		response.CAPublicKey = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(certificate.SignatureKey)))
+		response.Certificates = append(response.Certificates, FunctionCertificate{
+			Certificate: base64.RawURLEncoding.EncodeToString(certificate.Marshal()),
+			Serial:      certificate.Serial,
+			KeyID:       certificate.KeyId,
+			Principals:  certificate.ValidPrincipals,
+			ValidAfter:  certificate.ValidAfter,
+			ValidBefore: certificate.ValidBefore,
+		})
+	}
+	return response
+}
+
+// Keys returns the public keys in the payload, whichever version of the API was used
+func (p *FunctionPayload) Keys() []string {
+	if len(p.PublicKeys) == 0 && p.PublicKey != "" {
+		return []string{p.PublicKey}
+	}
+	return p.PublicKeys
+}
+
+// Errors returned by InvokeSignFunction, wrapped in an InvokeError
+var (
+	// ErrAuthExpired means the token was rejected, and the user must authenticate again
+	ErrAuthExpired = errors.New("authentication expired")
+	// ErrPolicyDenied means the CA refused to issue a certificate for this user
+	ErrPolicyDenied = errors.New("certificate request denied by policy")
+	// ErrCAUnavailable means the CA couldn't be reached, or failed after retrying
+	ErrCAUnavailable = errors.New("certificate authority unavailable")
+	// ErrApprovalExpired means nobody approved the request before it expired
+	ErrApprovalExpired = errors.New("certificate request was not approved in time")
+	// ErrApprovalPending means the request is waiting for approval, and InvokeOptions.NoWait
+	// was set
+	ErrApprovalPending = errors.New("certificate request is waiting for approval")
+)
+
+// InvokeError describes a failed invocation of the sign function
+type InvokeError struct {
+	// Err is one of the ErrAuthExpired, ErrPolicyDenied, ErrCAUnavailable, ErrApprovalExpired
+	// or ErrApprovalPending, or nil
+	Err        error
+	StatusCode int
+	// Code is the error code given by version 2 of the API
+	Code    string
+	Message string
+	// RetryAfter is how long the CA asked us to wait before trying again, if at all
+	RetryAfter time.Duration
+}
+
+// Error returns a description of the failure including the reason given by the CA
+func (e *InvokeError) Error() string {
+	reason := "azure function invocation failed"
+	if e.Err != nil {
+		reason = e.Err.Error()
+	}
+	if e.StatusCode != 0 {
+		reason = fmt.Sprintf("%s (HTTP %d)", reason, e.StatusCode)
+	}
+	if e.Code != "" {
+		reason = fmt.Sprintf("%s [%s]", reason, e.Code)
+	}
+	if e.Message != "" {
+		reason = fmt.Sprintf("%s: %s", reason, e.Message)
+	}
+	if e.RetryAfter > 0 {
+		reason = fmt.Sprintf("%s, try again in %s", reason, e.RetryAfter.Round(time.Second))
+	}
+	return reason
+}
+
+// Unwrap allows the error to be checked with errors.Is
+func (e *InvokeError) Unwrap() error {
+	return e.Err
 }
 
-// InvokeSignFunction invokes the sshizzle-ca on Azure Functions with a given OAuth config and token
-func InvokeSignFunction(publicKey *ssh.PublicKey, funcHost string, oauthConfig *oauth2.Config, token *oauth2.Token) (*ssh.Certificate, error) {
+// InvokeOptions control the timeouts and retries used when invoking the sign function
+type InvokeOptions struct {
+	// Timeout for each attempt to invoke the function
+	Timeout time.Duration
+	// Number of times to retry after rate limiting, server errors or connection failures
+	MaxRetries int
+	// Bounds for the exponential backoff between retries
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// PollInterval is how often to check whether a request waiting for approval was approved.
+	// Each check counts towards the CA's rate limits
+	PollInterval time.Duration
+	// OnPending is called, if set, each time the CA says the request is waiting for approval
+	OnPending func(approval *FunctionApproval)
+	// NoWait returns ErrApprovalPending as soon as the request is waiting for approval, with
+	// SignRequest.ApprovalID set, rather than polling until it's decided
+	NoWait bool
+	// IDToken sends the user's ID token rather than their access token, for OIDC providers
+	// other than Azure AD
+	IDToken bool
+}
+
+// SignRequest describes the certificates to request from the sign function
+type SignRequest struct {
+	PublicKeys []ssh.PublicKey
+	// Principals requested in addition to the user's own
+	Principals []string
+	// ApprovalID of an earlier request for the same principals. It's updated if the CA
+	// creates a new request, so it can be reused while the approval lasts
+	ApprovalID string
+	// Justification for the certificates, such as a change ticket
+	Justification string
+}
+
+// DefaultInvokeOptions allow for a cold start of the Azure Function, which can take a while
+var DefaultInvokeOptions = InvokeOptions{
+	Timeout:      30 * time.Second,
+	MaxRetries:   3,
+	MinBackoff:   500 * time.Millisecond,
+	MaxBackoff:   10 * time.Second,
+	PollInterval: 10 * time.Second,
+}
+
+// InvokeSignFunction invokes the sshizzle-ca on Azure Functions with a given OAuth config and
+// token, returning a certificate for each public key in the same order. If the request needs
+// approval, the function is polled until it is approved, denied or expires, unless
+// opts.NoWait is set
+func InvokeSignFunction(ctx context.Context, request *SignRequest, funcHost string, oauthConfig *oauth2.Config, token *oauth2.Token, opts InvokeOptions) ([]*ssh.Certificate, error) {
+	publicKeys := request.PublicKeys
 	// Construct function URL from Function Name
 	funcURL := "https://" + funcHost + "/api/sign-agent-key"
 
-	// Marshal Public Key and encode into Base64
-	encodedKey := base64.RawURLEncoding.EncodeToString((*publicKey).Marshal())
-
-	// Create a function payload containing the key
-	payload := &FunctionPayload{encodedKey}
+	// Create a function payload containing the keys, marshalled and encoded into Base64
+	payload := &FunctionPayload{
+		Version:       APIVersion,
+		Principals:    request.Principals,
+		ApprovalID:    request.ApprovalID,
+		Justification: request.Justification,
+	}
+	for _, publicKey := range publicKeys {
+		payload.PublicKeys = append(payload.PublicKeys, base64.RawURLEncoding.EncodeToString(publicKey.Marshal()))
+	}
+	// Version 1 of the CA only understands a single key
+	if len(payload.PublicKeys) > 0 {
+		payload.PublicKey = payload.PublicKeys[0]
+	}
 
 	// Create a marhsalled payload
 	jsonPayload, err := json.Marshal(payload)
 	if err != nil {
 		return nil, err
 	}
-	// Setup the POST request
-	request, err := http.NewRequest("POST", funcURL, bytes.NewBuffer(jsonPayload))
-	request.Header.Set("Content-Type", "application/json")
 
 	// Create a client using the OAuth token we fetched earlier
-	client := oauthConfig.Client(context.Background(), token)
+	client := newClient(ctx, oauthConfig, token, opts)
 
-	// Invoke the function
+	polling := false
+	for attempt := 0; ; attempt++ {
+		body, err := invokeOnce(ctx, client, funcURL, jsonPayload, opts.Timeout)
+		if err == nil {
+			certificates, approval, err := parseSignResponse(body, publicKeys)
+			if err != nil || approval == nil {
+				return certificates, err
+			}
+
+			// The request is parked until someone approves it, so ask again using its ID. The
+			// CA replaces requests that expire while we're waiting with new ones
+			if (polling && approval.ID != payload.ApprovalID) || time.Now().Unix() >= approval.ExpiresAt {
+				return nil, &InvokeError{Err: ErrApprovalExpired, Message: fmt.Sprintf("request %s", payload.ApprovalID)}
+			}
+			if opts.OnPending != nil {
+				opts.OnPending(approval)
+			}
+			polling = true
+			if approval.ID != payload.ApprovalID {
+				request.ApprovalID = approval.ID
+				payload.ApprovalID = approval.ID
+				if jsonPayload, err = json.Marshal(payload); err != nil {
+					return nil, err
+				}
+			}
+			if opts.NoWait {
+				return nil, &InvokeError{Err: ErrApprovalPending, Message: fmt.Sprintf("request %s", approval.ID)}
+			}
+			select {
+			case <-ctx.Done():
+				return nil, &InvokeError{Err: ErrApprovalExpired, Message: ctx.Err().Error()}
+			case <-time.After(opts.PollInterval):
+			}
+			attempt = -1
+			continue
+		}
+
+		// Only retry if the CA is unavailable, and we've got retries left
+		if !errors.Is(err, ErrCAUnavailable) || attempt >= opts.MaxRetries {
+			return nil, err
+		}
+
+		// Wait before trying again, honouring the server's Retry-After if given. Give up
+		// rather than blocking the SSH client if the wait is longer than we'd back off
+		wait := backoff(attempt, opts.MinBackoff, opts.MaxBackoff)
+		var invokeErr *InvokeError
+		if errors.As(err, &invokeErr) && invokeErr.RetryAfter > 0 {
+			if invokeErr.RetryAfter > opts.MaxBackoff {
+				return nil, err
+			}
+			wait = invokeErr.RetryAfter
+		}
+		select {
+		case <-ctx.Done():
+			return nil, &InvokeError{Err: ErrCAUnavailable, Message: ctx.Err().Error()}
+		case <-time.After(wait):
+		}
+	}
+}
+
+// LookupCertificates queries the ledger of certificates issued by sshizzle-ca with the URL
+// parameters of a lookup. The user must be one of the CA's configured ledger readers
+func LookupCertificates(ctx context.Context, query url.Values, funcHost string, oauthConfig *oauth2.Config, token *oauth2.Token, opts InvokeOptions) ([]FunctionRecord, error) {
+	funcURL := "https://" + funcHost + "/api/lookup-certificates?" + query.Encode()
+	result, err := invokeAPI(ctx, "GET", funcURL, nil, oauthConfig, token, opts)
+	if err != nil {
+		return nil, err
+	}
+	return result.Records, nil
+}
+
+// ListApprovals returns the requests waiting for approval. The user must be one of the CA's
+// configured approvers
+func ListApprovals(ctx context.Context, funcHost string, oauthConfig *oauth2.Config, token *oauth2.Token, opts InvokeOptions) ([]FunctionApproval, error) {
+	result, err := invokeAPI(ctx, "GET", "https://"+funcHost+"/api/approvals", nil, oauthConfig, token, opts)
+	if err != nil {
+		return nil, err
+	}
+	return result.Approvals, nil
+}
+
+// DecideApproval approves or denies a request waiting for approval
+func DecideApproval(ctx context.Context, id string, approve bool, funcHost string, oauthConfig *oauth2.Config, token *oauth2.Token, opts InvokeOptions) (*FunctionApproval, error) {
+	payload, err := json.Marshal(&ApprovalPayload{Version: APIVersion, ID: id, Approve: approve})
+	if err != nil {
+		return nil, err
+	}
+	result, err := invokeAPI(ctx, "POST", "https://"+funcHost+"/api/approvals", payload, oauthConfig, token, opts)
+	if err != nil {
+		return nil, err
+	}
+	return result.Approval, nil
+}
+
+// newClient returns a client authenticating with the token, refreshing it when it expires
+func newClient(ctx context.Context, oauthConfig *oauth2.Config, token *oauth2.Token, opts InvokeOptions) *http.Client {
+	if opts.IDToken {
+		return oauth2.NewClient(ctx, oidc.IDTokenSource(ctx, oauthConfig, token))
+	}
+	return oauthConfig.Client(ctx, token)
+}
+
+// invokeAPI makes a single request to one of the CA's other functions, returning the response
+// if successful
+func invokeAPI(ctx context.Context, method string, funcURL string, payload []byte, oauthConfig *oauth2.Config, token *oauth2.Token, opts InvokeOptions) (*FunctionResponse, error) {
+	client := newClient(ctx, oauthConfig, token, opts)
+
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	request, err := http.NewRequestWithContext(ctx, method, funcURL, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	if payload != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
 	response, err := client.Do(request)
+	if err != nil {
+		return nil, &InvokeError{Err: ErrCAUnavailable, Message: err.Error()}
+	}
+	defer response.Body.Close()
+
+	result := &FunctionResponse{}
+	if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+		return nil, &InvokeError{StatusCode: response.StatusCode, Message: err.Error()}
+	}
+	if result.Error != nil {
+		invokeErr := &InvokeError{StatusCode: response.StatusCode, Code: result.Error.Code, Message: result.Error.Message}
+		switch response.StatusCode {
+		case http.StatusUnauthorized:
+			invokeErr.Err = ErrAuthExpired
+		case http.StatusForbidden:
+			invokeErr.Err = ErrPolicyDenied
+		}
+		return nil, invokeErr
+	}
+	return result, nil
+}
+
+// invokeOnce makes a single request to the sign function, returning the response body if
+// successful
+func invokeOnce(ctx context.Context, client *http.Client, funcURL string, payload []byte, timeout time.Duration) ([]byte, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// Setup the POST request
+	request, err := http.NewRequestWithContext(ctx, "POST", funcURL, bytes.NewReader(payload))
 	if err != nil {
 		return nil, err
 	}
+	request.Header.Set("Content-Type", "application/json")
+
+	// Invoke the function
+	response, err := client.Do(request)
+	if err != nil {
+		// The refresh token was rejected when the client tried to use it
+		var retrieveErr *oauth2.RetrieveError
+		if errors.As(err, &retrieveErr) {
+			return nil, &InvokeError{Err: ErrAuthExpired, Message: err.Error()}
+		}
+		// Otherwise assume the function couldn't be reached, or is still starting up
+		return nil, &InvokeError{Err: ErrCAUnavailable, Message: err.Error()}
+	}
 
 	// Read the whole response
 	defer response.Body.Close()
 	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, &InvokeError{Err: ErrCAUnavailable, StatusCode: response.StatusCode, Message: err.Error()}
+	}
 
 	// Check if request was successful
 	if response.StatusCode >= 200 && response.StatusCode <= 299 {
-		// Unmarshal and decode
-		result := &FunctionResponse{}
-		err = json.Unmarshal(body, &result)
-		if err != nil {
-			return nil, err
+		return body, nil
+	}
+
+	invokeErr := &InvokeError{
+		StatusCode: response.StatusCode,
+		Message:    string(bytes.TrimSpace(body)),
+		RetryAfter: parseRetryAfter(response.Header.Get("Retry-After")),
+	}
+
+	// Use the structured error from version 2 of the API if we got one
+	result := &FunctionResponse{}
+	if err := json.Unmarshal(body, result); err == nil && result.Error != nil {
+		invokeErr.Code = result.Error.Code
+		invokeErr.Message = result.Error.Message
+		if result.RequestID != "" {
+			invokeErr.Message = fmt.Sprintf("%s (request %s)", invokeErr.Message, result.RequestID)
 		}
+	}
 
+	switch {
+	case invokeErr.Code == ErrorCodeUnauthenticated, response.StatusCode == http.StatusUnauthorized:
+		invokeErr.Err = ErrAuthExpired
+	case invokeErr.Code == ErrorCodePolicyDenied, response.StatusCode == http.StatusForbidden:
+		invokeErr.Err = ErrPolicyDenied
+	case response.StatusCode == http.StatusNotFound:
+		invokeErr.Message = "try clearing your DNS cache and try again"
+	case response.StatusCode == http.StatusTooManyRequests, response.StatusCode >= 500:
+		invokeErr.Err = ErrCAUnavailable
+	}
+	return nil, invokeErr
+}
+
+// parseSignResponse decodes the certificates from a successful response, checking each is for
+// the public key in the same position, or the approval if the request is waiting for approval
+func parseSignResponse(body []byte, publicKeys []ssh.PublicKey) ([]*ssh.Certificate, *FunctionApproval, error) {
+	count := len(publicKeys)
+	// Unmarshal and decode
+	result := &FunctionResponse{}
+	err := json.Unmarshal(body, &result)
+	if err != nil {
+		return nil, nil, err
+	}
+	if result.Approval != nil && len(result.Certificates) == 0 {
+		return nil, result.Approval, nil
+	}
+
+	// Version 1 responses only contain a single certificate in the response field
+	var encoded []string
+	if result.Version < 2 {
+		if count > 1 {
+			return nil, nil, errors.New("this version of sshizzle-ca can only sign a single public key")
+		}
+		encoded = append(encoded, result.Response)
+	}
+	for _, certificate := range result.Certificates {
+		encoded = append(encoded, certificate.Certificate)
+	}
+	if len(encoded) != count {
+		return nil, nil, fmt.Errorf("azure function returned %d certificates for %d public keys", len(encoded), count)
+	}
+
+	certificates := make([]*ssh.Certificate, 0, len(encoded))
+	for i, e := range encoded {
 		// Decode the certificate from Base64
-		decoded, err := base64.RawURLEncoding.DecodeString(result.Response)
+		decoded, err := base64.RawURLEncoding.DecodeString(e)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		// Unmarshal the decoded certificate into an ssh.Certificate
 		pubkey, err := ssh.ParsePublicKey(decoded)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-
-		// Return the certificate to the caller!
-		return pubkey.(*ssh.Certificate), nil
+		certificate, ok := pubkey.(*ssh.Certificate)
+		if !ok {
+			return nil, nil, errors.New("azure function response did not contain a certificate")
+		}
+		// The certificate must be for the key we asked to be signed, or the agent would hold a
+		// certificate it can't use
+		if !bytes.Equal(certificate.Key.Marshal(), publicKeys[i].Marshal()) {
+			return nil, nil, fmt.Errorf("azure function returned certificate %d for a different public key", i)
+		}
+		certificates = append(certificates, certificate)
 	}
 
-	if response.StatusCode == 404 {
-		return nil, fmt.Errorf("azure function invocation failed with error 404, try clearing your DNS cache and try again")
+	// Return the certificates to the caller!
+	return certificates, nil, nil
+}
+
+// backoff returns a random wait before the next retry, using exponential backoff with full jitter
+// #nosec
+func backoff(attempt int, min time.Duration, max time.Duration) time.Duration {
+	ceiling := min << uint(attempt)
+	if ceiling > max || ceiling <= 0 {
+		ceiling = max
+	}
+	if ceiling <= min {
+		return min
 	}
+	return min + time.Duration(rand.Int63n(int64(ceiling-min)))
+}
 
-	return nil, fmt.Errorf("azure function invocation failed with %d, %s", response.StatusCode, string(body))
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+	return 0
 }
@@ -0,0 +1,147 @@
+package azure
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newPublicKey returns a new ed25519 SSH public key
+func newPublicKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sshKey
+}
+
+// encodeCertificate signs a certificate for the public key, encoded as in a sign response
+func encodeCertificate(t *testing.T, caSigner ssh.Signer, publicKey ssh.PublicKey) string {
+	t.Helper()
+	certificate := &ssh.Certificate{
+		Key:             publicKey,
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"alice"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := certificate.SignCert(rand.Reader, caSigner); err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(certificate.Marshal())
+}
+
+func TestParseSignResponse(t *testing.T) {
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caSigner, err := ssh.NewSignerFromKey(caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := newPublicKey(t), newPublicKey(t)
+	firstCert, secondCert := encodeCertificate(t, caSigner, first), encodeCertificate(t, caSigner, second)
+
+	tests := []struct {
+		name       string
+		response   FunctionResponse
+		publicKeys []ssh.PublicKey
+		approval   bool
+		err        string
+	}{
+		{
+			name:       "version 2",
+			response:   FunctionResponse{Version: 2, Certificates: []FunctionCertificate{{Certificate: firstCert}, {Certificate: secondCert}}},
+			publicKeys: []ssh.PublicKey{first, second},
+		},
+		{
+			name:       "version 1",
+			response:   FunctionResponse{Response: firstCert},
+			publicKeys: []ssh.PublicKey{first},
+		},
+		{
+			name:       "waiting for approval",
+			response:   FunctionResponse{Version: 2, Approval: &FunctionApproval{ID: "approval"}},
+			publicKeys: []ssh.PublicKey{first},
+			approval:   true,
+		},
+		{
+			name:       "certificates in a different order",
+			response:   FunctionResponse{Version: 2, Certificates: []FunctionCertificate{{Certificate: secondCert}, {Certificate: firstCert}}},
+			publicKeys: []ssh.PublicKey{first, second},
+			err:        "certificate 0 for a different public key",
+		},
+		{
+			name:       "certificate for another key",
+			response:   FunctionResponse{Version: 2, Certificates: []FunctionCertificate{{Certificate: firstCert}, {Certificate: firstCert}}},
+			publicKeys: []ssh.PublicKey{first, second},
+			err:        "certificate 1 for a different public key",
+		},
+		{
+			name:       "version 1 certificate for another key",
+			response:   FunctionResponse{Response: secondCert},
+			publicKeys: []ssh.PublicKey{first},
+			err:        "certificate 0 for a different public key",
+		},
+		{
+			name:       "too few certificates",
+			response:   FunctionResponse{Version: 2, Certificates: []FunctionCertificate{{Certificate: firstCert}}},
+			publicKeys: []ssh.PublicKey{first, second},
+			err:        "returned 1 certificates for 2 public keys",
+		},
+		{
+			name:       "version 1 with several keys",
+			response:   FunctionResponse{Response: firstCert},
+			publicKeys: []ssh.PublicKey{first, second},
+			err:        "can only sign a single public key",
+		},
+		{
+			name:       "not a certificate",
+			response:   FunctionResponse{Version: 2, Certificates: []FunctionCertificate{{Certificate: base64.RawURLEncoding.EncodeToString(first.Marshal())}}},
+			publicKeys: []ssh.PublicKey{first},
+			err:        "did not contain a certificate",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body, err := json.Marshal(test.response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			certificates, approval, err := parseSignResponse(body, test.publicKeys)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if test.approval {
+				if approval == nil || approval.ID != "approval" || certificates != nil {
+					t.Fatalf("expected the approval, got %v %v", certificates, approval)
+				}
+				return
+			}
+			if len(certificates) != len(test.publicKeys) {
+				t.Fatalf("got %d certificates, expected %d", len(certificates), len(test.publicKeys))
+			}
+			for i, certificate := range certificates {
+				if string(certificate.Key.Marshal()) != string(test.publicKeys[i].Marshal()) {
+					t.Errorf("certificate %d is for the wrong key", i)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package azure
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+// EnvironmentVariable selects the Azure cloud for the agent, CA and host
+const EnvironmentVariable = "AZ_ENVIRONMENT"
+
+// ParseEnvironment returns the Azure cloud with the name given, which is one of "public" (the
+// default), "usgovernment" or "china", an SDK name such as "AzureChinaCloud", or the path to a
+// JSON file describing the endpoints of a private cloud
+func ParseEnvironment(name string) (azure.Environment, error) {
+	switch strings.ToLower(name) {
+	case "", "public":
+		return azure.PublicCloud, nil
+	case "usgovernment":
+		return azure.USGovernmentCloud, nil
+	case "china":
+		return azure.ChinaCloud, nil
+	}
+	if strings.HasSuffix(strings.ToLower(name), ".json") {
+		env, err := azure.EnvironmentFromFile(name)
+		if err != nil {
+			return env, fmt.Errorf("error reading Azure environment from %s: %s", name, err.Error())
+		}
+		return env, nil
+	}
+	env, err := azure.EnvironmentFromName(name)
+	if err != nil {
+		return env, fmt.Errorf("invalid Azure environment '%s', must be 'public', 'usgovernment', 'china' or a JSON file", name)
+	}
+	return env, nil
+}
+
+// KeyVaultURL returns the URL of the Key Vault with the name given in the Azure cloud
+func KeyVaultURL(env azure.Environment, keyVaultName string) string {
+	return fmt.Sprintf("https://%s.%s/", keyVaultName, env.KeyVaultDNSSuffix)
+}
+
+// KeyVaultResource returns the resource to request Key Vault access tokens for
+func KeyVaultResource(env azure.Environment) string {
+	if env.ResourceIdentifiers.KeyVault != "" {
+		return env.ResourceIdentifiers.KeyVault
+	}
+	return strings.TrimSuffix(env.KeyVaultEndpoint, "/")
+}
+
+// ManagedHSMURL returns the URL of the managed HSM with the name given in the Azure cloud
+func ManagedHSMURL(env azure.Environment, hsmName string) (string, error) {
+	if env.ManagedHSMDNSSuffix == "" || env.ManagedHSMDNSSuffix == azure.NotAvailable {
+		return "", fmt.Errorf("managed HSMs are not available in %s", env.Name)
+	}
+	return fmt.Sprintf("https://%s.%s/", hsmName, env.ManagedHSMDNSSuffix), nil
+}
+
+// ManagedHSMResource returns the resource to request managed HSM access tokens for
+func ManagedHSMResource(env azure.Environment) string {
+	if env.ResourceIdentifiers.ManagedHSM != "" && env.ResourceIdentifiers.ManagedHSM != azure.NotAvailable {
+		return env.ResourceIdentifiers.ManagedHSM
+	}
+	return strings.TrimSuffix(env.ManagedHSMEndpoint, "/")
+}
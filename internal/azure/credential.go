@@ -0,0 +1,474 @@
+package azure
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+)
+
+// TokenRefresh is how long before an access token expires that it's replaced
+const TokenRefresh = 5 * time.Minute
+
+// IMDSEndpoint is the token endpoint of the Azure Instance Metadata Service on VMs
+const IMDSEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+// Timeouts for token requests. Connecting to IMDS fails fast so machines outside Azure can
+// fall back to other credentials quickly
+const (
+	tokenRequestTimeout = 10 * time.Second
+	imdsConnectTimeout  = 2 * time.Second
+)
+
+// AccessToken is a bearer token for an Azure resource
+type AccessToken struct {
+	Token     string
+	ExpiresOn time.Time
+}
+
+// Credential gets access tokens for Azure resources, such as KeyVaultResource
+type Credential interface {
+	GetToken(ctx context.Context, resource string) (*AccessToken, error)
+}
+
+// NewDefaultCredential returns a credential chain configured by the environment, with tokens
+// cached until shortly before they expire. It tries, in order:
+//   - a service principal with a secret, from AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_CLIENT_SECRET
+//   - a service principal with a certificate, from AZURE_TENANT_ID, AZURE_CLIENT_ID and a PEM file
+//     containing the certificate and private key at AZURE_CLIENT_CERTIFICATE_PATH
+//   - workload identity, exchanging the token in AZURE_FEDERATED_TOKEN_FILE for AZURE_CLIENT_ID
+//   - the managed identity of an App Service or Function, from IDENTITY_ENDPOINT and IDENTITY_HEADER
+//   - the managed identity of a VM, from IMDS
+//
+// Managed identities are user-assigned if AZURE_CLIENT_ID is set, otherwise system-assigned. The
+// tenant defaults to the one the App Service authenticates with, and activeDirectoryEndpoint is
+// used unless AZURE_AUTHORITY_HOST is set
+func NewDefaultCredential(activeDirectoryEndpoint string) (Credential, error) {
+	clientID := os.Getenv("AZURE_CLIENT_ID")
+	authority := activeDirectoryEndpoint
+	if host := os.Getenv("AZURE_AUTHORITY_HOST"); host != "" {
+		authority = host
+	}
+
+	chain := &chainedCredential{}
+	if secret := os.Getenv("AZURE_CLIENT_SECRET"); secret != "" {
+		tenantID, err := tenant()
+		if err != nil {
+			return nil, err
+		}
+		chain.credentials = append(chain.credentials, &clientSecretCredential{
+			tokenEndpoint: tokenEndpoint(authority, tenantID),
+			clientID:      clientID,
+			secret:        secret,
+		})
+	}
+	if certPath := os.Getenv("AZURE_CLIENT_CERTIFICATE_PATH"); certPath != "" {
+		tenantID, err := tenant()
+		if err != nil {
+			return nil, err
+		}
+		cred, err := newClientCertificateCredential(tokenEndpoint(authority, tenantID), clientID, certPath)
+		if err != nil {
+			return nil, err
+		}
+		chain.credentials = append(chain.credentials, cred)
+	}
+	if tokenFile := os.Getenv("AZURE_FEDERATED_TOKEN_FILE"); tokenFile != "" {
+		tenantID, err := tenant()
+		if err != nil {
+			return nil, err
+		}
+		chain.credentials = append(chain.credentials, &workloadIdentityCredential{
+			tokenEndpoint: tokenEndpoint(authority, tenantID),
+			clientID:      clientID,
+			tokenFile:     tokenFile,
+		})
+	}
+	if endpoint, header := os.Getenv("IDENTITY_ENDPOINT"), os.Getenv("IDENTITY_HEADER"); endpoint != "" && header != "" {
+		chain.credentials = append(chain.credentials, &appServiceCredential{endpoint: endpoint, header: header, clientID: clientID})
+	}
+	chain.credentials = append(chain.credentials, newIMDSCredential(clientID))
+
+	return NewCachedCredential(chain), nil
+}
+
+// tenant returns the Azure AD tenant ID from AZURE_TENANT_ID, or the issuer App Service
+// authentication is configured with
+func tenant() (string, error) {
+	if tenantID := os.Getenv("AZURE_TENANT_ID"); tenantID != "" {
+		return tenantID, nil
+	}
+	issuer := os.Getenv("WEBSITE_AUTH_OPENID_ISSUER")
+	if issuer == "" {
+		return "", errors.New("AZURE_TENANT_ID must be set to authenticate with a service principal or workload identity")
+	}
+	return tenantFromIssuer(issuer)
+}
+
+// tenantFromIssuer returns the tenant ID from an Azure AD issuer URL, such as
+// https://sts.windows.net/<tenant>/ or https://login.microsoftonline.com/<tenant>/v2.0
+func tenantFromIssuer(issuer string) (string, error) {
+	u, err := url.Parse(issuer)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse issuer '%s': %s", issuer, err.Error())
+	}
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if segments[0] == "" {
+		return "", fmt.Errorf("issuer '%s' doesn't contain a tenant ID", issuer)
+	}
+	return segments[0], nil
+}
+
+// tokenEndpoint returns the OAuth 2.0 token endpoint of the tenant
+func tokenEndpoint(authority string, tenantID string) string {
+	return fmt.Sprintf("%s/%s/oauth2/v2.0/token", strings.TrimSuffix(authority, "/"), tenantID)
+}
+
+// chainedCredential tries each credential in turn. Once one has succeeded, only it is used
+type chainedCredential struct {
+	credentials []Credential
+
+	mu       sync.Mutex
+	selected Credential
+}
+
+// GetToken returns a token from the first credential which can get one
+func (c *chainedCredential) GetToken(ctx context.Context, resource string) (*AccessToken, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.selected != nil {
+		return c.selected.GetToken(ctx, resource)
+	}
+	var messages []string
+	for _, cred := range c.credentials {
+		token, err := cred.GetToken(ctx, resource)
+		if err == nil {
+			c.selected = cred
+			return token, nil
+		}
+		messages = append(messages, err.Error())
+	}
+	return nil, fmt.Errorf("no credential could get a token: %s", strings.Join(messages, "; "))
+}
+
+// CachedCredential caches the tokens of a credential for each resource, replacing them shortly
+// before they expire
+type CachedCredential struct {
+	credential Credential
+
+	mu     sync.Mutex
+	tokens map[string]*AccessToken
+}
+
+// NewCachedCredential returns a CachedCredential for the credential
+func NewCachedCredential(credential Credential) *CachedCredential {
+	return &CachedCredential{
+		credential: credential,
+		tokens:     map[string]*AccessToken{},
+	}
+}
+
+// GetToken returns the cached token for the resource, getting a new one if it's about to expire
+func (c *CachedCredential) GetToken(ctx context.Context, resource string) (*AccessToken, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if token, ok := c.tokens[resource]; ok && time.Until(token.ExpiresOn) > TokenRefresh {
+		return token, nil
+	}
+	token, err := c.credential.GetToken(ctx, resource)
+	if err != nil {
+		return nil, err
+	}
+	c.tokens[resource] = token
+	return token, nil
+}
+
+// Authorizer adds an access token for a resource from a credential to requests, implementing
+// autorest.Authorizer
+type Authorizer struct {
+	credential Credential
+	resource   string
+}
+
+// NewAuthorizer returns an Authorizer for the resource, use a CachedCredential so the token is
+// reused between requests
+func NewAuthorizer(credential Credential, resource string) *Authorizer {
+	return &Authorizer{credential: credential, resource: resource}
+}
+
+// WithAuthorization adds the access token to requests
+func (a *Authorizer) WithAuthorization() autorest.PrepareDecorator {
+	return func(p autorest.Preparer) autorest.Preparer {
+		return autorest.PreparerFunc(func(r *http.Request) (*http.Request, error) {
+			r, err := p.Prepare(r)
+			if err != nil {
+				return r, err
+			}
+			token, err := a.credential.GetToken(r.Context(), a.resource)
+			if err != nil {
+				return r, err
+			}
+			return autorest.Prepare(r, autorest.WithBearerAuthorization(token.Token))
+		})
+	}
+}
+
+// tokenResponse is a token from Azure AD or a managed identity endpoint. Azure AD gives how
+// long the token is valid for, and managed identity endpoints when it expires
+type tokenResponse struct {
+	AccessToken      string      `json:"access_token"`
+	ExpiresIn        json.Number `json:"expires_in"`
+	ExpiresOn        json.Number `json:"expires_on"`
+	Error            string      `json:"error"`
+	ErrorDescription string      `json:"error_description"`
+}
+
+// requestToken makes a token request, returning the token from the response
+func requestToken(client *http.Client, req *http.Request) (*AccessToken, error) {
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed token request to %s: %s", req.URL.Host, err.Error())
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token response from %s: %s", req.URL.Host, err.Error())
+	}
+
+	var token tokenResponse
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal token response from %s: %s", req.URL.Host, err.Error())
+	}
+	if res.StatusCode != http.StatusOK || token.AccessToken == "" {
+		if token.Error != "" {
+			return nil, fmt.Errorf("token request to %s failed: %s: %s", req.URL.Host, token.Error, token.ErrorDescription)
+		}
+		return nil, fmt.Errorf("token request to %s failed with status %d", req.URL.Host, res.StatusCode)
+	}
+
+	if expiresIn, err := token.ExpiresIn.Int64(); err == nil {
+		return &AccessToken{Token: token.AccessToken, ExpiresOn: time.Now().Add(time.Duration(expiresIn) * time.Second)}, nil
+	}
+	expiresOn, err := strconv.ParseInt(token.ExpiresOn.String(), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("token response from %s has an invalid expiry '%s'", req.URL.Host, token.ExpiresOn)
+	}
+	return &AccessToken{Token: token.AccessToken, ExpiresOn: time.Unix(expiresOn, 0)}, nil
+}
+
+// requestClientCredentials requests a token from Azure AD with the client credentials grant
+func requestClientCredentials(ctx context.Context, endpoint string, resource string, form url.Values) (*AccessToken, error) {
+	form.Set("grant_type", "client_credentials")
+	form.Set("scope", strings.TrimSuffix(resource, "/")+"/.default")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return requestToken(&http.Client{Timeout: tokenRequestTimeout}, req)
+}
+
+// clientSecretCredential authenticates as a service principal with a secret
+type clientSecretCredential struct {
+	tokenEndpoint string
+	clientID      string
+	secret        string
+}
+
+func (c *clientSecretCredential) GetToken(ctx context.Context, resource string) (*AccessToken, error) {
+	return requestClientCredentials(ctx, c.tokenEndpoint, resource, url.Values{
+		"client_id":     {c.clientID},
+		"client_secret": {c.secret},
+	})
+}
+
+// clientCertificateCredential authenticates as a service principal with a certificate, by
+// signing a client assertion with its private key
+type clientCertificateCredential struct {
+	tokenEndpoint string
+	clientID      string
+	cert          *x509.Certificate
+	key           *rsa.PrivateKey
+}
+
+// newClientCertificateCredential reads the certificate and RSA private key from a PEM file
+func newClientCertificateCredential(tokenEndpoint string, clientID string, certPath string) (*clientCertificateCredential, error) {
+	data, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client certificate: %s", err.Error())
+	}
+	c := &clientCertificateCredential{tokenEndpoint: tokenEndpoint, clientID: clientID}
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		switch block.Type {
+		case "CERTIFICATE":
+			if c.cert == nil {
+				if c.cert, err = x509.ParseCertificate(block.Bytes); err != nil {
+					return nil, fmt.Errorf("failed to parse client certificate: %s", err.Error())
+				}
+			}
+		case "RSA PRIVATE KEY":
+			if c.key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+				return nil, fmt.Errorf("failed to parse client certificate key: %s", err.Error())
+			}
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse client certificate key: %s", err.Error())
+			}
+			rsaKey, ok := key.(*rsa.PrivateKey)
+			if !ok {
+				return nil, errors.New("client certificate key must be an RSA key")
+			}
+			c.key = rsaKey
+		}
+	}
+	if c.cert == nil || c.key == nil {
+		return nil, fmt.Errorf("%s must contain a PEM certificate and RSA private key", certPath)
+	}
+	return c, nil
+}
+
+func (c *clientCertificateCredential) GetToken(ctx context.Context, resource string) (*AccessToken, error) {
+	assertion, err := c.assertion()
+	if err != nil {
+		return nil, err
+	}
+	return requestClientCredentials(ctx, c.tokenEndpoint, resource, url.Values{
+		"client_id":             {c.clientID},
+		"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+		"client_assertion":      {assertion},
+	})
+}
+
+// assertion returns a short lived JWT identifying the service principal, signed with the key
+func (c *clientCertificateCredential) assertion() (string, error) {
+	thumbprint := sha1.Sum(c.cert.Raw)
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"x5t": base64.RawURLEncoding.EncodeToString(thumbprint[:]),
+	})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"aud": c.tokenEndpoint,
+		"iss": c.clientID,
+		"sub": c.clientID,
+		"jti": hex.EncodeToString(jti),
+		"nbf": now.Unix(),
+		"exp": now.Add(10 * time.Minute).Unix(),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, c.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign client assertion: %s", err.Error())
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// workloadIdentityCredential exchanges a federated token, such as a Kubernetes service account
+// token, for an Azure AD token
+type workloadIdentityCredential struct {
+	tokenEndpoint string
+	clientID      string
+	tokenFile     string
+}
+
+func (c *workloadIdentityCredential) GetToken(ctx context.Context, resource string) (*AccessToken, error) {
+	// The file is read each time as the token in it is rotated
+	assertion, err := ioutil.ReadFile(c.tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read federated token: %s", err.Error())
+	}
+	return requestClientCredentials(ctx, c.tokenEndpoint, resource, url.Values{
+		"client_id":             {c.clientID},
+		"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+		"client_assertion":      {strings.TrimSpace(string(assertion))},
+	})
+}
+
+// appServiceCredential gets tokens for the managed identity of an App Service or Function
+// https://docs.microsoft.com/en-us/azure/app-service/overview-managed-identity#rest-endpoint-reference
+type appServiceCredential struct {
+	endpoint string
+	header   string
+	clientID string
+}
+
+func (c *appServiceCredential) GetToken(ctx context.Context, resource string) (*AccessToken, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid IDENTITY_ENDPOINT: %s", err.Error())
+	}
+	q := req.URL.Query()
+	q.Set("resource", resource)
+	q.Set("api-version", "2019-08-01")
+	if c.clientID != "" {
+		q.Set("client_id", c.clientID)
+	}
+	req.URL.RawQuery = q.Encode()
+	// The header protects against server side request forgery
+	req.Header.Set("X-IDENTITY-HEADER", c.header)
+	return requestToken(&http.Client{Timeout: tokenRequestTimeout}, req)
+}
+
+// imdsCredential gets tokens for the managed identity of a VM
+type imdsCredential struct {
+	endpoint string
+	clientID string
+	client   *http.Client
+}
+
+func newIMDSCredential(clientID string) *imdsCredential {
+	return &imdsCredential{
+		endpoint: IMDSEndpoint,
+		clientID: clientID,
+		client: &http.Client{
+			Timeout: tokenRequestTimeout,
+			Transport: &http.Transport{
+				Proxy:       nil,
+				DialContext: (&net.Dialer{Timeout: imdsConnectTimeout}).DialContext,
+			},
+		},
+	}
+}
+
+func (c *imdsCredential) GetToken(ctx context.Context, resource string) (*AccessToken, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	q := req.URL.Query()
+	q.Set("resource", resource)
+	q.Set("api-version", "2018-02-01")
+	if c.clientID != "" {
+		q.Set("client_id", c.clientID)
+	}
+	req.URL.RawQuery = q.Encode()
+	req.Header.Set("Metadata", "true")
+	return requestToken(c.client, req)
+}
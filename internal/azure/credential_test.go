@@ -0,0 +1,613 @@
+package azure
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// vaultResource is the resource tokens are requested for
+const vaultResource = "https://vault.azure.net"
+
+// tokenRequest is a request made to a fakeTokenServer
+type tokenRequest struct {
+	method string
+	path   string
+	form   url.Values
+	header http.Header
+}
+
+// fakeTokenServer serves token requests like Azure AD and the managed identity endpoints
+type fakeTokenServer struct {
+	t        *testing.T
+	url      string
+	status   int
+	response map[string]interface{}
+	requests []tokenRequest
+}
+
+// newFakeTokenServer returns a server responding to every request with a token for an hour
+func newFakeTokenServer(t *testing.T) *fakeTokenServer {
+	t.Helper()
+	s := &fakeTokenServer{
+		t:        t,
+		status:   http.StatusOK,
+		response: map[string]interface{}{"access_token": "token", "expires_in": "3600"},
+	}
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	s.url = server.URL
+	return s
+}
+
+func (s *fakeTokenServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		s.t.Errorf("failed to parse token request: %s", err)
+	}
+	s.requests = append(s.requests, tokenRequest{method: r.Method, path: r.URL.Path, form: r.Form, header: r.Header})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(s.status)
+	_ = json.NewEncoder(w).Encode(s.response)
+}
+
+// lastRequest returns the last request the server received
+func (s *fakeTokenServer) lastRequest() tokenRequest {
+	s.t.Helper()
+	if len(s.requests) == 0 {
+		s.t.Fatal("no token request was made")
+	}
+	return s.requests[len(s.requests)-1]
+}
+
+// checkForm checks the request has each of the form or query values
+func checkForm(t *testing.T, req tokenRequest, expected map[string]string) {
+	t.Helper()
+	for key, value := range expected {
+		if got := req.form.Get(key); got != value {
+			t.Errorf("got %s %q, expected %q", key, got, value)
+		}
+	}
+}
+
+// checkToken checks a token was returned, expiring at about the expected time
+func checkToken(t *testing.T, token *AccessToken, err error, expiresOn time.Time) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if token.Token != "token" {
+		t.Errorf("got token %q", token.Token)
+	}
+	if d := token.ExpiresOn.Sub(expiresOn); d < -time.Minute || d > time.Minute {
+		t.Errorf("token expires at %s, expected %s", token.ExpiresOn, expiresOn)
+	}
+}
+
+// setenv sets environment variables for the rest of the test, restoring them afterwards
+func setenv(t *testing.T, env map[string]string) {
+	t.Helper()
+	for key, value := range env {
+		original, ok := os.LookupEnv(key)
+		if err := os.Setenv(key, value); err != nil {
+			t.Fatal(err)
+		}
+		key := key
+		t.Cleanup(func() {
+			if ok {
+				_ = os.Setenv(key, original)
+			} else {
+				_ = os.Unsetenv(key)
+			}
+		})
+	}
+}
+
+// clearCredentialEnv unsets the environment variables NewDefaultCredential reads
+func clearCredentialEnv(t *testing.T) {
+	t.Helper()
+	env := make(map[string]string)
+	for _, key := range []string{
+		"AZURE_TENANT_ID", "AZURE_CLIENT_ID", "AZURE_CLIENT_SECRET", "AZURE_CLIENT_CERTIFICATE_PATH",
+		"AZURE_FEDERATED_TOKEN_FILE", "AZURE_AUTHORITY_HOST", "IDENTITY_ENDPOINT", "IDENTITY_HEADER",
+		"WEBSITE_AUTH_OPENID_ISSUER",
+	} {
+		env[key] = ""
+	}
+	setenv(t, env)
+}
+
+func TestTenantFromIssuer(t *testing.T) {
+	tests := []struct {
+		name     string
+		issuer   string
+		expected string
+		err      string
+	}{
+		{name: "v1 issuer", issuer: "https://sts.windows.net/00000000-0000-0000-0000-000000000001/", expected: "00000000-0000-0000-0000-000000000001"},
+		{name: "v2 issuer", issuer: "https://login.microsoftonline.com/00000000-0000-0000-0000-000000000001/v2.0", expected: "00000000-0000-0000-0000-000000000001"},
+		{name: "without a trailing slash", issuer: "https://sts.windows.net/tenant", expected: "tenant"},
+		{name: "no tenant", issuer: "https://sts.windows.net/", err: "doesn't contain a tenant ID"},
+		{name: "no path", issuer: "https://sts.windows.net", err: "doesn't contain a tenant ID"},
+		{name: "invalid", issuer: "https://sts.windows.net/%zz", err: "failed to parse issuer"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tenantID, err := tenantFromIssuer(test.issuer)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if tenantID != test.expected {
+				t.Errorf("got %q, expected %q", tenantID, test.expected)
+			}
+		})
+	}
+}
+
+func TestTenant(t *testing.T) {
+	clearCredentialEnv(t)
+	if _, err := tenant(); err == nil || !strings.Contains(err.Error(), "AZURE_TENANT_ID must be set") {
+		t.Fatalf("expected an error without a tenant, got %v", err)
+	}
+	setenv(t, map[string]string{"WEBSITE_AUTH_OPENID_ISSUER": "https://sts.windows.net/issuer-tenant/"})
+	if tenantID, err := tenant(); err != nil || tenantID != "issuer-tenant" {
+		t.Fatalf("got %q %v, expected the tenant from the issuer", tenantID, err)
+	}
+	setenv(t, map[string]string{"AZURE_TENANT_ID": "env-tenant"})
+	if tenantID, err := tenant(); err != nil || tenantID != "env-tenant" {
+		t.Fatalf("got %q %v, expected AZURE_TENANT_ID", tenantID, err)
+	}
+}
+
+func TestRequestToken(t *testing.T) {
+	expiresOn := time.Now().Add(time.Hour).Truncate(time.Second)
+	tests := []struct {
+		name     string
+		status   int
+		response map[string]interface{}
+		err      string
+	}{
+		{name: "expires_in", response: map[string]interface{}{"access_token": "token", "expires_in": 3600}},
+		{name: "expires_in as a string", response: map[string]interface{}{"access_token": "token", "expires_in": "3600"}},
+		{name: "expires_on", response: map[string]interface{}{"access_token": "token", "expires_on": strconv.FormatInt(expiresOn.Unix(), 10)}},
+		{
+			name:     "error",
+			status:   http.StatusBadRequest,
+			response: map[string]interface{}{"error": "invalid_client", "error_description": "bad secret"},
+			err:      "failed: invalid_client: bad secret",
+		},
+		{name: "error status", status: http.StatusInternalServerError, response: map[string]interface{}{}, err: "failed with status 500"},
+		{name: "no token", response: map[string]interface{}{"expires_in": 3600}, err: "failed with status 200"},
+		{name: "fractional expiry", response: map[string]interface{}{"access_token": "token", "expires_on": "1.5e9"}, err: "invalid expiry"},
+		{name: "no expiry", response: map[string]interface{}{"access_token": "token"}, err: "invalid expiry"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newFakeTokenServer(t)
+			if test.status != 0 {
+				server.status = test.status
+			}
+			server.response = test.response
+			req, err := http.NewRequest(http.MethodGet, server.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			token, err := requestToken(http.DefaultClient, req)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			checkToken(t, token, err, expiresOn)
+		})
+	}
+}
+
+func TestClientSecretCredential(t *testing.T) {
+	server := newFakeTokenServer(t)
+	cred := &clientSecretCredential{tokenEndpoint: tokenEndpoint(server.url+"/", "tenant"), clientID: "client", secret: "secret"}
+	token, err := cred.GetToken(context.Background(), vaultResource)
+	checkToken(t, token, err, time.Now().Add(time.Hour))
+
+	req := server.lastRequest()
+	if req.method != http.MethodPost || req.path != "/tenant/oauth2/v2.0/token" {
+		t.Errorf("got %s %s, expected POST to the tenant's token endpoint", req.method, req.path)
+	}
+	checkForm(t, req, map[string]string{
+		"grant_type":    "client_credentials",
+		"scope":         strings.TrimSuffix(vaultResource, "/") + "/.default",
+		"client_id":     "client",
+		"client_secret": "secret",
+	})
+}
+
+// writeClientCertificate writes a self-signed certificate and its RSA key to a PEM file, with
+// the key in PKCS #1 or PKCS #8 form
+func writeClientCertificate(t *testing.T, pkcs8 bool) (string, *x509.Certificate) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sshizzle"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyBlock := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	if pkcs8 {
+		keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyBlock = &pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}
+	}
+	data := append(pem.EncodeToMemory(keyBlock), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	path := filepath.Join(t.TempDir(), "client.pem")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, cert
+}
+
+func TestClientCertificateCredential(t *testing.T) {
+	for _, pkcs8 := range []bool{false, true} {
+		t.Run("PKCS #8 "+strconv.FormatBool(pkcs8), func(t *testing.T) {
+			server := newFakeTokenServer(t)
+			certPath, cert := writeClientCertificate(t, pkcs8)
+			endpoint := tokenEndpoint(server.url, "tenant")
+			cred, err := newClientCertificateCredential(endpoint, "client", certPath)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			token, err := cred.GetToken(context.Background(), vaultResource)
+			checkToken(t, token, err, time.Now().Add(time.Hour))
+
+			req := server.lastRequest()
+			checkForm(t, req, map[string]string{
+				"grant_type":            "client_credentials",
+				"client_id":             "client",
+				"client_assertion_type": "urn:ietf:params:oauth:client-assertion-type:jwt-bearer",
+			})
+
+			// The assertion is signed by the certificate's key, and identifies the certificate
+			parts := strings.Split(req.form.Get("client_assertion"), ".")
+			if len(parts) != 3 {
+				t.Fatalf("client assertion isn't a JWT: %q", req.form.Get("client_assertion"))
+			}
+			signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+			if err != nil {
+				t.Fatal(err)
+			}
+			digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+			if err := rsa.VerifyPKCS1v15(cert.PublicKey.(*rsa.PublicKey), crypto.SHA256, digest[:], signature); err != nil {
+				t.Errorf("client assertion isn't signed by the certificate's key: %s", err)
+			}
+			var header map[string]string
+			var claims map[string]interface{}
+			decodeSegment(t, parts[0], &header)
+			decodeSegment(t, parts[1], &claims)
+			thumbprint := sha1.Sum(cert.Raw)
+			if header["alg"] != "RS256" || header["x5t"] != base64.RawURLEncoding.EncodeToString(thumbprint[:]) {
+				t.Errorf("unexpected assertion header %v", header)
+			}
+			if claims["aud"] != endpoint || claims["iss"] != "client" || claims["sub"] != "client" {
+				t.Errorf("unexpected assertion claims %v", claims)
+			}
+		})
+	}
+}
+
+// decodeSegment decodes a JWT header or claims
+func decodeSegment(t *testing.T, segment string, v interface{}) {
+	t.Helper()
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewClientCertificateCredentialInvalid(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecDER, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath, _ := writeClientCertificate(t, false)
+	valid, err := os.ReadFile(certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certOnly := valid[strings.Index(string(valid), "-----BEGIN CERTIFICATE"):]
+
+	tests := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{name: "no key", data: certOnly, err: "must contain a PEM certificate and RSA private key"},
+		{name: "EC key", data: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: ecDER}), err: "must be an RSA key"},
+		{name: "invalid certificate", data: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("invalid")}), err: "failed to parse client certificate"},
+		{name: "empty", data: nil, err: "must contain a PEM certificate and RSA private key"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "client.pem")
+			if err := os.WriteFile(path, test.data, 0600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := newClientCertificateCredential("https://login.microsoftonline.com/tenant/oauth2/v2.0/token", "client", path)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+
+	if _, err := newClientCertificateCredential("", "client", filepath.Join(t.TempDir(), "missing.pem")); err == nil || !strings.Contains(err.Error(), "failed to read client certificate") {
+		t.Fatalf("expected an error for a missing file, got %v", err)
+	}
+}
+
+func TestWorkloadIdentityCredential(t *testing.T) {
+	server := newFakeTokenServer(t)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	cred := &workloadIdentityCredential{tokenEndpoint: tokenEndpoint(server.url, "tenant"), clientID: "client", tokenFile: tokenFile}
+
+	if _, err := cred.GetToken(context.Background(), vaultResource); err == nil || !strings.Contains(err.Error(), "failed to read federated token") {
+		t.Fatalf("expected an error without a token file, got %v", err)
+	}
+
+	// The token file is read for each request, as it's rotated
+	for _, federated := range []string{"first", "second"} {
+		if err := os.WriteFile(tokenFile, []byte(federated+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		token, err := cred.GetToken(context.Background(), vaultResource)
+		checkToken(t, token, err, time.Now().Add(time.Hour))
+		checkForm(t, server.lastRequest(), map[string]string{
+			"grant_type":            "client_credentials",
+			"client_id":             "client",
+			"client_assertion_type": "urn:ietf:params:oauth:client-assertion-type:jwt-bearer",
+			"client_assertion":      federated,
+		})
+	}
+}
+
+func TestAppServiceCredential(t *testing.T) {
+	expiresOn := time.Now().Add(time.Hour).Truncate(time.Second)
+	tests := []struct {
+		name     string
+		clientID string
+	}{
+		{name: "system-assigned"},
+		{name: "user-assigned", clientID: "client"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newFakeTokenServer(t)
+			server.response = map[string]interface{}{"access_token": "token", "expires_on": strconv.FormatInt(expiresOn.Unix(), 10)}
+			cred := &appServiceCredential{endpoint: server.url + "/msi/token", header: "secret-header", clientID: test.clientID}
+			token, err := cred.GetToken(context.Background(), vaultResource)
+			checkToken(t, token, err, expiresOn)
+
+			req := server.lastRequest()
+			if req.method != http.MethodGet || req.path != "/msi/token" {
+				t.Errorf("got %s %s, expected GET to IDENTITY_ENDPOINT", req.method, req.path)
+			}
+			if req.header.Get("X-IDENTITY-HEADER") != "secret-header" {
+				t.Errorf("got X-IDENTITY-HEADER %q", req.header.Get("X-IDENTITY-HEADER"))
+			}
+			checkForm(t, req, map[string]string{"resource": vaultResource, "api-version": "2019-08-01", "client_id": test.clientID})
+		})
+	}
+}
+
+func TestIMDSCredential(t *testing.T) {
+	expiresOn := time.Now().Add(time.Hour).Truncate(time.Second)
+	server := newFakeTokenServer(t)
+	server.response = map[string]interface{}{"access_token": "token", "expires_on": strconv.FormatInt(expiresOn.Unix(), 10)}
+	cred := newIMDSCredential("client")
+	if cred.endpoint != IMDSEndpoint {
+		t.Fatalf("got endpoint %s, expected %s", cred.endpoint, IMDSEndpoint)
+	}
+	cred.endpoint = server.url + "/metadata/identity/oauth2/token"
+	token, err := cred.GetToken(context.Background(), vaultResource)
+	checkToken(t, token, err, expiresOn)
+
+	req := server.lastRequest()
+	if req.header.Get("Metadata") != "true" {
+		t.Error("IMDS request is missing the Metadata header")
+	}
+	checkForm(t, req, map[string]string{"resource": vaultResource, "api-version": "2018-02-01", "client_id": "client"})
+
+	// Outside Azure, IMDS can't be reached
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+	cred.endpoint = unreachable.URL
+	if _, err := cred.GetToken(context.Background(), vaultResource); err == nil || !strings.Contains(err.Error(), "failed token request") {
+		t.Fatalf("expected a failed request, got %v", err)
+	}
+}
+
+// fakeCredential returns tokens expiring after a time, counting the requests for them
+type fakeCredential struct {
+	expiresIn time.Duration
+	err       error
+	requests  int
+}
+
+func (c *fakeCredential) GetToken(ctx context.Context, resource string) (*AccessToken, error) {
+	c.requests++
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &AccessToken{Token: resource + strconv.Itoa(c.requests), ExpiresOn: time.Now().Add(c.expiresIn)}, nil
+}
+
+func TestChainedCredential(t *testing.T) {
+	failing := &fakeCredential{err: errors.New("not configured")}
+	working := &fakeCredential{expiresIn: time.Hour}
+	unused := &fakeCredential{expiresIn: time.Hour}
+	chain := &chainedCredential{credentials: []Credential{failing, working, unused}}
+
+	for i := 0; i < 2; i++ {
+		if _, err := chain.GetToken(context.Background(), vaultResource); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	// Once a credential works only it is used
+	if failing.requests != 1 || working.requests != 2 || unused.requests != 0 {
+		t.Errorf("got %d, %d and %d requests, expected 1, 2 and 0", failing.requests, working.requests, unused.requests)
+	}
+
+	chain = &chainedCredential{credentials: []Credential{failing, &fakeCredential{err: errors.New("no identity")}}}
+	_, err := chain.GetToken(context.Background(), vaultResource)
+	if err == nil || !strings.Contains(err.Error(), "not configured; no identity") {
+		t.Fatalf("expected the errors of every credential, got %v", err)
+	}
+}
+
+func TestCachedCredential(t *testing.T) {
+	tests := []struct {
+		name      string
+		expiresIn time.Duration
+		requests  int
+	}{
+		{name: "reused until it's about to expire", expiresIn: time.Hour, requests: 1},
+		{name: "refreshed when it's about to expire", expiresIn: TokenRefresh - time.Second, requests: 2},
+		{name: "refreshed when it's expired", expiresIn: -time.Minute, requests: 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := &fakeCredential{expiresIn: test.expiresIn}
+			cred := NewCachedCredential(fake)
+			first, err := cred.GetToken(context.Background(), vaultResource)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			second, err := cred.GetToken(context.Background(), vaultResource)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if fake.requests != test.requests {
+				t.Fatalf("got %d requests, expected %d", fake.requests, test.requests)
+			}
+			if (first.Token == second.Token) != (test.requests == 1) {
+				t.Errorf("got tokens %s and %s", first.Token, second.Token)
+			}
+		})
+	}
+
+	// Tokens are cached for each resource
+	fake := &fakeCredential{expiresIn: time.Hour}
+	cred := NewCachedCredential(fake)
+	for _, resource := range []string{vaultResource, "https://storage.azure.com/", vaultResource} {
+		if _, err := cred.GetToken(context.Background(), resource); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if fake.requests != 2 {
+		t.Errorf("got %d requests, expected one for each resource", fake.requests)
+	}
+
+	// Errors aren't cached
+	fake = &fakeCredential{err: errors.New("unavailable")}
+	cred = NewCachedCredential(fake)
+	for i := 0; i < 2; i++ {
+		if _, err := cred.GetToken(context.Background(), vaultResource); err == nil {
+			t.Fatal("expected an error")
+		}
+	}
+	if fake.requests != 2 {
+		t.Errorf("got %d requests, expected 2", fake.requests)
+	}
+}
+
+func TestNewDefaultCredential(t *testing.T) {
+	t.Run("client secret", func(t *testing.T) {
+		clearCredentialEnv(t)
+		server := newFakeTokenServer(t)
+		setenv(t, map[string]string{
+			"AZURE_TENANT_ID":      "tenant",
+			"AZURE_CLIENT_ID":      "client",
+			"AZURE_CLIENT_SECRET":  "secret",
+			"AZURE_AUTHORITY_HOST": server.url,
+		})
+		cred, err := NewDefaultCredential("https://login.microsoftonline.com/")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		token, err := cred.GetToken(context.Background(), vaultResource)
+		checkToken(t, token, err, time.Now().Add(time.Hour))
+		req := server.lastRequest()
+		if req.path != "/tenant/oauth2/v2.0/token" {
+			t.Errorf("got request to %s, expected the tenant's token endpoint on AZURE_AUTHORITY_HOST", req.path)
+		}
+		checkForm(t, req, map[string]string{"client_id": "client", "client_secret": "secret"})
+	})
+
+	t.Run("App Service managed identity", func(t *testing.T) {
+		clearCredentialEnv(t)
+		server := newFakeTokenServer(t)
+		setenv(t, map[string]string{"IDENTITY_ENDPOINT": server.url, "IDENTITY_HEADER": "secret-header"})
+		cred, err := NewDefaultCredential("https://login.microsoftonline.com/")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		token, err := cred.GetToken(context.Background(), vaultResource)
+		checkToken(t, token, err, time.Now().Add(time.Hour))
+		if server.lastRequest().header.Get("X-IDENTITY-HEADER") != "secret-header" {
+			t.Error("token wasn't requested from IDENTITY_ENDPOINT")
+		}
+	})
+
+	t.Run("no tenant", func(t *testing.T) {
+		clearCredentialEnv(t)
+		setenv(t, map[string]string{"AZURE_CLIENT_ID": "client", "AZURE_FEDERATED_TOKEN_FILE": "/var/run/secrets/token"})
+		if _, err := NewDefaultCredential("https://login.microsoftonline.com/"); err == nil || !strings.Contains(err.Error(), "AZURE_TENANT_ID must be set") {
+			t.Fatalf("expected an error without a tenant, got %v", err)
+		}
+	})
+}
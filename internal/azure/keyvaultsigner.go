@@ -7,58 +7,216 @@ import (
 	"crypto/rsa"
 	"encoding/base64"
 	"encoding/binary"
-	"fmt"
 	"io"
 	"math/big"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/services/keyvault/v7.0/keyvault"
+	"github.com/Azure/go-autorest/autorest"
 	"github.com/pkg/errors"
 )
 
 // Timeout for all calls to Azure Key Vault
 const KeyVaultRequestTimeout = 20 * time.Second
 
+// PublicKeyTTL is how long the public key is cached before it's fetched from Key Vault again
+const PublicKeyTTL = time.Hour
+
+// ManagedHSMAPIVersion is the Key Vault API version used for managed HSMs, which don't support
+// the older version used by the SDK
+const ManagedHSMAPIVersion = "7.2"
+
 // KeyVaultSigner an Azure Key Vault signer
 type KeyVaultSigner struct {
 	crypto.Signer
 	client *keyvault.BaseClient
 	url    string
 	key    string
+	// version of the key to use, or "" for the latest
+	version string
+
+	// The public key is cached so it's only fetched occasionally, and signatures can be
+	// verified against it. keyVersion is the version it belongs to, which is used to sign
+	mu         sync.Mutex
+	publicKey  *rsa.PublicKey
+	keyVersion string
+	fetchedAt  time.Time
+}
+
+// NewKeyVaultClient returns a client for a Key Vault, or a managed HSM if managedHSM is set,
+// using the authorizer given
+func NewKeyVaultClient(authorizer autorest.Authorizer, managedHSM bool) *keyvault.BaseClient {
+	client := keyvault.New()
+	client.Authorizer = authorizer
+	if managedHSM {
+		// The requests and responses for the operations we use are the same in both versions
+		client.RequestInspector = withAPIVersion(ManagedHSMAPIVersion)
+	}
+	return &client
 }
 
-// NewKeyVaultSigner returns a new instance of a KeyVaultSigner
-func NewKeyVaultSigner(client *keyvault.BaseClient, keyVaultName string, key string) *KeyVaultSigner {
-	// Construct the URL to the keyvault from the name
-	keyvaultURL := fmt.Sprintf("https://%s.vault.azure.net/", keyVaultName)
+// NewKeyVaultSigner returns a new instance of a KeyVaultSigner for a key in the Key Vault or
+// managed HSM at keyvaultURL, see KeyVaultURL and ManagedHSMURL. The key version is pinned if
+// given, otherwise the latest version is used. It should be reused, so the public key is cached
+func NewKeyVaultSigner(client *keyvault.BaseClient, keyvaultURL string, key string, version string) *KeyVaultSigner {
 	// Return a new KeyVaultSigner
 	return &KeyVaultSigner{
-		client: client,
-		url:    keyvaultURL,
-		key:    key,
+		client:  client,
+		url:     keyvaultURL,
+		key:     key,
+		version: version,
 	}
 }
 
-// Public returns the PublicKey from an Azure Key Vault Key
+// Public returns the PublicKey from an Azure Key Vault Key, or nil if it can't be fetched
 func (s *KeyVaultSigner) Public() crypto.PublicKey {
+	publicKey, err := s.PublicKey(context.Background())
+	if err != nil {
+		return nil
+	}
+	return publicKey
+}
+
+// PublicKey returns the cached public key, fetching it from Azure Key Vault if it's older
+// than PublicKeyTTL
+func (s *KeyVaultSigner) PublicKey(ctx context.Context) (*rsa.PublicKey, error) {
+	publicKey, _, err := s.cachedKey(ctx)
+	return publicKey, err
+}
+
+// KeyVersion returns the version of the cached public key, which signatures are made with. It's
+// empty until the public key has been fetched
+func (s *KeyVaultSigner) KeyVersion() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keyVersion
+}
+
+// cachedKey returns the cached public key and its version, fetching them from Azure Key Vault
+// if they're older than PublicKeyTTL
+func (s *KeyVaultSigner) cachedKey(ctx context.Context) (*rsa.PublicKey, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.publicKey != nil && time.Since(s.fetchedAt) < PublicKeyTTL {
+		return s.publicKey, s.keyVersion, nil
+	}
+	publicKey, keyVersion, err := s.fetchPublicKey(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	s.publicKey = publicKey
+	s.keyVersion = keyVersion
+	s.fetchedAt = time.Now()
+	return publicKey, keyVersion, nil
+}
+
+// fetchPublicKey gets the public key and its version from Azure Key Vault
+func (s *KeyVaultSigner) fetchPublicKey(ctx context.Context) (*rsa.PublicKey, string, error) {
 	// Get the key from Azure Key Vault
-	ctx, cancel := context.WithTimeout(context.Background(), KeyVaultRequestTimeout)
-	keyBundle, err := s.client.GetKey(ctx, s.url, s.key, "")
+	ctx, cancel := context.WithTimeout(ctx, KeyVaultRequestTimeout)
+	keyBundle, err := s.client.GetKey(ctx, s.url, s.key, s.version)
 	cancel()
 	if err != nil {
-		return nil
+		return nil, "", errors.Wrap(err, "failed to get public key from Azure Key Vault")
+	}
+	// The key ID is the URL of this version of the key, ending with the version
+	publicKey, err := rsaPublicKey(keyBundle.Key)
+	if err != nil {
+		return nil, "", err
+	}
+	return publicKey, path.Base(*keyBundle.Key.Kid), nil
+}
+
+// PublicKeys returns the public keys of the enabled, unexpired versions of the key, newest first,
+// for hosts to trust while the key is rotated. Only the pinned version is returned if there is
+// one. They're always fetched from Azure Key Vault, rather than cached
+func (s *KeyVaultSigner) PublicKeys(ctx context.Context) ([]*rsa.PublicKey, error) {
+	if s.version != "" {
+		publicKey, _, err := s.fetchPublicKey(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return []*rsa.PublicKey{publicKey}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, KeyVaultRequestTimeout)
+	defer cancel()
+	page, err := s.client.GetKeyVersions(ctx, s.url, s.key, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list key versions in Azure Key Vault")
+	}
+	type keyVersion struct {
+		version string
+		created time.Time
+	}
+	var versions []keyVersion
+	now := time.Now()
+	for page.NotDone() {
+		for _, item := range page.Values() {
+			attributes := item.Attributes
+			if item.Kid == nil || attributes == nil {
+				continue
+			}
+			// Versions that aren't valid yet are included, so they're trusted before they're used
+			if (attributes.Enabled != nil && !*attributes.Enabled) || (attributes.Expires != nil && time.Time(*attributes.Expires).Before(now)) {
+				continue
+			}
+			version := keyVersion{version: path.Base(*item.Kid)}
+			if attributes.Created != nil {
+				version.created = time.Time(*attributes.Created)
+			}
+			versions = append(versions, version)
+		}
+		if err := page.NextWithContext(ctx); err != nil {
+			return nil, errors.Wrap(err, "failed to list key versions in Azure Key Vault")
+		}
+	}
+	if len(versions) == 0 {
+		return nil, errors.New("key in Azure Key Vault has no enabled versions")
+	}
+	// A stable order, so the keys only change when the versions do
+	sort.Slice(versions, func(i, j int) bool {
+		if !versions[i].created.Equal(versions[j].created) {
+			return versions[i].created.After(versions[j].created)
+		}
+		return versions[i].version < versions[j].version
+	})
+
+	publicKeys := make([]*rsa.PublicKey, 0, len(versions))
+	for _, version := range versions {
+		keyBundle, err := s.client.GetKey(ctx, s.url, s.key, version.version)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get version %s of the public key from Azure Key Vault", version.version)
+		}
+		publicKey, err := rsaPublicKey(keyBundle.Key)
+		if err != nil {
+			return nil, err
+		}
+		publicKeys = append(publicKeys, publicKey)
+	}
+	return publicKeys, nil
+}
+
+// rsaPublicKey decodes an RSA public key from Azure Key Vault
+func rsaPublicKey(key *keyvault.JSONWebKey) (*rsa.PublicKey, error) {
+	if key == nil || key.N == nil || key.E == nil || key.Kid == nil {
+		return nil, errors.New("key in Azure Key Vault is not an RSA key")
 	}
 
 	// Retreive the key modulus and decode from Base64
-	keyModulus, err := base64.RawURLEncoding.DecodeString(*keyBundle.Key.N)
+	keyModulus, err := base64.RawURLEncoding.DecodeString(*key.N)
 	if err != nil {
-		return nil
+		return nil, errors.Wrap(err, "failed to decode public key modulus")
 	}
 
 	// Retrieve the key exponent and decode from Bae64
-	keyExponent, err := base64.RawURLEncoding.DecodeString(*keyBundle.Key.E)
+	keyExponent, err := base64.RawURLEncoding.DecodeString(*key.E)
 	if err != nil {
-		return nil
+		return nil, errors.Wrap(err, "failed to decode public key exponent")
 	}
 
 	// Create the modulus big number
@@ -79,15 +237,52 @@ func (s *KeyVaultSigner) Public() crypto.PublicKey {
 	var e uint64
 	err = binary.Read(eReader, binary.BigEndian, &e)
 	if err != nil {
-		return nil
+		return nil, errors.Wrap(err, "failed to read public key exponent")
 	}
 
 	// Create a new PublicKey using our computed values
-	return &rsa.PublicKey{N: n, E: int(e)}
+	return &rsa.PublicKey{N: n, E: int(e)}, nil
+}
+
+// CurrentKey returns a signer using only the version of the key that's currently cached, and
+// that version, so the version recorded with a signature is always the one that made it
+func (s *KeyVaultSigner) CurrentKey(ctx context.Context) (crypto.Signer, string, error) {
+	publicKey, keyVersion, err := s.cachedKey(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	return &keyVersionSigner{signer: s, publicKey: publicKey, keyVersion: keyVersion}, keyVersion, nil
+}
+
+// keyVersionSigner signs with one version of the key in Azure Key Vault
+type keyVersionSigner struct {
+	signer     *KeyVaultSigner
+	publicKey  *rsa.PublicKey
+	keyVersion string
+}
+
+// Public returns the public key of the version
+func (k *keyVersionSigner) Public() crypto.PublicKey {
+	return k.publicKey
+}
+
+// Sign a digest with the version of the key
+func (k *keyVersionSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return k.signer.sign(k.publicKey, k.keyVersion, digest, opts)
 }
 
 // Sign a digest with the private key in Azure Key Vault
 func (s *KeyVaultSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	// Sign with the version of the key we're handing out the public key of
+	publicKey, keyVersion, err := s.cachedKey(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return s.sign(publicKey, keyVersion, digest, opts)
+}
+
+// sign signs a digest with a version of the key, checking the signature with its public key
+func (s *KeyVaultSigner) sign(publicKey *rsa.PublicKey, keyVersion string, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
 	// Encode the digest into URL-encoded base64
 	encodedDigest := base64.RawURLEncoding.EncodeToString(digest)
 
@@ -97,7 +292,7 @@ func (s *KeyVaultSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerO
 		ctx,
 		s.url,
 		s.key,
-		"",
+		keyVersion,
 		keyvault.KeySignParameters{
 			Algorithm: keyvault.RS256,
 			Value:     &encodedDigest,
@@ -114,6 +309,32 @@ func (s *KeyVaultSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerO
 		return nil, errors.New("failed to decode signature result from Azure Function")
 	}
 
+	// Check the signature matches the public key we're handing out, in case the response was
+	// corrupted or the key has been replaced
+	if err := rsa.VerifyPKCS1v15(publicKey, opts.HashFunc(), digest, signature); err != nil {
+		// Fetch the key again next time
+		s.mu.Lock()
+		s.publicKey = nil
+		s.mu.Unlock()
+		return nil, errors.New("signature from Azure Key Vault doesn't match the cached public key")
+	}
+
 	// Success!
 	return signature, nil
 }
+
+// withAPIVersion returns a decorator replacing the api-version of requests
+func withAPIVersion(version string) autorest.PrepareDecorator {
+	return func(p autorest.Preparer) autorest.Preparer {
+		return autorest.PreparerFunc(func(r *http.Request) (*http.Request, error) {
+			r, err := p.Prepare(r)
+			if err != nil {
+				return r, err
+			}
+			query := r.URL.Query()
+			query.Set("api-version", version)
+			r.URL.RawQuery = query.Encode()
+			return r, nil
+		})
+	}
+}
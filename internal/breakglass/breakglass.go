@@ -0,0 +1,224 @@
+package breakglass
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/thalesgroup/sshizzle/internal/justification"
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultPrincipal is the principal break-glass certificates are issued for. Hosts must map
+// it to the accounts it can be used with, see `sshizzle-host -break-glass-user`
+const DefaultPrincipal = "sshizzle-breakglass"
+
+// KeyIDPrefix starts the KeyId of every break-glass certificate, so they stand out in logs
+const KeyIDPrefix = "BREAK-GLASS"
+
+// MaxValidity is the longest a break-glass certificate can be valid for
+const MaxValidity = time.Hour
+
+// MaxAge is how long a request remains valid after it was created, to limit replays
+const MaxAge = 10 * time.Minute
+
+// Namespace of the approval signatures, so they can't be confused with signatures made for
+// any other purpose with the same key
+const signatureNamespace = "sshizzle-break-glass-v1"
+
+// Request asks for a break-glass certificate for a public key, and carries the approvals
+// of the holders of the break-glass credentials
+type Request struct {
+	Version int `json:"version"`
+	// PublicKey to sign, in authorized_keys format
+	PublicKey string `json:"public_key"`
+	// Reason the certificate is needed, included in the certificate and audit log
+	Reason string `json:"reason"`
+	// RequestedAt is when the request was created, as a Unix time
+	RequestedAt int64      `json:"requested_at"`
+	Approvals   []Approval `json:"approvals"`
+}
+
+// Approval is a signature over a request by one of the break-glass keys
+type Approval struct {
+	// PublicKey of the approver, in authorized_keys format
+	PublicKey string `json:"public_key"`
+	// Signature is the SSH wire format signature, encoded as base64
+	Signature string `json:"signature"`
+}
+
+// NewRequest creates an unapproved request for a certificate for publicKey
+func NewRequest(publicKey ssh.PublicKey, reason string) (*Request, error) {
+	if err := checkReason(reason); err != nil {
+		return nil, err
+	}
+	return &Request{
+		Version:     1,
+		PublicKey:   strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey))),
+		Reason:      reason,
+		RequestedAt: time.Now().Unix(),
+	}, nil
+}
+
+// checkReason checks a reason is given and can be recorded in the certificate KeyId
+func checkReason(reason string) error {
+	if strings.TrimSpace(reason) == "" {
+		return errors.New("a reason must be given")
+	}
+	return justification.CheckFormat("reason", reason)
+}
+
+// Message returns the bytes signed by each approver, which cover everything in the request
+// except the approvals themselves
+func (r *Request) Message() []byte {
+	return []byte(fmt.Sprintf("%s\npublic_key=%s\nreason=%s\nrequested_at=%d\n", signatureNamespace, r.PublicKey, r.Reason, r.RequestedAt))
+}
+
+// Key parses the public key to sign
+func (r *Request) Key() (ssh.PublicKey, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(r.PublicKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %s", err.Error())
+	}
+	if _, ok := key.(*ssh.Certificate); ok {
+		return nil, errors.New("invalid public key: must not be a certificate")
+	}
+	return key, nil
+}
+
+// Approve adds an approval of the request signed by signer
+func (r *Request) Approve(signer ssh.Signer) error {
+	publicKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+	for _, approval := range r.Approvals {
+		if approval.PublicKey == publicKey {
+			return errors.New("request has already been approved with this key")
+		}
+	}
+	signature, err := signer.Sign(rand.Reader, r.Message())
+	if err != nil {
+		return err
+	}
+	r.Approvals = append(r.Approvals, Approval{
+		PublicKey: publicKey,
+		Signature: base64.StdEncoding.EncodeToString(ssh.Marshal(signature)),
+	})
+	return nil
+}
+
+// Verifier checks requests have been approved by enough of the break-glass keys
+type Verifier struct {
+	keys      []ssh.PublicKey
+	threshold int
+	// used records the requests already used, which can't be used again until they expire
+	used ReplayCache
+}
+
+// ParseKeys parses break-glass public keys in authorized_keys format, separated by newlines
+// or semicolons so they can be given in a single app setting
+func ParseKeys(value string) ([]ssh.PublicKey, error) {
+	var keys []ssh.PublicKey
+	for _, line := range strings.FieldsFunc(value, func(r rune) bool { return r == '\n' || r == ';' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("invalid break-glass key '%s': %s", line, err.Error())
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// NewVerifier returns a Verifier requiring threshold of the keys to approve each request,
+// recording used requests in used
+func NewVerifier(keys []ssh.PublicKey, threshold int, used ReplayCache) (*Verifier, error) {
+	if threshold < 1 || threshold > len(keys) {
+		return nil, fmt.Errorf("break-glass threshold must be between 1 and the number of keys (%d)", len(keys))
+	}
+	return &Verifier{
+		keys:      keys,
+		threshold: threshold,
+		used:      used,
+	}, nil
+}
+
+// Verify checks the request has a valid reason, is recent, hasn't been used before, and is
+// approved by enough distinct break-glass keys. The fingerprints of the approving keys are
+// returned
+func (v *Verifier) Verify(ctx context.Context, r *Request) ([]string, error) {
+	if err := checkReason(r.Reason); err != nil {
+		return nil, err
+	}
+	requestedAt := time.Unix(r.RequestedAt, 0)
+	if time.Since(requestedAt) > MaxAge || time.Until(requestedAt) > time.Minute {
+		return nil, fmt.Errorf("request was created at %s, and must be used within %s", requestedAt.UTC().Format(time.RFC3339), MaxAge)
+	}
+
+	message := r.Message()
+	var approvers []string
+	for _, approval := range r.Approvals {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(approval.PublicKey))
+		if err != nil || !v.isKey(key) {
+			continue
+		}
+		fingerprint := ssh.FingerprintSHA256(key)
+		if contains(approvers, fingerprint) {
+			continue
+		}
+		encoded, err := base64.StdEncoding.DecodeString(approval.Signature)
+		if err != nil {
+			continue
+		}
+		signature := &ssh.Signature{}
+		if err := ssh.Unmarshal(encoded, signature); err != nil {
+			continue
+		}
+		if err := key.Verify(message, signature); err != nil {
+			continue
+		}
+		approvers = append(approvers, fingerprint)
+	}
+	if len(approvers) < v.threshold {
+		return nil, fmt.Errorf("request has %d valid approvals, %d are required", len(approvers), v.threshold)
+	}
+
+	// Only allow each approved request to be used once
+	digest := sha256.Sum256(message)
+	first, err := v.used.Use(ctx, hex.EncodeToString(digest[:]), requestedAt.Add(MaxAge+time.Minute))
+	if err != nil {
+		return nil, fmt.Errorf("unable to check if request has been used: %s", err.Error())
+	}
+	if !first {
+		return nil, errors.New("request has already been used")
+	}
+	return approvers, nil
+}
+
+// isKey reports whether key is one of the break-glass keys
+func (v *Verifier) isKey(key ssh.PublicKey) bool {
+	for _, k := range v.keys {
+		if bytes.Equal(k.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// contains reports whether value is in values
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
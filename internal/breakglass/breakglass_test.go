@@ -0,0 +1,211 @@
+package breakglass
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newSigners returns n break-glass keys
+func newSigners(t *testing.T, n int) []ssh.Signer {
+	t.Helper()
+	signers := make([]ssh.Signer, n)
+	for i := range signers {
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if signers[i], err = ssh.NewSignerFromKey(privateKey); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return signers
+}
+
+// failingCache is a ReplayCache whose store is unavailable
+type failingCache struct{}
+
+func (failingCache) Use(ctx context.Context, digest string, expiry time.Time) (bool, error) {
+	return false, errors.New("store unavailable")
+}
+
+func TestVerify(t *testing.T) {
+	signers := newSigners(t, 4)
+	trusted := []ssh.PublicKey{signers[0].PublicKey(), signers[1].PublicKey(), signers[2].PublicKey()}
+	untrusted := signers[3]
+	userKey := newSigners(t, 1)[0].PublicKey()
+
+	tests := []struct {
+		name string
+		// approvers are indexes into signers
+		approvers []int
+		// age of the request when it's approved
+		age    time.Duration
+		modify func(r *Request)
+		cache  ReplayCache
+		err    string
+	}{
+		{name: "threshold met", approvers: []int{0, 1}},
+		{name: "more than the threshold", approvers: []int{0, 1, 2}},
+		{name: "threshold not met", approvers: []int{0}, err: "1 valid approvals, 2 are required"},
+		{name: "no approvals", err: "0 valid approvals, 2 are required"},
+		{
+			name:      "same approver twice",
+			approvers: []int{0},
+			modify: func(r *Request) {
+				r.Approvals = append(r.Approvals, r.Approvals[0])
+			},
+			err: "1 valid approvals",
+		},
+		{name: "approver not trusted", approvers: []int{0, 3}, err: "1 valid approvals"},
+		{
+			name:      "approval signed by another key",
+			approvers: []int{0, 3},
+			modify: func(r *Request) {
+				// Claim the untrusted key's signature came from a trusted key
+				r.Approvals[1].PublicKey = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signers[1].PublicKey())))
+			},
+			err: "1 valid approvals",
+		},
+		{
+			name:      "malformed signature",
+			approvers: []int{0, 1},
+			modify: func(r *Request) {
+				r.Approvals[1].Signature = "!!!"
+			},
+			err: "1 valid approvals",
+		},
+		{
+			name:      "tampered reason",
+			approvers: []int{0, 1},
+			modify: func(r *Request) {
+				r.Reason = "something else"
+			},
+			err: "0 valid approvals",
+		},
+		{
+			name:      "tampered public key",
+			approvers: []int{0, 1},
+			modify: func(r *Request) {
+				r.PublicKey = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(untrusted.PublicKey())))
+			},
+			err: "0 valid approvals",
+		},
+		{name: "nearly too old", approvers: []int{0, 1}, age: MaxAge - time.Minute},
+		{name: "too old", approvers: []int{0, 1}, age: MaxAge + time.Minute, err: "must be used within"},
+		{name: "in the future", approvers: []int{0, 1}, age: -5 * time.Minute, err: "must be used within"},
+		{
+			name:      "invalid reason",
+			approvers: []int{0, 1},
+			modify: func(r *Request) {
+				r.Reason = "]"
+			},
+			err: "reason",
+		},
+		{name: "replay cache unavailable", approvers: []int{0, 1}, cache: failingCache{}, err: "unable to check if request has been used"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache := test.cache
+			if cache == nil {
+				cache = NewMemoryCache()
+			}
+			verifier, err := NewVerifier(trusted, 2, cache)
+			if err != nil {
+				t.Fatal(err)
+			}
+			request, err := NewRequest(userKey, "datacentre outage")
+			if err != nil {
+				t.Fatal(err)
+			}
+			request.RequestedAt = time.Now().Add(-test.age).Unix()
+			for _, i := range test.approvers {
+				if err := request.Approve(signers[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.modify != nil {
+				test.modify(request)
+			}
+
+			approvers, err := verifier.Verify(context.Background(), request)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(approvers) != len(test.approvers) {
+				t.Fatalf("got %d approvers, expected %d", len(approvers), len(test.approvers))
+			}
+			for i, approver := range approvers {
+				if approver != ssh.FingerprintSHA256(signers[test.approvers[i]].PublicKey()) {
+					t.Errorf("approver %d is %s, expected signer %d", i, approver, test.approvers[i])
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyReplay(t *testing.T) {
+	signers := newSigners(t, 2)
+	verifier, err := NewVerifier([]ssh.PublicKey{signers[0].PublicKey(), signers[1].PublicKey()}, 2, NewMemoryCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := NewRequest(newSigners(t, 1)[0].PublicKey(), "datacentre outage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, signer := range signers {
+		if err := request.Approve(signer); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := verifier.Verify(context.Background(), request); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := verifier.Verify(context.Background(), request); err == nil || !strings.Contains(err.Error(), "already been used") {
+		t.Fatalf("expected replay to be refused, got %v", err)
+	}
+
+	// Reordering the approvals doesn't make it a new request
+	request.Approvals[0], request.Approvals[1] = request.Approvals[1], request.Approvals[0]
+	if _, err := verifier.Verify(context.Background(), request); err == nil || !strings.Contains(err.Error(), "already been used") {
+		t.Fatalf("expected reordered replay to be refused, got %v", err)
+	}
+}
+
+func TestApproveTwice(t *testing.T) {
+	signers := newSigners(t, 1)
+	request, err := NewRequest(signers[0].PublicKey(), "datacentre outage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := request.Approve(signers[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := request.Approve(signers[0]); err == nil {
+		t.Fatal("expected a second approval with the same key to be refused")
+	}
+}
+
+func TestNewVerifierThreshold(t *testing.T) {
+	signers := newSigners(t, 2)
+	keys := []ssh.PublicKey{signers[0].PublicKey(), signers[1].PublicKey()}
+	for _, threshold := range []int{0, 3} {
+		if _, err := NewVerifier(keys, threshold, NewMemoryCache()); err == nil {
+			t.Errorf("expected threshold %d of 2 keys to be refused", threshold)
+		}
+	}
+}
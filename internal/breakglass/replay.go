@@ -0,0 +1,46 @@
+package breakglass
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ReplayCache records the requests that have been used, so each can only be used once
+type ReplayCache interface {
+	// Use records the request with the digest as used until expiry, returning false if it
+	// had already been used
+	Use(ctx context.Context, digest string, expiry time.Time) (bool, error)
+}
+
+// MemoryCache keeps used requests in memory. Each instance of the function has its own
+// cache, so a request could be used once on every instance
+type MemoryCache struct {
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+// NewMemoryCache returns an empty MemoryCache
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{
+		used: make(map[string]time.Time),
+	}
+}
+
+// Use records the request as used, discarding expired requests
+func (c *MemoryCache) Use(ctx context.Context, digest string, expiry time.Time) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for d, e := range c.used {
+		if now.After(e) {
+			delete(c.used, d)
+		}
+	}
+	if _, used := c.used[digest]; used {
+		return false, nil
+	}
+	c.used[digest] = expiry
+	return true, nil
+}
@@ -0,0 +1,66 @@
+package tablecache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+// Partition containing all used requests
+const tablePartition = "used"
+
+// Timeout in seconds for each request to Table Storage
+const tableTimeout = 10
+
+// Cache keeps used break-glass requests in Azure Table Storage, so a request can only be used
+// once across all instances of the function. Each request is an entity with its digest as the
+// row key. It's kept out of the breakglass package so sshizzle-breakglass doesn't include the
+// storage client
+type Cache struct {
+	table *storage.Table
+}
+
+// NewCache returns a Cache using the storage account in the connection string, creating the
+// table if required. Use "UseDevelopmentStorage=true" for the local emulator
+func NewCache(connectionString string, tableName string) (*Cache, error) {
+	client, err := storage.NewClientFromConnectionString(connectionString)
+	if err != nil {
+		return nil, fmt.Errorf("error creating table storage client: %s", err.Error())
+	}
+	tableService := client.GetTableService()
+	table := tableService.GetTableReference(tableName)
+	if err := table.Create(tableTimeout, storage.EmptyPayload, nil); err != nil && !isStatus(err, http.StatusConflict) {
+		return nil, fmt.Errorf("error creating table %s: %s", tableName, err.Error())
+	}
+	return &Cache{table: table}, nil
+}
+
+// Use inserts an entity for the request. Inserts fail if the entity exists, so only one
+// instance can use each request. Break-glass requests are rare, so entities aren't removed
+func (c *Cache) Use(ctx context.Context, digest string, expiry time.Time) (bool, error) {
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	entity := c.table.GetEntityReference(tablePartition, digest)
+	entity.Properties = map[string]interface{}{
+		"Expiry": expiry.UTC(),
+	}
+	err := entity.Insert(storage.EmptyPayload, nil)
+	if isStatus(err, http.StatusConflict) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// isStatus reports whether err is a Table Storage error with the status code specified
+func isStatus(err error, statusCode int) bool {
+	var storageErr storage.AzureStorageServiceError
+	return errors.As(err, &storageErr) && storageErr.StatusCode == statusCode
+}
@@ -1,24 +1,42 @@
 package config
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
+	"github.com/thalesgroup/sshizzle/internal/azure"
+	"github.com/thalesgroup/sshizzle/internal/oidc"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/microsoft"
 )
 
 // SSHizzleConfig contains information required to authenticate
 // with Azure AD and invoke the lambda function
 type SSHizzleConfig struct {
-	Socket      string
-	TenantID    string
-	ClientID    string
-	FuncHost    string
-	Signer      ssh.Signer
-	OauthConfig *oauth2.Config
+	Socket        string
+	Confirm       string
+	Destinations  []ssh.PublicKey
+	CATimeout     time.Duration
+	CARetries     int
+	TenantID      string
+	ClientID      string
+	FuncHost      string
+	KeyTypes      []string
+	Principals    []string
+	Justification string
+	Signers       []ssh.Signer
+	OauthConfig   *oauth2.Config
+	// IDToken is set when signing in with an OIDC provider other than Azure AD, whose ID
+	// tokens are sent to sshizzle-ca
+	IDToken bool
 }
 
 // Check gets config from environment variables and creates sshizzle config dir
@@ -33,13 +51,63 @@ func Check() (*SSHizzleConfig, error) {
 	if err != nil {
 		return nil, err
 	}
-	tenantID, err := GetEnv("AZ_TENANT_ID")
-	if err != nil {
-		return nil, err
+
+	// Optionally require confirmation of each signature, with either "askpass" or "notify"
+	confirm := os.Getenv("SSHIZZLE_CONFIRM")
+	if confirm != "" && confirm != "askpass" && confirm != "notify" {
+		return nil, fmt.Errorf("invalid SSHIZZLE_CONFIRM '%s', must be 'askpass' or 'notify'", confirm)
 	}
-	clientID, err := GetEnv("AZ_CLIENT_ID")
-	if err != nil {
-		return nil, err
+
+	// Optionally restrict the hosts the agent can be used with to those in a known_hosts file
+	var destinations []ssh.PublicKey
+	if destinationsFile := os.Getenv("SSHIZZLE_DESTINATIONS"); destinationsFile != "" {
+		destinations, err = LoadDestinations(destinationsFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Key types the agent should generate and request certificates for, e.g. "ed25519,rsa"
+	keyTypes := []string{"rsa"}
+	if value := os.Getenv("SSHIZZLE_KEY_TYPES"); value != "" {
+		keyTypes = strings.Split(value, ",")
+		for i, keyType := range keyTypes {
+			keyTypes[i] = strings.TrimSpace(keyType)
+			if keyTypes[i] != "rsa" && keyTypes[i] != "ed25519" {
+				return nil, fmt.Errorf("invalid key type '%s' in SSHIZZLE_KEY_TYPES, must be 'rsa' or 'ed25519'", keyType)
+			}
+		}
+	}
+
+	// Optionally request privileged principals, such as "root", in addition to the user's own.
+	// The CA may require someone to approve these
+	var principals []string
+	if value := os.Getenv("SSHIZZLE_PRINCIPALS"); value != "" {
+		for _, principal := range strings.Split(value, ",") {
+			if principal = strings.TrimSpace(principal); principal != "" {
+				principals = append(principals, principal)
+			}
+		}
+	}
+
+	// Optionally give a reason for the certificates, such as a change ticket, which is recorded
+	// in them. The CA may require this for some principals
+	justification := strings.TrimSpace(os.Getenv("SSHIZZLE_JUSTIFICATION"))
+
+	// Optionally override the timeout and number of retries when invoking sshizzle-ca
+	caTimeout := 30 * time.Second
+	if value := os.Getenv("SSHIZZLE_CA_TIMEOUT"); value != "" {
+		caTimeout, err = time.ParseDuration(value)
+		if err != nil || caTimeout <= 0 {
+			return nil, fmt.Errorf("invalid SSHIZZLE_CA_TIMEOUT '%s', must be a duration such as 30s", value)
+		}
+	}
+	caRetries := 3
+	if value := os.Getenv("SSHIZZLE_CA_RETRIES"); value != "" {
+		caRetries, err = strconv.Atoi(value)
+		if err != nil || caRetries < 0 {
+			return nil, fmt.Errorf("invalid SSHIZZLE_CA_RETRIES '%s', must be a number", value)
+		}
 	}
 
 	// Get the default user config directory ($HOME/.config) on Linux
@@ -56,25 +124,92 @@ func Check() (*SSHizzleConfig, error) {
 		}
 	}
 
+	// Sign in with an OIDC provider if one is configured, otherwise Azure AD
+	var tenantID, clientID string
+	var oauthConfig *oauth2.Config
+	idToken := false
+	if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+		if clientID, err = GetEnv("OIDC_CLIENT_ID"); err != nil {
+			return nil, err
+		}
+		if oauthConfig, err = oidcConfig(issuer, clientID); err != nil {
+			return nil, err
+		}
+		idToken = true
+	} else {
+		if tenantID, err = GetEnv("AZ_TENANT_ID"); err != nil {
+			return nil, err
+		}
+		if clientID, err = GetEnv("AZ_CLIENT_ID"); err != nil {
+			return nil, err
+		}
+		if oauthConfig, err = azureADConfig(tenantID, clientID, funcHost); err != nil {
+			return nil, err
+		}
+	}
+
 	// Create a new SSHizzleConfig with the details specified
 	config := SSHizzleConfig{
-		Socket:   "/tmp/sshizzle.sock",
-		TenantID: tenantID,
-		ClientID: clientID,
-		FuncHost: funcHost,
-		Signer:   nil,
-		OauthConfig: &oauth2.Config{
-			RedirectURL:  "http://localhost:8080/callback",
-			ClientID:     clientID,
-			ClientSecret: "",
-			Scopes:       []string{"openid offline_access https://" + funcHost + "/user_impersonation"},
-			Endpoint:     microsoft.AzureADEndpoint(tenantID),
-		},
+		Socket:        GetSocket(),
+		Confirm:       confirm,
+		Destinations:  destinations,
+		CATimeout:     caTimeout,
+		CARetries:     caRetries,
+		TenantID:      tenantID,
+		ClientID:      clientID,
+		FuncHost:      funcHost,
+		KeyTypes:      keyTypes,
+		Principals:    principals,
+		Justification: justification,
+		Signers:       nil,
+		OauthConfig:   oauthConfig,
+		IDToken:       idToken,
 	}
 
 	return &config, nil
 }
 
+// azureADConfig returns the OAuth config for signing in with the Azure AD of the cloud the
+// function is in, and getting access tokens for it
+func azureADConfig(tenantID string, clientID string, funcHost string) (*oauth2.Config, error) {
+	cloud, err := azure.ParseEnvironment(os.Getenv(azure.EnvironmentVariable))
+	if err != nil {
+		return nil, err
+	}
+	activeDirectoryEndpoint := strings.TrimSuffix(cloud.ActiveDirectoryEndpoint, "/")
+	return &oauth2.Config{
+		RedirectURL:  "http://localhost:8080/callback",
+		ClientID:     clientID,
+		ClientSecret: "",
+		Scopes:       []string{"openid offline_access https://" + funcHost + "/user_impersonation"},
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  activeDirectoryEndpoint + "/" + tenantID + "/oauth2/v2.0/authorize",
+			TokenURL: activeDirectoryEndpoint + "/" + tenantID + "/oauth2/v2.0/token",
+		},
+	}, nil
+}
+
+// oidcConfig returns the OAuth config for signing in with the OIDC provider at issuer, such as
+// Okta, Keycloak or Dex. OIDC_CLIENT_SECRET is only needed for confidential clients, and
+// OIDC_SCOPES replaces the default scopes
+func oidcConfig(issuer string, clientID string) (*oauth2.Config, error) {
+	provider, err := oidc.Discover(context.Background(), issuer)
+	if err != nil {
+		return nil, err
+	}
+	scopes := []string{"openid", "profile", "email", "offline_access"}
+	if value := os.Getenv("OIDC_SCOPES"); value != "" {
+		scopes = strings.Fields(strings.ReplaceAll(value, ",", " "))
+	}
+	return &oauth2.Config{
+		RedirectURL:  "http://localhost:8080/callback",
+		ClientID:     clientID,
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		Scopes:       scopes,
+		Endpoint:     provider.Endpoint(),
+	}, nil
+}
+
 // GetSSHizzleDir returns the path to the sshizzle config dir
 func GetSSHizzleDir() (string, error) {
 	// Get the default user config directory ($HOME/.config) on Linux
@@ -96,6 +231,65 @@ func GetSSHizzleTokenFile() (string, error) {
 	return tokenFile, nil
 }
 
+// GetSocket returns the agent socket path from the SSHIZZLE_SOCKET environment variable
+// if set, otherwise the per-user default
+func GetSocket() string {
+	socket, exists := os.LookupEnv("SSHIZZLE_SOCKET")
+	if !exists || socket == "" {
+		return GetDefaultSocket()
+	}
+	return socket
+}
+
+// GetDefaultSocket returns the default agent socket path for the current user. This is
+// $XDG_RUNTIME_DIR/sshizzle/agent.sock, falling back to a per-user directory in the
+// system temp dir where XDG_RUNTIME_DIR is unset (e.g. on macOS)
+func GetDefaultSocket() string {
+	runtimeDir, exists := os.LookupEnv("XDG_RUNTIME_DIR")
+	if exists && runtimeDir != "" {
+		return filepath.Join(runtimeDir, "sshizzle", "agent.sock")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("sshizzle-%d", os.Getuid()), "agent.sock")
+}
+
+// LoadDestinations reads the host keys from a file in known_hosts format. Host names are
+// ignored, only the keys are used. Keys marked @cert-authority aren't host keys so are skipped,
+// and keys marked @revoked are never allowed, even if they're also listed without the marker
+func LoadDestinations(path string) ([]ssh.PublicKey, error) {
+	data, err := ioutil.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, fmt.Errorf("error reading destinations file: %s", err.Error())
+	}
+	var allowed []ssh.PublicKey
+	revoked := make(map[string]bool)
+	for len(data) > 0 {
+		marker, _, key, _, rest, err := ssh.ParseKnownHosts(data)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error parsing destinations file: %s", err.Error())
+		}
+		data = rest
+		switch marker {
+		case "":
+			allowed = append(allowed, key)
+		case "revoked":
+			revoked[string(key.Marshal())] = true
+		}
+	}
+	var keys []ssh.PublicKey
+	for _, key := range allowed {
+		if !revoked[string(key.Marshal())] {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no host keys found in destinations file %s", path)
+	}
+	return keys, nil
+}
+
 // GetEnv gets an environment variable or returns an error if unset
 func GetEnv(key string) (string, error) {
 	result, exists := os.LookupEnv(key)
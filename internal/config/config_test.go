@@ -0,0 +1,99 @@
+package config
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestLoadDestinations(t *testing.T) {
+	keys := make([]string, 3)
+	publicKeys := make([]ssh.PublicKey, 3)
+	for i := range keys {
+		publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if publicKeys[i], err = ssh.NewPublicKey(publicKey); err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKeys[i])))
+	}
+
+	tests := []struct {
+		name     string
+		content  string
+		expected []int
+		err      string
+	}{
+		{
+			name:     "host keys",
+			content:  fmt.Sprintf("# servers\nbastion %s\nweb,10.0.0.1 %s\n", keys[0], keys[1]),
+			expected: []int{0, 1},
+		},
+		{
+			name:     "cert-authority skipped",
+			content:  fmt.Sprintf("bastion %s\n@cert-authority *.example.com %s\n", keys[0], keys[2]),
+			expected: []int{0},
+		},
+		{
+			name:     "revoked key denied",
+			content:  fmt.Sprintf("bastion %s\n@revoked * %s\n", keys[0], keys[2]),
+			expected: []int{0},
+		},
+		{
+			name:     "revoked key also listed without the marker",
+			content:  fmt.Sprintf("bastion %s\nweb %s\n@revoked * %s\n", keys[0], keys[1], keys[1]),
+			expected: []int{0},
+		},
+		{
+			name:    "only marked keys",
+			content: fmt.Sprintf("@cert-authority * %s\n@revoked * %s\n", keys[0], keys[1]),
+			err:     "no host keys found",
+		},
+		{
+			name:    "empty",
+			content: "# no servers\n",
+			err:     "no host keys found",
+		},
+		{
+			name:    "invalid key",
+			content: "bastion ssh-ed25519 !!!\n",
+			err:     "error parsing destinations file",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "known_hosts")
+			if err := os.WriteFile(path, []byte(test.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			destinations, err := LoadDestinations(path)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(destinations) != len(test.expected) {
+				t.Fatalf("got %d destinations, expected %d", len(destinations), len(test.expected))
+			}
+			for i, key := range test.expected {
+				if !bytes.Equal(destinations[i].Marshal(), publicKeys[key].Marshal()) {
+					t.Errorf("destination %d isn't key %d", i, key)
+				}
+			}
+		})
+	}
+}
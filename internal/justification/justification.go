@@ -0,0 +1,82 @@
+package justification
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"unicode"
+)
+
+// MaxLength is the longest justification accepted, so it fits in the certificate KeyId
+const MaxLength = 128
+
+// Policy checks the justification given with a certificate request, such as a change ticket
+type Policy struct {
+	pattern *regexp.Regexp
+	// principals are glob patterns for the principals which need a justification
+	principals []string
+}
+
+// NewPolicy returns a Policy requiring justifications to match the pattern, if given, and
+// requiring one for any principal matching the glob patterns in principals
+func NewPolicy(pattern string, principals []string) (*Policy, error) {
+	p := &Policy{}
+	if pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid justification pattern '%s': %s", pattern, err.Error())
+		}
+		p.pattern = re
+	}
+	for _, principal := range principals {
+		if _, err := path.Match(principal, ""); err != nil {
+			return nil, fmt.Errorf("invalid principal pattern '%s': %s", principal, err.Error())
+		}
+		p.principals = append(p.principals, principal)
+	}
+	return p, nil
+}
+
+// Required returns the first of the principals which needs a justification, or "" if none do
+func (p *Policy) Required(principals []string) string {
+	if p == nil {
+		return ""
+	}
+	for _, principal := range principals {
+		for _, pattern := range p.principals {
+			if matched, _ := path.Match(pattern, principal); matched {
+				return principal
+			}
+		}
+	}
+	return ""
+}
+
+// CheckFormat checks text recorded in a certificate KeyId fits and doesn't contain brackets
+// or control characters, so the KeyId stays easy to parse. name describes the text in errors
+func CheckFormat(name string, text string) error {
+	if len(text) > MaxLength {
+		return fmt.Errorf("%s must be at most %d characters", name, MaxLength)
+	}
+	for _, r := range text {
+		if !unicode.IsPrint(r) || r == '[' || r == ']' {
+			return fmt.Errorf("%s can't contain brackets or control characters", name)
+		}
+	}
+	return nil
+}
+
+// Validate checks a justification is well formed and matches the pattern. An empty
+// justification is always valid, use Required to check if one is needed
+func (p *Policy) Validate(justification string) error {
+	if justification == "" {
+		return nil
+	}
+	if err := CheckFormat("justification", justification); err != nil {
+		return err
+	}
+	if p != nil && p.pattern != nil && !p.pattern.MatchString(justification) {
+		return fmt.Errorf("justification '%s' doesn't match the pattern %s", justification, p.pattern.String())
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// MaxRecords is the maximum number of records returned by a single lookup
+const MaxRecords = 100
+
+// Record describes a certificate issued by the CA
+type Record struct {
+	Serial      uint64    `json:"serial"`
+	KeyID       string    `json:"key_id"`
+	Principals  []string  `json:"principals"`
+	Fingerprint string    `json:"fingerprint"`
+	ValidAfter  time.Time `json:"valid_after"`
+	ValidBefore time.Time `json:"valid_before"`
+	IssuedAt    time.Time `json:"issued_at"`
+	RequestID   string    `json:"request_id"`
+	// Requester is the Azure AD principal that requested the certificate
+	Requester   string `json:"requester"`
+	RequesterID string `json:"requester_id"`
+	ClientIP    string `json:"client_ip"`
+}
+
+// Query selects records from the ledger, either by serial or by requester and time window
+type Query struct {
+	// Serial returns the certificate with this serial number, if non-zero
+	Serial uint64
+	// Requester returns the certificates issued to this principal name
+	Requester string
+	// From and To restrict the results to certificates issued in this window, if non-zero
+	From time.Time
+	To   time.Time
+	// Limit is the maximum number of records to return, defaulting to MaxRecords
+	Limit int
+}
+
+// Ledger stores a record of every certificate issued by the CA
+type Ledger interface {
+	// Record adds the records to the ledger
+	Record(ctx context.Context, records []Record) error
+	// Lookup returns the records matching the query, most recently issued first
+	Lookup(ctx context.Context, query Query) ([]Record, error)
+}
+
+// NewRecords creates ledger records for certificates issued to a requester
+func NewRecords(certificates []*ssh.Certificate, requestID string, requester string, requesterID string, clientIP string) []Record {
+	issuedAt := time.Now().UTC()
+	records := make([]Record, 0, len(certificates))
+	for _, certificate := range certificates {
+		records = append(records, Record{
+			Serial:      certificate.Serial,
+			KeyID:       certificate.KeyId,
+			Principals:  certificate.ValidPrincipals,
+			Fingerprint: ssh.FingerprintSHA256(certificate.Key),
+			ValidAfter:  time.Unix(int64(certificate.ValidAfter), 0).UTC(),
+			ValidBefore: time.Unix(int64(certificate.ValidBefore), 0).UTC(),
+			IssuedAt:    issuedAt,
+			RequestID:   requestID,
+			Requester:   requester,
+			RequesterID: requesterID,
+			ClientIP:    clientIP,
+		})
+	}
+	return records
+}
+
+// Validate checks the query selects either a serial or a requester, and fills in the limit
+func (q *Query) Validate() error {
+	if q.Serial == 0 && q.Requester == "" {
+		return errors.New("a serial or requester must be given")
+	}
+	if !q.From.IsZero() && !q.To.IsZero() && q.To.Before(q.From) {
+		return errors.New("the end of the time window is before the start")
+	}
+	if q.Limit <= 0 || q.Limit > MaxRecords {
+		q.Limit = MaxRecords
+	}
+	return nil
+}
+
+// Values encodes the query as URL parameters for the lookup API
+func (q Query) Values() url.Values {
+	values := url.Values{}
+	if q.Serial != 0 {
+		values.Set("serial", strconv.FormatUint(q.Serial, 10))
+	}
+	if q.Requester != "" {
+		values.Set("requester", q.Requester)
+	}
+	if !q.From.IsZero() {
+		values.Set("from", q.From.UTC().Format(time.RFC3339))
+	}
+	if !q.To.IsZero() {
+		values.Set("to", q.To.UTC().Format(time.RFC3339))
+	}
+	if q.Limit > 0 {
+		values.Set("limit", strconv.Itoa(q.Limit))
+	}
+	return values
+}
+
+// ParseQuery decodes a query from the URL parameters given to the lookup API
+func ParseQuery(values url.Values) (Query, error) {
+	query := Query{
+		Requester: values.Get("requester"),
+	}
+	var err error
+	if value := values.Get("serial"); value != "" {
+		if query.Serial, err = strconv.ParseUint(value, 10, 64); err != nil {
+			return query, fmt.Errorf("invalid serial '%s'", value)
+		}
+	}
+	if value := values.Get("from"); value != "" {
+		if query.From, err = time.Parse(time.RFC3339, value); err != nil {
+			return query, fmt.Errorf("invalid from time '%s', must be RFC 3339", value)
+		}
+	}
+	if value := values.Get("to"); value != "" {
+		if query.To, err = time.Parse(time.RFC3339, value); err != nil {
+			return query, fmt.Errorf("invalid to time '%s', must be RFC 3339", value)
+		}
+	}
+	if value := values.Get("limit"); value != "" {
+		if query.Limit, err = strconv.Atoi(value); err != nil {
+			return query, fmt.Errorf("invalid limit '%s'", value)
+		}
+	}
+	return query, query.Validate()
+}
@@ -0,0 +1,146 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/thalesgroup/sshizzle/internal/ledger"
+
+	// Register the pure Go sqlite driver with database/sql, which unlike cgo drivers builds
+	// for Windows
+	_ "modernc.org/sqlite"
+)
+
+// Schema for the SQLite ledger. Serials are random 63 bit numbers so fit in an INTEGER
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS certificates (
+	serial       INTEGER NOT NULL,
+	key_id       TEXT NOT NULL,
+	principals   TEXT NOT NULL,
+	fingerprint  TEXT NOT NULL,
+	valid_after  INTEGER NOT NULL,
+	valid_before INTEGER NOT NULL,
+	issued_at    INTEGER NOT NULL,
+	request_id   TEXT NOT NULL,
+	requester    TEXT NOT NULL COLLATE NOCASE,
+	requester_id TEXT NOT NULL,
+	client_ip    TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS certificates_serial ON certificates (serial);
+CREATE INDEX IF NOT EXISTS certificates_requester ON certificates (requester, issued_at);
+`
+
+// Ledger keeps the ledger in a local SQLite database, for running the CA outside of Azure
+// or on a single instance. It's kept out of the ledger package so only the CA and
+// sshizzle-ledger include the driver
+type Ledger struct {
+	db *sql.DB
+}
+
+// NewLedger opens the SQLite database at path, creating it if required
+func NewLedger(path string) (*Ledger, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening ledger database: %s", err.Error())
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating ledger database: %s", err.Error())
+	}
+	return &Ledger{db: db}, nil
+}
+
+// Record inserts the records in a single transaction
+func (l *Ledger) Record(ctx context.Context, records []ledger.Record) error {
+	tx, err := l.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		_, err := tx.ExecContext(ctx,
+			`INSERT INTO certificates (serial, key_id, principals, fingerprint, valid_after, valid_before, issued_at, request_id, requester, requester_id, client_ip)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			int64(record.Serial),
+			record.KeyID,
+			strings.Join(record.Principals, ","),
+			record.Fingerprint,
+			record.ValidAfter.Unix(),
+			record.ValidBefore.Unix(),
+			record.IssuedAt.Unix(),
+			record.RequestID,
+			record.Requester,
+			record.RequesterID,
+			record.ClientIP,
+		)
+		if err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("error recording certificate %d: %s", record.Serial, err.Error())
+		}
+	}
+	return tx.Commit()
+}
+
+// Lookup returns the records matching the query, most recently issued first
+func (l *Ledger) Lookup(ctx context.Context, query ledger.Query) ([]ledger.Record, error) {
+	if err := query.Validate(); err != nil {
+		return nil, err
+	}
+
+	var conditions []string
+	var args []interface{}
+	if query.Serial != 0 {
+		conditions = append(conditions, "serial = ?")
+		args = append(args, int64(query.Serial))
+	}
+	if query.Requester != "" {
+		conditions = append(conditions, "requester = ?")
+		args = append(args, query.Requester)
+	}
+	if !query.From.IsZero() {
+		conditions = append(conditions, "issued_at >= ?")
+		args = append(args, query.From.Unix())
+	}
+	if !query.To.IsZero() {
+		conditions = append(conditions, "issued_at <= ?")
+		args = append(args, query.To.Unix())
+	}
+	args = append(args, query.Limit)
+
+	// #nosec conditions only contain fixed strings, the values are passed as arguments
+	rows, err := l.db.QueryContext(ctx,
+		`SELECT serial, key_id, principals, fingerprint, valid_after, valid_before, issued_at, request_id, requester, requester_id, client_ip
+		FROM certificates WHERE `+strings.Join(conditions, " AND ")+` ORDER BY issued_at DESC LIMIT ?`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []ledger.Record{}
+	for rows.Next() {
+		var record ledger.Record
+		var serial, validAfter, validBefore, issuedAt int64
+		var principals string
+		err := rows.Scan(&serial, &record.KeyID, &principals, &record.Fingerprint, &validAfter, &validBefore, &issuedAt,
+			&record.RequestID, &record.Requester, &record.RequesterID, &record.ClientIP)
+		if err != nil {
+			return nil, err
+		}
+		record.Serial = uint64(serial)
+		record.Principals = strings.Split(principals, ",")
+		record.ValidAfter = time.Unix(validAfter, 0).UTC()
+		record.ValidBefore = time.Unix(validBefore, 0).UTC()
+		record.IssuedAt = time.Unix(issuedAt, 0).UTC()
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// Close closes the database
+func (l *Ledger) Close() error {
+	return l.db.Close()
+}
@@ -0,0 +1,67 @@
+package sqlite
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/thalesgroup/sshizzle/internal/ledger"
+)
+
+func TestLedger(t *testing.T) {
+	l, err := NewLedger(filepath.Join(t.TempDir(), "ledger.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ctx := context.Background()
+	issuedAt := time.Now().UTC().Truncate(time.Second)
+	records := []ledger.Record{
+		{Serial: 1, KeyID: "old", Principals: []string{"alice"}, Requester: "Alice@example.com", IssuedAt: issuedAt.Add(-time.Hour)},
+		{Serial: 2, KeyID: "new", Principals: []string{"alice", "admins"}, Requester: "alice@example.com", IssuedAt: issuedAt},
+		{Serial: 1<<63 - 1, KeyID: "bob", Principals: []string{"bob"}, Requester: "bob@example.com", IssuedAt: issuedAt},
+	}
+	if err := l.Record(ctx, records); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		query  ledger.Query
+		keyIDs []string
+	}{
+		{"serial", ledger.Query{Serial: 2}, []string{"new"}},
+		{"largest serial", ledger.Query{Serial: 1<<63 - 1}, []string{"bob"}},
+		{"unknown serial", ledger.Query{Serial: 3}, nil},
+		{"requester, newest first and case insensitive", ledger.Query{Requester: "ALICE@example.com"}, []string{"new", "old"}},
+		{"requester in window", ledger.Query{Requester: "alice@example.com", From: issuedAt.Add(-time.Minute)}, []string{"new"}},
+		{"requester with limit", ledger.Query{Requester: "alice@example.com", Limit: 1}, []string{"new"}},
+		{"serial for another requester", ledger.Query{Serial: 2, Requester: "bob@example.com"}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			found, err := l.Lookup(ctx, test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(found) != len(test.keyIDs) {
+				t.Fatalf("found %d records, expected %d", len(found), len(test.keyIDs))
+			}
+			for i, record := range found {
+				if record.KeyID != test.keyIDs[i] {
+					t.Errorf("record %d is %s, expected %s", i, record.KeyID, test.keyIDs[i])
+				}
+			}
+		})
+	}
+
+	found, err := l.Lookup(ctx, ledger.Query{Serial: 2})
+	if err != nil || len(found) != 1 {
+		t.Fatalf("lookup failed: %v", err)
+	}
+	if got := found[0]; len(got.Principals) != 2 || got.Principals[1] != "admins" || !got.IssuedAt.Equal(issuedAt) {
+		t.Fatalf("record wasn't read back as written: %+v", got)
+	}
+}
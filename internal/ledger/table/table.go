@@ -0,0 +1,195 @@
+package table
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/thalesgroup/sshizzle/internal/ledger"
+)
+
+// Timeout in seconds for each request to Table Storage
+const tableTimeout = 10
+
+// serialPartition holds a copy of every record keyed by serial, so a serial can be looked up
+// without knowing the requester. ':' never appears in the base64 requester partitions
+const serialPartition = "serial:"
+
+// Ledger keeps the ledger in Azure Table Storage. Each certificate is an entity with the
+// requester as its partition key and the serial as its row key, so a user's certificates
+// can be found without scanning the whole table, and a copy is kept in the serial partition
+type Ledger struct {
+	table *storage.Table
+}
+
+// NewLedger returns a Ledger using the storage account in the connection string, creating
+// the table if required. Use "UseDevelopmentStorage=true" for the local emulator
+func NewLedger(connectionString string, tableName string) (*Ledger, error) {
+	client, err := storage.NewClientFromConnectionString(connectionString)
+	if err != nil {
+		return nil, fmt.Errorf("error creating table storage client: %s", err.Error())
+	}
+	tableService := client.GetTableService()
+	table := tableService.GetTableReference(tableName)
+	if err := table.Create(tableTimeout, storage.EmptyPayload, nil); err != nil && !isStatus(err, http.StatusConflict) {
+		return nil, fmt.Errorf("error creating table %s: %s", tableName, err.Error())
+	}
+	return &Ledger{table: table}, nil
+}
+
+// Record inserts an entity for each record in the requester's partition and the serial
+// partition
+func (l *Ledger) Record(ctx context.Context, records []ledger.Record) error {
+	for _, record := range records {
+		for _, partition := range []string{serialPartition, partitionKey(record.Requester)} {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			entity := l.table.GetEntityReference(partition, strconv.FormatUint(record.Serial, 10))
+			entity.Properties = map[string]interface{}{
+				"KeyID":       record.KeyID,
+				"Principals":  strings.Join(record.Principals, ","),
+				"Fingerprint": record.Fingerprint,
+				"ValidAfter":  record.ValidAfter.UTC(),
+				"ValidBefore": record.ValidBefore.UTC(),
+				"IssuedAt":    record.IssuedAt.UTC(),
+				"RequestID":   record.RequestID,
+				"Requester":   record.Requester,
+				"RequesterID": record.RequesterID,
+				"ClientIP":    record.ClientIP,
+			}
+			if err := entity.Insert(storage.EmptyPayload, nil); err != nil {
+				return fmt.Errorf("error recording certificate %d: %s", record.Serial, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// Lookup returns the records matching the query, most recently issued first
+func (l *Ledger) Lookup(ctx context.Context, query ledger.Query) ([]ledger.Record, error) {
+	if err := query.Validate(); err != nil {
+		return nil, err
+	}
+	if query.Serial != 0 {
+		return l.lookupSerial(ctx, query)
+	}
+
+	conditions := []string{fmt.Sprintf("PartitionKey eq '%s'", partitionKey(query.Requester))}
+	if !query.From.IsZero() {
+		conditions = append(conditions, fmt.Sprintf("IssuedAt ge datetime'%s'", query.From.UTC().Format(time.RFC3339)))
+	}
+	if !query.To.IsZero() {
+		conditions = append(conditions, fmt.Sprintf("IssuedAt le datetime'%s'", query.To.UTC().Format(time.RFC3339)))
+	}
+
+	// Table Storage returns entities in key order, so read every page of the requester's
+	// partition before sorting
+	records := []ledger.Record{}
+	result, err := l.table.QueryEntities(tableTimeout, storage.FullMetadata, &storage.QueryOptions{
+		Filter: strings.Join(conditions, " and "),
+	})
+	for {
+		if err != nil {
+			return nil, err
+		}
+		for _, entity := range result.Entities {
+			records = append(records, entityRecord(entity))
+		}
+		if result.NextLink == nil || ctx.Err() != nil {
+			break
+		}
+		result, err = result.NextResults(nil)
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].IssuedAt.After(records[j].IssuedAt)
+	})
+	if len(records) > query.Limit {
+		records = records[:query.Limit]
+	}
+	return records, nil
+}
+
+// lookupSerial reads the single entity for a serial, from the requester's partition if one
+// was given, otherwise from the serial partition
+func (l *Ledger) lookupSerial(ctx context.Context, query ledger.Query) ([]ledger.Record, error) {
+	partition := serialPartition
+	if query.Requester != "" {
+		partition = partitionKey(query.Requester)
+	}
+	entity := l.table.GetEntityReference(partition, strconv.FormatUint(query.Serial, 10))
+	err := entity.Get(tableTimeout, storage.FullMetadata, nil)
+	if isStatus(err, http.StatusNotFound) {
+		return []ledger.Record{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	record := entityRecord(entity)
+	if (!query.From.IsZero() && record.IssuedAt.Before(query.From)) || (!query.To.IsZero() && record.IssuedAt.After(query.To)) {
+		return []ledger.Record{}, nil
+	}
+	return []ledger.Record{record}, nil
+}
+
+// entityRecord converts an entity read from Table Storage into a Record
+func entityRecord(entity *storage.Entity) ledger.Record {
+	serial, _ := strconv.ParseUint(entity.RowKey, 10, 64)
+	stringProperty := func(name string) string {
+		value, _ := entity.Properties[name].(string)
+		return value
+	}
+	return ledger.Record{
+		Serial:      serial,
+		KeyID:       stringProperty("KeyID"),
+		Principals:  strings.Split(stringProperty("Principals"), ","),
+		Fingerprint: stringProperty("Fingerprint"),
+		ValidAfter:  timeProperty(entity.Properties["ValidAfter"]),
+		ValidBefore: timeProperty(entity.Properties["ValidBefore"]),
+		IssuedAt:    timeProperty(entity.Properties["IssuedAt"]),
+		RequestID:   stringProperty("RequestID"),
+		Requester:   stringProperty("Requester"),
+		RequesterID: stringProperty("RequesterID"),
+		ClientIP:    stringProperty("ClientIP"),
+	}
+}
+
+// timeProperty converts a time read from Table Storage, which is decoded from JSON
+func timeProperty(value interface{}) time.Time {
+	switch v := value.(type) {
+	case time.Time:
+		return v.UTC()
+	case string:
+		t, _ := time.Parse(time.RFC3339Nano, v)
+		return t.UTC()
+	default:
+		return time.Time{}
+	}
+}
+
+// partitionKey encodes the requester, as principal names may contain characters not
+// allowed in partition keys and are matched case insensitively
+func partitionKey(requester string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strings.ToLower(requester)))
+}
+
+// isStatus reports whether err is a Table Storage error with the status code specified
+func isStatus(err error, statusCode int) bool {
+	var storageErr storage.AzureStorageServiceError
+	return errors.As(err, &storageErr) && storageErr.StatusCode == statusCode
+}
@@ -0,0 +1,66 @@
+package table
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/thalesgroup/sshizzle/internal/ledger"
+)
+
+// TestLedger runs against the storage account in SSHIZZLE_TEST_STORAGE_CONNECTION_STRING, such
+// as "UseDevelopmentStorage=true" for a local Azurite emulator
+func TestLedger(t *testing.T) {
+	connectionString := os.Getenv("SSHIZZLE_TEST_STORAGE_CONNECTION_STRING")
+	if connectionString == "" {
+		t.Skip("SSHIZZLE_TEST_STORAGE_CONNECTION_STRING not set")
+	}
+	l, err := NewLedger(connectionString, "sshizzleledgertest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Serials are unique, so use new ones each run
+	ctx := context.Background()
+	base := uint64(time.Now().UnixNano())
+	issuedAt := time.Now().UTC().Truncate(time.Second)
+	alice := "alice" + time.Now().Format("150405.000000000") + "@example.com"
+	records := []ledger.Record{
+		{Serial: base, KeyID: "old", Principals: []string{"alice"}, Requester: alice, IssuedAt: issuedAt.Add(-time.Hour)},
+		{Serial: base + 1, KeyID: "new", Principals: []string{"alice", "admins"}, Requester: alice, IssuedAt: issuedAt},
+	}
+	if err := l.Record(ctx, records); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		query  ledger.Query
+		keyIDs []string
+	}{
+		{"serial", ledger.Query{Serial: base + 1}, []string{"new"}},
+		{"serial and requester", ledger.Query{Serial: base + 1, Requester: alice}, []string{"new"}},
+		{"serial outside window", ledger.Query{Serial: base, From: issuedAt.Add(-time.Minute)}, nil},
+		{"unknown serial", ledger.Query{Serial: base + 2}, nil},
+		{"serial for another requester", ledger.Query{Serial: base, Requester: "bob@example.com"}, nil},
+		{"requester, newest first", ledger.Query{Requester: alice}, []string{"new", "old"}},
+		{"requester with limit", ledger.Query{Requester: alice, Limit: 1}, []string{"new"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			found, err := l.Lookup(ctx, test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(found) != len(test.keyIDs) {
+				t.Fatalf("found %d records, expected %d", len(found), len(test.keyIDs))
+			}
+			for i, record := range found {
+				if record.KeyID != test.keyIDs[i] {
+					t.Errorf("record %d is %s, expected %s", i, record.KeyID, test.keyIDs[i])
+				}
+			}
+		})
+	}
+}
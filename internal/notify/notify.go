@@ -0,0 +1,292 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"time"
+)
+
+// Types of event sent to webhooks
+const (
+	EventIssued     = "issued"
+	EventDenied     = "denied"
+	EventBreakGlass = "break_glass"
+	EventPending    = "pending"
+)
+
+// Payload formats supported by webhooks
+const (
+	FormatJSON  = "json"
+	FormatSlack = "slack"
+	FormatTeams = "teams"
+)
+
+// Number of events that can wait to be delivered before new events are dropped
+const queueSize = 256
+
+// Timeout for each attempt to deliver an event to a webhook
+const deliveryTimeout = 10 * time.Second
+
+// Number of attempts to deliver an event to a webhook before giving up
+const deliveryAttempts = 3
+
+// retryDelay is how long to wait before the second attempt to deliver an event, and is
+// increased for each later attempt. It's a variable so tests can shorten it
+var retryDelay = time.Second
+
+// Event describes a certificate being issued, or a request being denied or waiting for
+// approval by the CA
+type Event struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	// Requester is the Azure AD principal that made the request
+	Requester string `json:"requester"`
+	ClientIP  string `json:"client_ip"`
+	// Principals the certificates were issued for, or would have been if the request was denied
+	Principals []string `json:"principals"`
+	// Serials of the certificates issued
+	Serials []uint64 `json:"serials,omitempty"`
+	// Reason the request was denied, or a break-glass certificate was needed
+	Reason string `json:"reason,omitempty"`
+	// ApprovalID of a request waiting for approval
+	ApprovalID string `json:"approval_id,omitempty"`
+	// Justification given by the requester, such as a change ticket
+	Justification string `json:"justification,omitempty"`
+}
+
+// Webhook is an endpoint that receives events matching its filters
+type Webhook struct {
+	URL string `json:"url"`
+	// Format of the payload, "json" (default), "slack" or "teams"
+	Format string `json:"format"`
+	// Events to send, "issued", "denied", "break_glass" and/or "pending". All events are sent
+	// if empty
+	Events []string `json:"events"`
+	// Principals and Requesters are glob patterns, such as "admin*", matched against the
+	// event. Events for any principal or requester are sent if empty
+	Principals []string `json:"principals"`
+	Requesters []string `json:"requesters"`
+}
+
+// Notifier delivers events to webhooks in the background, so requests to the CA aren't
+// held up by slow or unavailable webhooks
+type Notifier struct {
+	webhooks []Webhook
+	client   *http.Client
+	queue    chan *Event
+	done     chan struct{}
+}
+
+// ParseWebhooks parses a JSON array of webhooks, checking each is valid
+func ParseWebhooks(value string) ([]Webhook, error) {
+	var webhooks []Webhook
+	if err := json.Unmarshal([]byte(value), &webhooks); err != nil {
+		return nil, fmt.Errorf("invalid webhooks: %s", err.Error())
+	}
+	for i, webhook := range webhooks {
+		if webhook.URL == "" {
+			return nil, fmt.Errorf("webhook %d has no url", i)
+		}
+		switch webhook.Format {
+		case "":
+			webhooks[i].Format = FormatJSON
+		case FormatJSON, FormatSlack, FormatTeams:
+		default:
+			return nil, fmt.Errorf("webhook %d has invalid format '%s', must be 'json', 'slack' or 'teams'", i, webhook.Format)
+		}
+		for _, event := range webhook.Events {
+			if event != EventIssued && event != EventDenied && event != EventBreakGlass && event != EventPending {
+				return nil, fmt.Errorf("webhook %d has invalid event '%s', must be 'issued', 'denied', 'break_glass' or 'pending'", i, event)
+			}
+		}
+		for _, pattern := range append(webhook.Principals, webhook.Requesters...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("webhook %d has invalid pattern '%s'", i, pattern)
+			}
+		}
+	}
+	return webhooks, nil
+}
+
+// NewNotifier returns a Notifier for the webhooks, and starts delivering events
+func NewNotifier(webhooks []Webhook) *Notifier {
+	n := &Notifier{
+		webhooks: webhooks,
+		client:   &http.Client{Timeout: deliveryTimeout},
+		queue:    make(chan *Event, queueSize),
+		done:     make(chan struct{}),
+	}
+	go n.run()
+	return n
+}
+
+// Notify queues the event for delivery to any matching webhooks. If the queue is full the
+// event is dropped and logged rather than waiting
+func (n *Notifier) Notify(event *Event) {
+	if n == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	select {
+	case n.queue <- event:
+	default:
+		log.Printf("notification queue full, dropping %s event for request %s\n", event.Type, event.RequestID)
+	}
+}
+
+// Close stops accepting events and waits for those already queued to be delivered, or for
+// the context to be cancelled
+func (n *Notifier) Close(ctx context.Context) {
+	if n == nil {
+		return
+	}
+	close(n.queue)
+	select {
+	case <-n.done:
+	case <-ctx.Done():
+	}
+}
+
+// run delivers queued events until the queue is closed
+func (n *Notifier) run() {
+	defer close(n.done)
+	for event := range n.queue {
+		for _, webhook := range n.webhooks {
+			if !webhook.Matches(event) {
+				continue
+			}
+			if err := n.deliver(webhook, event); err != nil {
+				log.Printf("error sending %s event for request %s to webhook: %s\n", event.Type, event.RequestID, err.Error())
+			}
+		}
+	}
+}
+
+// deliver sends the event to the webhook, retrying a few times if it fails
+func (n *Notifier) deliver(webhook Webhook, event *Event) error {
+	payload, err := json.Marshal(webhook.payload(event))
+	if err != nil {
+		return err
+	}
+	for attempt := 1; ; attempt++ {
+		err = n.post(webhook.URL, payload)
+		if err == nil || attempt >= deliveryAttempts {
+			return err
+		}
+		time.Sleep(time.Duration(attempt) * retryDelay)
+	}
+}
+
+// post makes a single request to the webhook
+func (n *Notifier) post(url string, payload []byte) error {
+	response, err := n.client.Post(url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, response.Body)
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("webhook returned HTTP %d", response.StatusCode)
+	}
+	return nil
+}
+
+// Matches reports whether the event passes the webhook's filters
+func (w Webhook) Matches(event *Event) bool {
+	if len(w.Events) > 0 && !contains(w.Events, event.Type) {
+		return false
+	}
+	// Everyone should hear about break-glass certificates, whoever they're for
+	if event.Type == EventBreakGlass {
+		return true
+	}
+	if len(w.Requesters) > 0 && !matchAny(w.Requesters, []string{event.Requester}) {
+		return false
+	}
+	if len(w.Principals) > 0 && !matchAny(w.Principals, event.Principals) {
+		return false
+	}
+	return true
+}
+
+// payload returns the body to send to the webhook in its format
+func (w Webhook) payload(event *Event) interface{} {
+	switch w.Format {
+	case FormatSlack:
+		return map[string]string{
+			"text": event.Summary(),
+		}
+	case FormatTeams:
+		color := "D40E0D"
+		switch event.Type {
+		case EventIssued:
+			color = "2EB886"
+		case EventPending:
+			color = "F2C744"
+		}
+		return map[string]string{
+			"@type":      "MessageCard",
+			"@context":   "http://schema.org/extensions",
+			"themeColor": color,
+			"summary":    event.Summary(),
+			"title":      "sshizzle certificate " + event.Type,
+			"text":       event.Summary(),
+		}
+	default:
+		return event
+	}
+}
+
+// Summary describes the event in a sentence for chat messages
+func (e *Event) Summary() string {
+	if e.Type == EventBreakGlass {
+		return fmt.Sprintf("BREAK-GLASS SSH certificate issued from %s for %v, serials %v, approved by %s: %s (request %s)",
+			e.ClientIP, e.Principals, e.Serials, e.Requester, e.Reason, e.RequestID)
+	}
+	justified := ""
+	if e.Justification != "" {
+		justified = fmt.Sprintf(" with justification %q", e.Justification)
+	}
+	if e.Type == EventPending {
+		return fmt.Sprintf("SSH certificate request by %s from %s for %v%s is waiting for approval, approve it with: sshizzle-approve -approve %s",
+			e.Requester, e.ClientIP, e.Principals, justified, e.ApprovalID)
+	}
+	if e.Type == EventDenied {
+		return fmt.Sprintf("SSH certificate request by %s from %s for %v denied: %s (request %s)",
+			e.Requester, e.ClientIP, e.Principals, e.Reason, e.RequestID)
+	}
+	return fmt.Sprintf("SSH certificate issued to %s from %s for %v%s, serials %v (request %s)",
+		e.Requester, e.ClientIP, e.Principals, justified, e.Serials, e.RequestID)
+}
+
+// contains reports whether value is in values
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAny reports whether any of the values match any of the glob patterns
+func matchAny(patterns []string, values []string) bool {
+	for _, pattern := range patterns {
+		for _, value := range values {
+			if matched, _ := path.Match(pattern, value); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
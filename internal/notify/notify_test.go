@@ -0,0 +1,259 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseWebhooks(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected []Webhook
+		err      string
+	}{
+		{
+			name:     "defaults to JSON",
+			value:    `[{"url": "https://example.com/hook"}]`,
+			expected: []Webhook{{URL: "https://example.com/hook", Format: FormatJSON}},
+		},
+		{
+			name:  "filters",
+			value: `[{"url": "https://hooks.slack.com/x", "format": "slack", "events": ["denied", "break_glass"], "principals": ["admin*"], "requesters": ["*@example.com"]}]`,
+			expected: []Webhook{{
+				URL:        "https://hooks.slack.com/x",
+				Format:     FormatSlack,
+				Events:     []string{EventDenied, EventBreakGlass},
+				Principals: []string{"admin*"},
+				Requesters: []string{"*@example.com"},
+			}},
+		},
+		{name: "none", value: `[]`, expected: []Webhook{}},
+		{name: "invalid JSON", value: `{"url": "https://example.com/hook"}`, err: "invalid webhooks"},
+		{name: "no url", value: `[{"format": "teams"}]`, err: "webhook 0 has no url"},
+		{name: "invalid format", value: `[{"url": "https://example.com/hook"}, {"url": "https://example.com/hook", "format": "xml"}]`, err: "webhook 1 has invalid format 'xml'"},
+		{name: "invalid event", value: `[{"url": "https://example.com/hook", "events": ["revoked"]}]`, err: "invalid event 'revoked'"},
+		{name: "invalid principal pattern", value: `[{"url": "https://example.com/hook", "principals": ["admin["]}]`, err: "invalid pattern 'admin['"},
+		{name: "invalid requester pattern", value: `[{"url": "https://example.com/hook", "requesters": ["[a-"]}]`, err: "invalid pattern '[a-'"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			webhooks, err := ParseWebhooks(test.value)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(webhooks, test.expected) {
+				t.Errorf("got %+v, expected %+v", webhooks, test.expected)
+			}
+		})
+	}
+}
+
+func TestMatches(t *testing.T) {
+	issued := &Event{Type: EventIssued, Requester: "alice@example.com", Principals: []string{"alice", "admin-web"}}
+	breakGlass := &Event{Type: EventBreakGlass, Requester: "bob@example.com", Principals: []string{"sshizzle-breakglass"}}
+
+	tests := []struct {
+		name     string
+		webhook  Webhook
+		event    *Event
+		expected bool
+	}{
+		{name: "no filters", webhook: Webhook{}, event: issued, expected: true},
+		{name: "event type", webhook: Webhook{Events: []string{EventIssued}}, event: issued, expected: true},
+		{name: "other event type", webhook: Webhook{Events: []string{EventDenied}}, event: issued, expected: false},
+		{name: "any principal", webhook: Webhook{Principals: []string{"root", "admin-*"}}, event: issued, expected: true},
+		{name: "no principal", webhook: Webhook{Principals: []string{"root"}}, event: issued, expected: false},
+		{name: "requester", webhook: Webhook{Requesters: []string{"*@example.com"}}, event: issued, expected: true},
+		{name: "other requester", webhook: Webhook{Requesters: []string{"*@contoso.com"}}, event: issued, expected: false},
+		{name: "requester and principal", webhook: Webhook{Requesters: []string{"alice@*"}, Principals: []string{"root"}}, event: issued, expected: false},
+		{name: "break-glass ignores principals", webhook: Webhook{Principals: []string{"root"}}, event: breakGlass, expected: true},
+		{name: "break-glass ignores requesters", webhook: Webhook{Requesters: []string{"*@contoso.com"}}, event: breakGlass, expected: true},
+		{name: "break-glass filtered by event type", webhook: Webhook{Events: []string{EventIssued, EventDenied}}, event: breakGlass, expected: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.webhook.Matches(test.event) != test.expected {
+				t.Errorf("expected %t", test.expected)
+			}
+		})
+	}
+}
+
+func TestPayload(t *testing.T) {
+	event := &Event{
+		Type:          EventIssued,
+		RequestID:     "request-id",
+		Requester:     "alice@example.com",
+		ClientIP:      "203.0.113.5",
+		Principals:    []string{"alice"},
+		Serials:       []uint64{42},
+		Justification: "CHG-1",
+	}
+	summary := `SSH certificate issued to alice@example.com from 203.0.113.5 for [alice] with justification "CHG-1", serials [42] (request request-id)`
+	if event.Summary() != summary {
+		t.Fatalf("got summary %q, expected %q", event.Summary(), summary)
+	}
+
+	if payload := (Webhook{Format: FormatJSON}).payload(event); payload != event {
+		t.Errorf("expected the event as the JSON payload, got %+v", payload)
+	}
+	slack := (Webhook{Format: FormatSlack}).payload(event)
+	if !reflect.DeepEqual(slack, map[string]string{"text": summary}) {
+		t.Errorf("unexpected Slack payload %+v", slack)
+	}
+
+	colors := map[string]string{EventIssued: "2EB886", EventPending: "F2C744", EventDenied: "D40E0D", EventBreakGlass: "D40E0D"}
+	for eventType, color := range colors {
+		event := &Event{Type: eventType, Requester: "alice@example.com"}
+		teams, ok := (Webhook{Format: FormatTeams}).payload(event).(map[string]string)
+		if !ok {
+			t.Fatalf("unexpected Teams payload for %s", eventType)
+		}
+		expected := map[string]string{
+			"@type":      "MessageCard",
+			"@context":   "http://schema.org/extensions",
+			"themeColor": color,
+			"summary":    event.Summary(),
+			"title":      "sshizzle certificate " + eventType,
+			"text":       event.Summary(),
+		}
+		if !reflect.DeepEqual(teams, expected) {
+			t.Errorf("got Teams payload %+v for %s, expected %+v", teams, eventType, expected)
+		}
+	}
+}
+
+func TestSummary(t *testing.T) {
+	tests := []struct {
+		name     string
+		event    *Event
+		expected string
+	}{
+		{
+			name:     "denied",
+			event:    &Event{Type: EventDenied, RequestID: "r", Requester: "alice", ClientIP: "203.0.113.5", Principals: []string{"root"}, Reason: "policy"},
+			expected: "SSH certificate request by alice from 203.0.113.5 for [root] denied: policy (request r)",
+		},
+		{
+			name:     "pending",
+			event:    &Event{Type: EventPending, Requester: "alice", ClientIP: "203.0.113.5", Principals: []string{"root"}, ApprovalID: "a"},
+			expected: "SSH certificate request by alice from 203.0.113.5 for [root] is waiting for approval, approve it with: sshizzle-approve -approve a",
+		},
+		{
+			name:     "break-glass",
+			event:    &Event{Type: EventBreakGlass, RequestID: "r", Requester: "bob", ClientIP: "203.0.113.5", Principals: []string{"sshizzle-breakglass"}, Serials: []uint64{7}, Reason: "outage"},
+			expected: "BREAK-GLASS SSH certificate issued from 203.0.113.5 for [sshizzle-breakglass], serials [7], approved by bob: outage (request r)",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if summary := test.event.Summary(); summary != test.expected {
+				t.Errorf("got %q, expected %q", summary, test.expected)
+			}
+		})
+	}
+}
+
+// fakeWebhook records the payloads posted to it, failing the first requests
+type fakeWebhook struct {
+	mu       sync.Mutex
+	failures int
+	attempts int
+	payloads []map[string]interface{}
+}
+
+func (h *fakeWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.attempts++
+	if h.attempts <= h.failures {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	var payload map[string]interface{}
+	if r.Header.Get("Content-Type") != "application/json" || json.Unmarshal(body, &payload) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	h.payloads = append(h.payloads, payload)
+}
+
+// newFakeWebhook returns a webhook that fails the first requests, and its URL
+func newFakeWebhook(t *testing.T, failures int) (*fakeWebhook, string) {
+	t.Helper()
+	h := &fakeWebhook{failures: failures}
+	server := httptest.NewServer(h)
+	t.Cleanup(server.Close)
+	return h, server.URL
+}
+
+func TestNotifier(t *testing.T) {
+	original := retryDelay
+	retryDelay = time.Millisecond
+	defer func() { retryDelay = original }()
+
+	all, allURL := newFakeWebhook(t, 0)
+	denied, deniedURL := newFakeWebhook(t, 0)
+	flaky, flakyURL := newFakeWebhook(t, deliveryAttempts-1)
+	down, downURL := newFakeWebhook(t, 100)
+	slack, slackURL := newFakeWebhook(t, 0)
+
+	notifier := NewNotifier([]Webhook{
+		{URL: allURL, Format: FormatJSON},
+		{URL: deniedURL, Format: FormatJSON, Events: []string{EventDenied}},
+		{URL: flakyURL, Format: FormatJSON, Events: []string{EventIssued}},
+		{URL: downURL, Format: FormatJSON, Events: []string{EventIssued}},
+		{URL: slackURL, Format: FormatSlack, Events: []string{EventIssued}},
+	})
+	notifier.Notify(&Event{Type: EventIssued, RequestID: "first", Requester: "alice", Principals: []string{"alice"}})
+	notifier.Notify(&Event{Type: EventDenied, RequestID: "second", Requester: "mallory", Principals: []string{"root"}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	notifier.Close(ctx)
+	if ctx.Err() != nil {
+		t.Fatal("events weren't delivered before the timeout")
+	}
+
+	if len(all.payloads) != 2 || all.payloads[0]["request_id"] != "first" || all.payloads[1]["request_id"] != "second" {
+		t.Errorf("expected both events in order, got %v", all.payloads)
+	}
+	if ts, _ := all.payloads[0]["time"].(string); ts == "" || strings.HasPrefix(ts, "0001") {
+		t.Errorf("event time wasn't set, got %v", all.payloads[0]["time"])
+	}
+	if len(denied.payloads) != 1 || denied.payloads[0]["request_id"] != "second" {
+		t.Errorf("expected only the denied event, got %v", denied.payloads)
+	}
+	// Failed deliveries are retried, then given up on
+	if flaky.attempts != deliveryAttempts || len(flaky.payloads) != 1 {
+		t.Errorf("expected the event to be delivered on attempt %d, got %d attempts and %v", deliveryAttempts, flaky.attempts, flaky.payloads)
+	}
+	if down.attempts != deliveryAttempts || len(down.payloads) != 0 {
+		t.Errorf("expected %d attempts, got %d", deliveryAttempts, down.attempts)
+	}
+	if len(slack.payloads) != 1 || !strings.HasPrefix(slack.payloads[0]["text"].(string), "SSH certificate issued to alice") {
+		t.Errorf("unexpected Slack payloads %v", slack.payloads)
+	}
+}
+
+func TestNilNotifier(t *testing.T) {
+	var notifier *Notifier
+	notifier.Notify(&Event{Type: EventIssued})
+	notifier.Close(context.Background())
+}
@@ -0,0 +1,89 @@
+package oidc
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+// dexSetting returns the environment variable given, or the value in Dex's example config
+func dexSetting(name string, example string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return example
+}
+
+// TestDex signs in to a Dex server with the password grant, and verifies the ID token it issues.
+// It's skipped unless SSHIZZLE_TEST_DEX_ISSUER is set to the issuer of a Dex server with a static
+// password user and oauth2.passwordConnector set to local
+func TestDex(t *testing.T) {
+	issuer := os.Getenv("SSHIZZLE_TEST_DEX_ISSUER")
+	if issuer == "" {
+		t.Skip("SSHIZZLE_TEST_DEX_ISSUER is not set")
+	}
+	clientID := dexSetting("SSHIZZLE_TEST_DEX_CLIENT_ID", "example-app")
+	username := dexSetting("SSHIZZLE_TEST_DEX_USERNAME", "admin@example.com")
+
+	ctx := context.Background()
+	provider, err := Discover(ctx, issuer)
+	if err != nil {
+		t.Fatalf("failed to discover Dex: %s", err)
+	}
+	config := &oauth2.Config{
+		ClientID:     clientID,
+		ClientSecret: dexSetting("SSHIZZLE_TEST_DEX_CLIENT_SECRET", "ZXhhbXBsZS1hcHAtc2VjcmV0"),
+		Endpoint:     provider.Endpoint(),
+		Scopes:       []string{"openid", "profile", "email", "groups", "offline_access"},
+	}
+	token, err := config.PasswordCredentialsToken(ctx, username, dexSetting("SSHIZZLE_TEST_DEX_PASSWORD", "password"))
+	if err != nil {
+		t.Fatalf("failed to sign in to Dex: %s", err)
+	}
+	idToken, err := IDTokenSource(ctx, config, token).Token()
+	if err != nil {
+		t.Fatalf("failed to get ID token: %s", err)
+	}
+
+	tests := []struct {
+		name          string
+		usernameClaim string
+		audience      string
+		username      string
+		err           bool
+	}{
+		// Dex's static passwords have verified email addresses
+		{name: "email", usernameClaim: "email", audience: clientID, username: username},
+		{name: "name", usernameClaim: "name", audience: clientID},
+		{name: "different client", usernameClaim: "email", audience: "other", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			verifier := NewVerifier(provider, test.audience, test.usernameClaim, "groups")
+			identity, err := verifier.Verify(ctx, idToken.AccessToken)
+			if test.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !identity.EmailVerified {
+				t.Error("expected the email address to be verified")
+			}
+			if test.username != "" && identity.Username != test.username {
+				t.Errorf("got username %s, expected %s", identity.Username, test.username)
+			}
+		})
+	}
+
+	// A tampered token must not verify
+	verifier := NewVerifier(provider, clientID, "email", "groups")
+	if _, err := verifier.Verify(ctx, idToken.AccessToken+"x"); err == nil {
+		t.Error("expected tampered token to fail verification")
+	}
+}
@@ -0,0 +1,151 @@
+package oidc
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// Timeout for requests to the identity provider
+const RequestTimeout = 10 * time.Second
+
+// expiryLeeway is how long before an ID token expires that it's replaced
+const expiryLeeway = time.Minute
+
+// Provider is the configuration of an OpenID Connect provider, from its discovery document
+type Provider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Discover fetches the discovery document of the provider with the issuer URL given, such as
+// https://dex.example.com or https://keycloak.example.com/realms/example
+func Discover(ctx context.Context, issuer string) (*Provider, error) {
+	issuer = strings.TrimSuffix(issuer, "/")
+	ctx, cancel := context.WithTimeout(ctx, RequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OIDC issuer '%s': %s", issuer, err.Error())
+	}
+	var provider Provider
+	if err := getJSON(req, &provider); err != nil {
+		return nil, fmt.Errorf("error discovering OIDC provider %s: %s", issuer, err.Error())
+	}
+	// Tokens are only trusted if they come from the issuer that was configured
+	if strings.TrimSuffix(provider.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("OIDC provider %s has a different issuer, %s", issuer, provider.Issuer)
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JWKSURI == "" {
+		return nil, fmt.Errorf("OIDC provider %s is missing endpoints", issuer)
+	}
+	return &provider, nil
+}
+
+// Endpoint returns the OAuth 2.0 endpoints of the provider
+func (p *Provider) Endpoint() oauth2.Endpoint {
+	return oauth2.Endpoint{
+		AuthURL:  p.AuthorizationEndpoint,
+		TokenURL: p.TokenEndpoint,
+	}
+}
+
+// getJSON makes a request, decoding the JSON response into out
+func getJSON(req *http.Request, out interface{}) error {
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %d", req.URL.String(), res.StatusCode)
+	}
+	return json.Unmarshal(body, out)
+}
+
+// IDTokenSource returns a token source for the ID tokens of the user signed in with token,
+// rather than access tokens, for providers whose access tokens aren't meant for sshizzle-ca.
+// The ID tokens are returned as bearer tokens, and the refresh token is used to get a new
+// one when the one in token is missing or expires
+func IDTokenSource(ctx context.Context, config *oauth2.Config, token *oauth2.Token) oauth2.TokenSource {
+	return oauth2.ReuseTokenSource(nil, &idTokenSource{ctx: ctx, config: config, token: token})
+}
+
+type idTokenSource struct {
+	ctx    context.Context
+	config *oauth2.Config
+
+	mu    sync.Mutex
+	token *oauth2.Token
+}
+
+// Token returns the current ID token, refreshing it if needed
+func (s *idTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if idToken, err := bearer(s.token); err == nil && idToken.Expiry.After(time.Now().Add(expiryLeeway)) {
+		return idToken, nil
+	}
+	if s.token.RefreshToken == "" {
+		return nil, errors.New("no refresh token to get a new ID token with, sign in again")
+	}
+	// The ID token isn't kept in the token cache, so force a refresh whatever the access token's expiry
+	token, err := s.config.TokenSource(s.ctx, &oauth2.Token{RefreshToken: s.token.RefreshToken}).Token()
+	if err != nil {
+		return nil, err
+	}
+	s.token = token
+	return bearer(token)
+}
+
+// bearer returns the ID token from an OAuth 2.0 token response as a bearer token
+func bearer(token *oauth2.Token) (*oauth2.Token, error) {
+	idToken, ok := token.Extra("id_token").(string)
+	if !ok || idToken == "" {
+		return nil, errors.New("token response doesn't contain an ID token")
+	}
+	expiry, err := unverifiedExpiry(idToken)
+	if err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{
+		AccessToken:  idToken,
+		TokenType:    "Bearer",
+		RefreshToken: token.RefreshToken,
+		Expiry:       expiry,
+	}, nil
+}
+
+// unverifiedExpiry reads the expiry of a JWT without verifying it, which is left to the CA
+func unverifiedExpiry(token string) (time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, errors.New("ID token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, errors.New("failed to decode ID token")
+	}
+	var claims struct {
+		Expiry int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Expiry == 0 {
+		return time.Time{}, errors.New("ID token doesn't have an expiry")
+	}
+	return time.Unix(claims.Expiry, 0), nil
+}
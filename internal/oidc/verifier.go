@@ -0,0 +1,244 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// KeysTTL is how long the provider's signing keys are cached. Unknown keys are fetched sooner,
+// at most once every keysRefetch, so rotated keys are picked up
+const KeysTTL = time.Hour
+
+const keysRefetch = time.Minute
+
+// signingMethods are the algorithms accepted for ID tokens
+var signingMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// Identity is the user an ID token was issued to
+type Identity struct {
+	// Subject uniquely identifies the user at the provider
+	Subject string
+	// Username is the value of the configured username claim
+	Username string
+	// Groups are the values of the configured groups claim
+	Groups []string
+	// EmailVerified is true if the provider has verified the user owns the email claim
+	EmailVerified bool
+	// Claims are the claims in the ID token with string values, or lists of strings
+	Claims map[string][]string
+}
+
+// Verifier checks ID tokens issued by a provider for a client
+type Verifier struct {
+	provider      *Provider
+	audience      string
+	usernameClaim string
+	groupsClaim   string
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+// NewVerifier returns a Verifier for ID tokens from provider for the client ID audience, taking the
+// username and groups from the claims given, e.g. "email" and "groups"
+func NewVerifier(provider *Provider, audience string, usernameClaim string, groupsClaim string) *Verifier {
+	return &Verifier{
+		provider:      provider,
+		audience:      audience,
+		usernameClaim: usernameClaim,
+		groupsClaim:   groupsClaim,
+	}
+}
+
+// Verify checks the signature, issuer, audience and expiry of an ID token, returning the user
+// it was issued to. If the username claim is email, the provider must have verified it, as
+// some let users sign up with any address
+func (v *Verifier) Verify(ctx context.Context, token string) (*Identity, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return v.key(ctx, kid)
+	}, jwt.WithValidMethods(signingMethods))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %s", err.Error())
+	}
+	if !claims.VerifyIssuer(v.provider.Issuer, true) {
+		return nil, errors.New("ID token is from a different issuer")
+	}
+	if !claims.VerifyAudience(v.audience, true) {
+		return nil, errors.New("ID token is for a different client")
+	}
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, errors.New("ID token has expired")
+	}
+
+	identity := &Identity{Claims: make(map[string][]string)}
+	for name, value := range claims {
+		switch value := value.(type) {
+		case string:
+			identity.Claims[name] = []string{value}
+		case []interface{}:
+			for _, item := range value {
+				if item, ok := item.(string); ok {
+					identity.Claims[name] = append(identity.Claims[name], item)
+				}
+			}
+		}
+	}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Username, _ = claims[v.usernameClaim].(string)
+	if identity.Subject == "" || identity.Username == "" {
+		return nil, fmt.Errorf("ID token doesn't have the sub and %s claims", v.usernameClaim)
+	}
+	// Some providers send email_verified as a string
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		identity.EmailVerified = verified
+	case string:
+		identity.EmailVerified = verified == "true"
+	}
+	if v.usernameClaim == "email" && !identity.EmailVerified {
+		return nil, fmt.Errorf("email address %s in the ID token isn't verified", identity.Username)
+	}
+	// Providers give a list of groups, or a single group as a string
+	identity.Groups = identity.Claims[v.groupsClaim]
+	return identity, nil
+}
+
+// InGroup returns true if the identity is in any of the groups, or there are no groups
+func (i *Identity) InGroup(groups []string) bool {
+	if len(groups) == 0 {
+		return true
+	}
+	for _, group := range groups {
+		for _, member := range i.Groups {
+			if member == group {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// key returns the provider's signing key with the ID given, fetching the keys if they're
+// older than KeysTTL or the key is unknown
+func (v *Verifier) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	key, ok := v.keys[kid]
+	if ok && time.Since(v.fetchedAt) < KeysTTL {
+		return key, nil
+	}
+	if !ok && time.Since(v.fetchedAt) < keysRefetch {
+		return nil, fmt.Errorf("unknown signing key '%s'", kid)
+	}
+	keys, err := v.fetchKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	v.keys = keys
+	v.fetchedAt = time.Now()
+	if key, ok = keys[kid]; !ok {
+		return nil, fmt.Errorf("unknown signing key '%s'", kid)
+	}
+	return key, nil
+}
+
+// jwk is a public key in a JSON Web Key Set
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetchKeys gets the provider's signing keys, ignoring any it doesn't support
+func (v *Verifier) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, RequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.provider.JWKSURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := getJSON(req, &set); err != nil {
+		return nil, fmt.Errorf("error fetching OIDC signing keys: %s", err.Error())
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+// publicKey decodes an RSA or EC key
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+// decodeInt decodes a base64url encoded big endian integer
+func decodeInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(data) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,145 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// newTestProvider serves a signing key at a fake provider's JWKS URI, returning the provider and
+// a function to issue ID tokens with the claims given
+func newTestProvider(t *testing.T) (*Provider, func(jwt.MapClaims) string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []jwk{{
+				Kty: "RSA",
+				Kid: "test",
+				Use: "sig",
+				N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	provider := &Provider{Issuer: "https://issuer.example.com", JWKSURI: server.URL}
+	issue := func(claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "test"
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	return provider, issue
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name          string
+		usernameClaim string
+		claims        jwt.MapClaims
+		username      string
+		emailVerified bool
+		err           string
+	}{
+		{
+			name:          "verified email",
+			usernameClaim: "email",
+			claims:        jwt.MapClaims{"email": "alice@example.com", "email_verified": true},
+			username:      "alice@example.com",
+			emailVerified: true,
+		},
+		{
+			name:          "verified email as a string",
+			usernameClaim: "email",
+			claims:        jwt.MapClaims{"email": "alice@example.com", "email_verified": "true"},
+			username:      "alice@example.com",
+			emailVerified: true,
+		},
+		{
+			name:          "unverified email",
+			usernameClaim: "email",
+			claims:        jwt.MapClaims{"email": "alice@example.com", "email_verified": false},
+			err:           "isn't verified",
+		},
+		{
+			name:          "email_verified missing",
+			usernameClaim: "email",
+			claims:        jwt.MapClaims{"email": "alice@example.com"},
+			err:           "isn't verified",
+		},
+		{
+			name:          "unverified email with another username claim",
+			usernameClaim: "preferred_username",
+			claims:        jwt.MapClaims{"preferred_username": "alice", "email": "alice@example.com", "email_verified": false},
+			username:      "alice",
+		},
+		{
+			name:          "username claim missing",
+			usernameClaim: "preferred_username",
+			claims:        jwt.MapClaims{},
+			err:           "doesn't have the sub and preferred_username claims",
+		},
+		{
+			name:          "different issuer",
+			usernameClaim: "email",
+			claims:        jwt.MapClaims{"iss": "https://other.example.com", "email": "alice@example.com", "email_verified": true},
+			err:           "different issuer",
+		},
+		{
+			name:          "different client",
+			usernameClaim: "email",
+			claims:        jwt.MapClaims{"aud": "other", "email": "alice@example.com", "email_verified": true},
+			err:           "different client",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider, issue := newTestProvider(t)
+			claims := jwt.MapClaims{
+				"iss": provider.Issuer,
+				"aud": "sshizzle",
+				"sub": "1234",
+				"exp": time.Now().Add(time.Hour).Unix(),
+			}
+			for name, value := range test.claims {
+				claims[name] = value
+			}
+
+			verifier := NewVerifier(provider, "sshizzle", test.usernameClaim, "groups")
+			identity, err := verifier.Verify(context.Background(), issue(claims))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if identity.Username != test.username {
+				t.Errorf("got username %s, expected %s", identity.Username, test.username)
+			}
+			if identity.EmailVerified != test.emailVerified {
+				t.Errorf("got email verified %t, expected %t", identity.EmailVerified, test.emailVerified)
+			}
+		})
+	}
+}
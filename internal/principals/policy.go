@@ -0,0 +1,148 @@
+package principals
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultPolicyFile is where sshizzle-host looks for the principals policy
+const DefaultPolicyFile = "/etc/ssh/sshizzle_policy"
+
+// AccountToken stands for the account's own name in a rule's principals
+const AccountToken = "%u"
+
+// Policy maps local accounts to the certificate principals that can log in as them. It's read
+// from a file of lines of the form:
+//
+//	# Groups of principals
+//	@admins = alice bob
+//	# Accounts, members of Unix groups (%group) or all accounts (*), and their principals,
+//	# where %u is the account's own name
+//	root: @admins
+//	%wheel: @admins carol
+//	*: %u oncall
+type Policy struct {
+	groups map[string][]string
+	rules  []rule
+}
+
+// rule gives principals access to the accounts matching a selector
+type rule struct {
+	selector   string
+	principals []string
+}
+
+// LoadPolicy reads a Policy from a file
+func LoadPolicy(path string) (*Policy, error) {
+	f, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return nil, fmt.Errorf("error reading principals policy: %s", err.Error())
+	}
+	// #nosec
+	defer f.Close()
+
+	p := &Policy{groups: make(map[string][]string)}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if i := strings.Index(text, "="); i >= 0 && strings.HasPrefix(text, "@") {
+			name := strings.TrimSpace(text[1:i])
+			if name == "" {
+				return nil, fmt.Errorf("line %d of principals policy has a group without a name", line)
+			}
+			if _, ok := p.groups[name]; ok {
+				return nil, fmt.Errorf("line %d of principals policy defines group @%s again", line, name)
+			}
+			members := strings.Fields(text[i+1:])
+			for _, member := range members {
+				if strings.HasPrefix(member, "@") {
+					return nil, fmt.Errorf("line %d of principals policy puts group %s in a group", line, member)
+				}
+			}
+			p.groups[name] = members
+			continue
+		}
+		i := strings.Index(text, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("line %d of principals policy must be '@group = principals...' or 'account: principals...'", line)
+		}
+		selector := strings.TrimSpace(text[:i])
+		if selector == "" || strings.ContainsAny(selector, " \t") {
+			return nil, fmt.Errorf("line %d of principals policy has an invalid account '%s'", line, selector)
+		}
+		p.rules = append(p.rules, rule{selector: selector, principals: strings.Fields(text[i+1:])})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading principals policy: %s", err.Error())
+	}
+
+	// Check every group used is defined, wherever it is in the file
+	for _, r := range p.rules {
+		for _, principal := range r.principals {
+			if strings.HasPrefix(principal, "@") {
+				if _, ok := p.groups[principal[1:]]; !ok {
+					return nil, fmt.Errorf("principals policy uses undefined group %s", principal)
+				}
+			}
+		}
+	}
+	return p, nil
+}
+
+// Principals returns the principals that can log in as the account, a member of the Unix
+// groups given. The account's own name is only included if a rule gives it with %u, or
+// accountName is true, so a certificate for a user's own principal doesn't log in to an account
+// of the same name that the policy doesn't give them
+func (p *Policy) Principals(account string, unixGroups []string, accountName bool) []string {
+	seen := make(map[string]bool)
+	principals := []string{}
+	add := func(principal string) {
+		if principal == AccountToken {
+			principal = account
+		}
+		if !seen[principal] {
+			seen[principal] = true
+			principals = append(principals, principal)
+		}
+	}
+	if accountName {
+		add(account)
+	}
+	for _, r := range p.rules {
+		if !r.matches(account, unixGroups) {
+			continue
+		}
+		for _, principal := range r.principals {
+			if strings.HasPrefix(principal, "@") {
+				for _, member := range p.groups[principal[1:]] {
+					add(member)
+				}
+				continue
+			}
+			add(principal)
+		}
+	}
+	return principals
+}
+
+// matches returns true if the rule applies to the account
+func (r *rule) matches(account string, unixGroups []string) bool {
+	switch {
+	case r.selector == "*":
+		return true
+	case strings.HasPrefix(r.selector, "%"):
+		for _, group := range unixGroups {
+			if group == r.selector[1:] {
+				return true
+			}
+		}
+		return false
+	}
+	return r.selector == account
+}
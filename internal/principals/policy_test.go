@@ -0,0 +1,49 @@
+package principals
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPrincipals(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sshizzle_policy")
+	policy := `
+@admins = alice bob
+root: @admins
+%wheel: @admins carol
+deploy: %u
+*: oncall
+`
+	if err := os.WriteFile(path, []byte(policy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := LoadPolicy(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	tests := []struct {
+		name        string
+		account     string
+		unixGroups  []string
+		accountName bool
+		expected    []string
+	}{
+		{name: "account rule", account: "root", expected: []string{"alice", "bob", "oncall"}},
+		{name: "group rule", account: "dave", unixGroups: []string{"wheel"}, expected: []string{"alice", "bob", "carol", "oncall"}},
+		{name: "account name not given by the policy", account: "alice", expected: []string{"oncall"}},
+		{name: "account name given by a rule", account: "deploy", expected: []string{"deploy", "oncall"}},
+		{name: "account name opted in", account: "alice", accountName: true, expected: []string{"alice", "oncall"}},
+		{name: "account name not repeated", account: "deploy", accountName: true, expected: []string{"deploy", "oncall"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			principals := p.Principals(test.account, test.unixGroups, test.accountName)
+			if !reflect.DeepEqual(principals, test.expected) {
+				t.Errorf("got principals %v, expected %v", principals, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps counters in memory. Each instance of the function has its own counters,
+// so limits are applied per instance rather than globally
+type MemoryStore struct {
+	mu       sync.Mutex
+	counters map[memoryKey]*memoryCounter
+}
+
+type memoryKey struct {
+	key    string
+	window int64
+}
+
+type memoryCounter struct {
+	count  int
+	expiry time.Time
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		counters: make(map[memoryKey]*memoryCounter),
+	}
+}
+
+// Increment adds one to the counter for key in the window, discarding expired counters
+func (s *MemoryStore) Increment(ctx context.Context, key string, window time.Time, expiry time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for k, counter := range s.counters {
+		if now.After(counter.expiry) {
+			delete(s.counters, k)
+		}
+	}
+
+	k := memoryKey{key: key, window: window.Unix()}
+	counter, exists := s.counters[k]
+	if !exists {
+		counter = &memoryCounter{expiry: expiry}
+		s.counters[k] = counter
+	}
+	counter.count++
+	return counter.count, nil
+}
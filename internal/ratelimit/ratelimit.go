@@ -0,0 +1,111 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Store persists request counters for a Limiter
+type Store interface {
+	// Increment adds one to the counter for key in the window starting at window, returning
+	// the new count. Counters can be discarded once expiry has passed
+	Increment(ctx context.Context, key string, window time.Time, expiry time.Time) (int, error)
+}
+
+// Limit is a maximum number of requests in a fixed window of time
+type Limit struct {
+	Requests int
+	Window   time.Duration
+}
+
+// ParseLimit parses a limit in the form "<requests>/<window>", such as "10/1m". An empty
+// string results in a zero Limit, which allows everything
+func ParseLimit(value string) (Limit, error) {
+	if value == "" {
+		return Limit{}, nil
+	}
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return Limit{}, fmt.Errorf("invalid rate limit '%s', must be in the form 10/1m", value)
+	}
+	requests, err := strconv.Atoi(parts[0])
+	if err != nil || requests < 1 {
+		return Limit{}, fmt.Errorf("invalid number of requests in rate limit '%s'", value)
+	}
+	window, err := time.ParseDuration(parts[1])
+	if err != nil || window < time.Second {
+		return Limit{}, fmt.Errorf("invalid window in rate limit '%s', must be at least 1s", value)
+	}
+	return Limit{Requests: requests, Window: window}, nil
+}
+
+// Enabled reports whether the limit restricts anything
+func (l Limit) Enabled() bool {
+	return l.Requests > 0 && l.Window > 0
+}
+
+// Limiter applies separate limits to the requests made by each principal and source IP, and
+// to the break-glass requests made from each source IP
+type Limiter struct {
+	store      Store
+	principal  Limit
+	ip         Limit
+	breakGlass Limit
+}
+
+// NewLimiter returns a Limiter backed by store
+func NewLimiter(store Store, principal Limit, ip Limit, breakGlass Limit) *Limiter {
+	return &Limiter{
+		store:      store,
+		principal:  principal,
+		ip:         ip,
+		breakGlass: breakGlass,
+	}
+}
+
+// Allow counts a request from the principal and IP. If either has exceeded its limit, false
+// is returned along with the time until the request would be allowed
+func (l *Limiter) Allow(ctx context.Context, principal string, ip string) (bool, time.Duration, error) {
+	if l == nil {
+		return true, 0, nil
+	}
+	if allowed, retryAfter, err := l.allow(ctx, "principal:"+principal, l.principal); err != nil || !allowed {
+		return allowed, retryAfter, err
+	}
+	return l.allow(ctx, "ip:"+ip, l.ip)
+}
+
+// AllowBreakGlass counts a break-glass request from the IP. Break-glass requests aren't made
+// by a signed in principal, and have their own budget so normal requests from the same IP
+// can't use it up. Without a break-glass limit the IP limit is used
+func (l *Limiter) AllowBreakGlass(ctx context.Context, ip string) (bool, time.Duration, error) {
+	if l == nil {
+		return true, 0, nil
+	}
+	limit := l.breakGlass
+	if !limit.Enabled() {
+		limit = l.ip
+	}
+	return l.allow(ctx, "break-glass-ip:"+ip, limit)
+}
+
+// allow counts a request against the key's counter for the current window
+func (l *Limiter) allow(ctx context.Context, key string, limit Limit) (bool, time.Duration, error) {
+	if !limit.Enabled() {
+		return true, 0, nil
+	}
+	now := time.Now()
+	window := now.Truncate(limit.Window)
+	expiry := window.Add(limit.Window)
+	count, err := l.store.Increment(ctx, key, window, expiry)
+	if err != nil {
+		return false, 0, fmt.Errorf("error updating rate limit for %s: %s", key, err.Error())
+	}
+	if count > limit.Requests {
+		return false, expiry.Sub(now), nil
+	}
+	return true, 0, nil
+}
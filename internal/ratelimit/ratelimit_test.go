@@ -0,0 +1,110 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		value string
+		limit Limit
+		valid bool
+	}{
+		{"", Limit{}, true},
+		{"10/1m", Limit{Requests: 10, Window: time.Minute}, true},
+		{"1/1s", Limit{Requests: 1, Window: time.Second}, true},
+		{"10", Limit{}, false},
+		{"0/1m", Limit{}, false},
+		{"ten/1m", Limit{}, false},
+		{"10/1ms", Limit{}, false},
+		{"10/forever", Limit{}, false},
+	}
+	for _, test := range tests {
+		limit, err := ParseLimit(test.value)
+		if test.valid != (err == nil) {
+			t.Errorf("ParseLimit(%q): unexpected error %v", test.value, err)
+		}
+		if limit != test.limit {
+			t.Errorf("ParseLimit(%q) = %+v, expected %+v", test.value, limit, test.limit)
+		}
+	}
+}
+
+// testLimiter checks the limits are applied separately to each principal, IP and break-glass
+// budget using store
+func testLimiter(t *testing.T, store Store) {
+	ctx := context.Background()
+	// Use a long window, so the test doesn't cross into the next one
+	limiter := NewLimiter(store, Limit{2, time.Hour}, Limit{3, time.Hour}, Limit{1, time.Hour})
+	suffix := time.Now().Format("150405.000000000")
+	alice, bob, carol, dave := "alice"+suffix, "bob"+suffix, "carol"+suffix, "dave"+suffix
+	ip, otherIP := "192.0.2.1#"+suffix, "192.0.2.2#"+suffix
+
+	steps := []struct {
+		name       string
+		breakGlass bool
+		principal  string
+		ip         string
+		allowed    bool
+	}{
+		{"first request", false, alice, ip, true},
+		{"second request", false, alice, ip, true},
+		{"over principal limit", false, alice, ip, false},
+		{"another principal from the same IP", false, bob, ip, true},
+		{"over IP limit", false, carol, ip, false},
+		{"another principal from another IP", false, carol, otherIP, true},
+		{"break-glass from IP used by normal requests", true, "", ip, true},
+		{"second break-glass from the same IP", true, "", ip, false},
+		{"break-glass from another IP", true, "", otherIP, true},
+		{"normal request after break-glass", false, dave, otherIP, true},
+	}
+	for _, step := range steps {
+		var allowed bool
+		var retryAfter time.Duration
+		var err error
+		if step.breakGlass {
+			allowed, retryAfter, err = limiter.AllowBreakGlass(ctx, step.ip)
+		} else {
+			allowed, retryAfter, err = limiter.Allow(ctx, step.principal, step.ip)
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", step.name, err)
+		}
+		if allowed != step.allowed {
+			t.Fatalf("%s: allowed = %t, expected %t", step.name, allowed, step.allowed)
+		}
+		if !allowed && (retryAfter <= 0 || retryAfter > time.Hour) {
+			t.Fatalf("%s: unexpected retry after %s", step.name, retryAfter)
+		}
+	}
+}
+
+func TestLimiterMemoryStore(t *testing.T) {
+	testLimiter(t, NewMemoryStore())
+}
+
+func TestBreakGlassDefaultsToIPLimit(t *testing.T) {
+	ctx := context.Background()
+	limiter := NewLimiter(NewMemoryStore(), Limit{}, Limit{1, time.Hour}, Limit{})
+	if allowed, _, _ := limiter.Allow(ctx, "alice", "192.0.2.1"); !allowed {
+		t.Fatal("first request denied")
+	}
+	if allowed, _, _ := limiter.AllowBreakGlass(ctx, "192.0.2.1"); !allowed {
+		t.Fatal("break-glass request denied by normal requests")
+	}
+	if allowed, _, _ := limiter.AllowBreakGlass(ctx, "192.0.2.1"); allowed {
+		t.Fatal("second break-glass request allowed over IP limit")
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	var limiter *Limiter
+	if allowed, _, err := limiter.Allow(context.Background(), "alice", "192.0.2.1"); !allowed || err != nil {
+		t.Fatal("nil limiter denied request")
+	}
+	if allowed, _, err := limiter.AllowBreakGlass(context.Background(), "192.0.2.1"); !allowed || err != nil {
+		t.Fatal("nil limiter denied break-glass request")
+	}
+}
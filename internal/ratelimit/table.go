@@ -0,0 +1,103 @@
+package ratelimit
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+// Number of attempts to update a counter when other instances are updating it concurrently
+const tableUpdateAttempts = 5
+
+// Timeout in seconds for each request to Table Storage
+const tableTimeout = 10
+
+// TableStore keeps counters in Azure Table Storage, so limits are shared between all
+// instances of the function. Each counter is an entity with the key as its partition key
+// and the start of the window as its row key
+type TableStore struct {
+	table *storage.Table
+}
+
+// NewTableStore returns a TableStore using the storage account in the connection string,
+// creating the table if required. Use "UseDevelopmentStorage=true" for the local emulator
+func NewTableStore(connectionString string, tableName string) (*TableStore, error) {
+	client, err := storage.NewClientFromConnectionString(connectionString)
+	if err != nil {
+		return nil, fmt.Errorf("error creating table storage client: %s", err.Error())
+	}
+	tableService := client.GetTableService()
+	table := tableService.GetTableReference(tableName)
+	if err := table.Create(tableTimeout, storage.EmptyPayload, nil); err != nil && !isStatus(err, http.StatusConflict) {
+		return nil, fmt.Errorf("error creating table %s: %s", tableName, err.Error())
+	}
+	return &TableStore{table: table}, nil
+}
+
+// Increment adds one to the counter for key in the window, using the entity's ETag to avoid
+// losing updates made concurrently by other instances
+func (s *TableStore) Increment(ctx context.Context, key string, window time.Time, expiry time.Time) (int, error) {
+	// Keys may contain characters not allowed in partition keys, such as '#' and '/'
+	partitionKey := base64.RawURLEncoding.EncodeToString([]byte(key))
+	rowKey := strconv.FormatInt(window.Unix(), 10)
+
+	var err error
+	for attempt := 0; attempt < tableUpdateAttempts; attempt++ {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+
+		entity := s.table.GetEntityReference(partitionKey, rowKey)
+		err = entity.Get(tableTimeout, storage.FullMetadata, nil)
+		if isStatus(err, http.StatusNotFound) {
+			// First request in this window, so try to create the counter
+			entity.Properties = map[string]interface{}{
+				"Count":  1,
+				"Expiry": expiry.UTC(),
+			}
+			err = entity.Insert(storage.EmptyPayload, nil)
+			if err == nil {
+				return 1, nil
+			}
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		// Update the existing counter if nobody else has changed it since we read it
+		count := countProperty(entity.Properties["Count"]) + 1
+		entity.Properties["Count"] = count
+		err = entity.Update(false, nil)
+		if err == nil {
+			return count, nil
+		}
+	}
+	return 0, fmt.Errorf("unable to update counter after %d attempts: %s", tableUpdateAttempts, err.Error())
+}
+
+// countProperty converts a count read from Table Storage, which is decoded from JSON
+func countProperty(value interface{}) int {
+	switch v := value.(type) {
+	case float64:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	default:
+		return 0
+	}
+}
+
+// isStatus reports whether err is a Table Storage error with the status code specified
+func isStatus(err error, statusCode int) bool {
+	var storageErr storage.AzureStorageServiceError
+	return errors.As(err, &storageErr) && storageErr.StatusCode == statusCode
+}
@@ -0,0 +1,64 @@
+package ratelimit
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestTableStore returns a TableStore using the storage account in
+// SSHIZZLE_TEST_STORAGE_CONNECTION_STRING, such as "UseDevelopmentStorage=true" for a local
+// Azurite emulator. Tests are skipped if it isn't set
+func newTestTableStore(t *testing.T) *TableStore {
+	t.Helper()
+	connectionString := os.Getenv("SSHIZZLE_TEST_STORAGE_CONNECTION_STRING")
+	if connectionString == "" {
+		t.Skip("SSHIZZLE_TEST_STORAGE_CONNECTION_STRING not set")
+	}
+	store, err := NewTableStore(connectionString, "sshizzleratelimitstest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestLimiterTableStore(t *testing.T) {
+	testLimiter(t, newTestTableStore(t))
+}
+
+func TestTableStoreConcurrentIncrements(t *testing.T) {
+	store := newTestTableStore(t)
+	ctx := context.Background()
+	key := "concurrent#" + time.Now().Format("150405.000000000")
+	window := time.Now().Truncate(time.Hour)
+	expiry := window.Add(time.Hour)
+
+	// Fewer concurrent updates than attempts, so every one should succeed
+	const increments = tableUpdateAttempts - 1
+	var wg sync.WaitGroup
+	errs := make(chan error, increments)
+	for i := 0; i < increments; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := store.Increment(ctx, key, window, expiry); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	count, err := store.Increment(ctx, key, window, expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != increments+1 {
+		t.Fatalf("count = %d, expected %d", count, increments+1)
+	}
+}
@@ -0,0 +1,86 @@
+package signer
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// AuditEvent records the outcome of a request to the CA
+type AuditEvent struct {
+	Time                time.Time `json:"time"`
+	InvocationID        string    `json:"invocation_id"`
+	ClientPrincipalID   string    `json:"client_principal_id"`
+	ClientPrincipalName string    `json:"client_principal_name"`
+	ClientIP            string    `json:"client_ip"`
+	UserAgent           string    `json:"user_agent"`
+	Principal           string    `json:"principal"`
+	// CAKeyVersion is the version of the CA key which signed the certificates
+	CAKeyVersion string             `json:"ca_key_version,omitempty"`
+	Certificates []AuditCertificate `json:"certificates"`
+	// ApprovalID and ApprovedBy are set if privileged principals were approved
+	ApprovalID string `json:"approval_id,omitempty"`
+	ApprovedBy string `json:"approved_by,omitempty"`
+	// Justification given by the user, such as a change ticket
+	Justification string `json:"justification,omitempty"`
+	// BreakGlass is set for emergency certificates, along with the reason and the
+	// fingerprints of the keys that approved them
+	BreakGlass bool     `json:"break_glass,omitempty"`
+	Reason     string   `json:"reason,omitempty"`
+	Approvers  []string `json:"approvers,omitempty"`
+}
+
+// AuditCertificate records the details of a certificate issued by the CA
+type AuditCertificate struct {
+	Serial      uint64    `json:"serial"`
+	KeyID       string    `json:"key_id"`
+	Fingerprint string    `json:"fingerprint"`
+	Principals  []string  `json:"principals"`
+	ValidAfter  time.Time `json:"valid_after"`
+	ValidBefore time.Time `json:"valid_before"`
+	// SourceAddress is the source-address critical option, if the certificate has one
+	SourceAddress string `json:"source_address,omitempty"`
+}
+
+// NewAuditEvent creates an audit event for the certificates issued by an invocation
+func NewAuditEvent(invocationDetail *FunctionInvocation, principal string, certificates []*ssh.Certificate) *AuditEvent {
+	event := &AuditEvent{
+		Time:                time.Now().UTC(),
+		InvocationID:        invocationDetail.InvocationID,
+		ClientPrincipalID:   invocationDetail.ClientPrincipalID,
+		ClientPrincipalName: invocationDetail.ClientPrincipalName,
+		ClientIP:            invocationDetail.ClientIP,
+		UserAgent:           invocationDetail.UserAgent,
+		Principal:           principal,
+	}
+	for _, certificate := range certificates {
+		event.Certificates = append(event.Certificates, AuditCertificate{
+			Serial:        certificate.Serial,
+			KeyID:         certificate.KeyId,
+			Fingerprint:   ssh.FingerprintSHA256(certificate.Key),
+			Principals:    certificate.ValidPrincipals,
+			ValidAfter:    time.Unix(int64(certificate.ValidAfter), 0).UTC(),
+			ValidBefore:   time.Unix(int64(certificate.ValidBefore), 0).UTC(),
+			SourceAddress: certificate.CriticalOptions["source-address"],
+		})
+	}
+	return event
+}
+
+// LogAuditEvent writes the audit event to the function log as a single line of JSON, so
+// it can be picked up by Application Insights or any other log collector
+func LogAuditEvent(event *AuditEvent) {
+	js, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("error marshalling audit event for request %s: %s\n", event.InvocationID, err.Error())
+		return
+	}
+	// Make break-glass certificates easy to alert on
+	if event.BreakGlass {
+		log.Printf("audit: BREAK-GLASS certificate issued: %s\n", js)
+		return
+	}
+	log.Printf("audit: %s\n", js)
+}
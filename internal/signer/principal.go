@@ -0,0 +1,196 @@
+package signer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// validPrincipal matches the principals issued to users, which must be usable as account names
+var validPrincipal = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
+// PrincipalMapper derives the certificate principal of a signed in user. The value of the
+// claim chosen, or the principal name, is looked up in a table of exceptions, then rewritten
+// with a regular expression if one is given, otherwise mapped according to its domain
+type PrincipalMapper struct {
+	// claim to derive the principal from, or "" for the principal name
+	claim string
+	// table maps identities to principals, overriding the other rules
+	table map[string]string
+	// targets are the principals in the table, which no other identity can be mapped to
+	targets map[string]string
+	// pattern and replacement rewrite identities, which must match the whole pattern
+	pattern     *regexp.Regexp
+	replacement string
+	// domains maps the domains users can sign in from to a prefix for their principals. Users
+	// from any domain are accepted, without a prefix, if empty
+	domains map[string]string
+	// reserved are principals which are never a user's own, such as the break-glass principal
+	reserved map[string]bool
+}
+
+// NewPrincipalMapper returns a PrincipalMapper. domains are of the form "example.com" or
+// "partner.com=partner-", giving the prefix for that domain's users, and must not give more
+// than one domain the same prefix, as their users' principals could collide
+func NewPrincipalMapper(claim string, pattern string, replacement string, domains []string, table map[string]string) (*PrincipalMapper, error) {
+	m := &PrincipalMapper{
+		claim:       claim,
+		table:       make(map[string]string),
+		targets:     make(map[string]string),
+		replacement: replacement,
+		reserved:    make(map[string]bool),
+	}
+	for identity, principal := range table {
+		if !validPrincipal.MatchString(principal) {
+			return nil, fmt.Errorf("invalid principal '%s' for %s in the principal table", principal, identity)
+		}
+		m.table[strings.ToLower(identity)] = principal
+		m.targets[principal] = identity
+	}
+	if pattern != "" {
+		// Anchor the pattern, so "(\w+)@corp\.com" doesn't also match "bob@corp.com.evil.org"
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid principal pattern '%s': %s", pattern, err.Error())
+		}
+		m.pattern = re
+	}
+	if len(domains) > 0 {
+		m.domains = make(map[string]string)
+		prefixes := make(map[string]string)
+		for _, domain := range domains {
+			prefix := ""
+			if i := strings.Index(domain, "="); i >= 0 {
+				domain, prefix = domain[:i], domain[i+1:]
+			}
+			domain = strings.ToLower(strings.TrimSpace(domain))
+			if other, ok := prefixes[prefix]; ok {
+				return nil, fmt.Errorf("domains %s and %s have the same prefix '%s', so their users' principals could collide", other, domain, prefix)
+			}
+			prefixes[prefix] = domain
+			m.domains[domain] = prefix
+		}
+	}
+	return m, nil
+}
+
+// Reserve stops principals being derived for any user, including through the table, so a
+// user can't be given a principal that's only issued by break-glass or with approval
+func (m *PrincipalMapper) Reserve(principals ...string) {
+	for _, principal := range principals {
+		m.reserved[principal] = true
+	}
+}
+
+// LoadPrincipalTable reads a table of identities and their principals, one pair per line
+// separated by whitespace. Blank lines and lines starting with # are ignored
+func LoadPrincipalTable(path string) (map[string]string, error) {
+	f, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return nil, fmt.Errorf("error reading principal table: %s", err.Error())
+	}
+	// #nosec
+	defer f.Close()
+
+	table := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d of principal table must be an identity and a principal", line)
+		}
+		identity := strings.ToLower(fields[0])
+		if existing, ok := table[identity]; ok && existing != fields[1] {
+			return nil, fmt.Errorf("line %d of principal table maps %s to more than one principal", line, fields[0])
+		}
+		table[identity] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading principal table: %s", err.Error())
+	}
+	return table, nil
+}
+
+// Principal returns the certificate principal for the signed in user, or an error if it's
+// empty, not a valid account name, reserved, or could belong to someone else. If m is nil,
+// the principal is the principal name up to the "@"
+func (m *PrincipalMapper) Principal(invocationDetail *FunctionInvocation) (string, error) {
+	if m == nil {
+		return checkPrincipal(strings.Split(invocationDetail.ClientPrincipalName, "@")[0])
+	}
+	principal, err := m.derive(invocationDetail)
+	if err != nil {
+		return "", err
+	}
+	if m.reserved[principal] {
+		return "", fmt.Errorf("principal '%s' is reserved and can't be issued to users", principal)
+	}
+	return principal, nil
+}
+
+// derive maps the user's identity to a principal
+func (m *PrincipalMapper) derive(invocationDetail *FunctionInvocation) (string, error) {
+	identity := invocationDetail.ClientPrincipalName
+	if m.claim != "" {
+		values := invocationDetail.Claims[m.claim]
+		if len(values) != 1 {
+			return "", fmt.Errorf("expected one %s claim, got %d", m.claim, len(values))
+		}
+		identity = values[0]
+	}
+	if identity == "" {
+		return "", errors.New("no identity to derive a principal from")
+	}
+
+	// Exceptions are taken as they are
+	if principal, ok := m.table[strings.ToLower(identity)]; ok {
+		return principal, nil
+	}
+
+	var principal string
+	if m.pattern != nil {
+		match := m.pattern.FindStringSubmatchIndex(identity)
+		if match == nil {
+			return "", fmt.Errorf("%s doesn't match the principal pattern", identity)
+		}
+		principal = string(m.pattern.ExpandString(nil, m.replacement, identity, match))
+	} else {
+		local, domain := identity, ""
+		if i := strings.LastIndex(identity, "@"); i >= 0 {
+			local, domain = identity[:i], strings.ToLower(identity[i+1:])
+		}
+		if m.domains != nil {
+			prefix, ok := m.domains[domain]
+			if !ok {
+				return "", fmt.Errorf("users from domain '%s' can't be issued certificates", domain)
+			}
+			local = prefix + local
+		}
+		principal = local
+	}
+
+	// Don't hand out a principal the table reserves for someone else
+	if other, ok := m.targets[principal]; ok && !strings.EqualFold(other, identity) {
+		return "", fmt.Errorf("principal '%s' for %s is ambiguous, it's also mapped to %s", principal, identity, other)
+	}
+	return checkPrincipal(principal)
+}
+
+// checkPrincipal returns the principal if it's a valid account name
+func checkPrincipal(principal string) (string, error) {
+	if principal == "" {
+		return "", errors.New("principal is empty")
+	}
+	if !validPrincipal.MatchString(principal) {
+		return "", fmt.Errorf("principal '%s' is not a valid account name", principal)
+	}
+	return principal, nil
+}
@@ -0,0 +1,166 @@
+package signer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPrincipal(t *testing.T) {
+	table := map[string]string{
+		"a_b.com#EXT#@tenant.onmicrosoft.com": "guest-ab",
+		"Carol.Smith@example.com":             "carol",
+		"root@example.com":                    "breakglass",
+	}
+
+	tests := []struct {
+		name        string
+		claim       string
+		pattern     string
+		replacement string
+		domains     []string
+		identity    string
+		claims      map[string][]string
+		expected    string
+		err         string
+	}{
+		{name: "principal name", identity: "alice@example.com", expected: "alice"},
+		{name: "table", identity: "carol.smith@EXAMPLE.com", expected: "carol"},
+		{name: "guest in the table", identity: "a_b.com#EXT#@tenant.onmicrosoft.com", expected: "guest-ab"},
+		{name: "guest not in the table", identity: "c_d.com#EXT#@tenant.onmicrosoft.com", err: "not a valid account name"},
+		{name: "ambiguous with the table", identity: "carol@example.com", err: "ambiguous"},
+		{name: "reserved through the table", identity: "root@example.com", err: "reserved"},
+		{name: "reserved principal", identity: "sshizzle-breakglass@example.com", err: "reserved"},
+		{name: "empty identity", identity: "", err: "no identity"},
+		{
+			name:     "claim",
+			claim:    "preferred_username",
+			identity: "1234",
+			claims:   map[string][]string{"preferred_username": {"dave@example.com"}},
+			expected: "dave",
+		},
+		{
+			name:     "claim missing",
+			claim:    "preferred_username",
+			identity: "dave@example.com",
+			err:      "expected one preferred_username claim, got 0",
+		},
+		{
+			name:     "claim with several values",
+			claim:    "emails",
+			identity: "dave@example.com",
+			claims:   map[string][]string{"emails": {"dave@example.com", "d@example.com"}},
+			err:      "expected one emails claim, got 2",
+		},
+		{name: "allowed domain", domains: []string{"example.com"}, identity: "alice@Example.com", expected: "alice"},
+		{name: "domain prefix", domains: []string{"example.com", "partner.com=p-"}, identity: "alice@partner.com", expected: "p-alice"},
+		{name: "other domain", domains: []string{"example.com"}, identity: "alice@evil.org", err: "users from domain 'evil.org'"},
+		{name: "no domain", domains: []string{"example.com"}, identity: "alice", err: "users from domain ''"},
+		{name: "pattern", pattern: `(\w+)@corp\.com`, replacement: "$1", identity: "bob@corp.com", expected: "bob"},
+		{name: "pattern must match the end", pattern: `(\w+)@corp\.com`, replacement: "$1", identity: "bob@corp.com.evil.org", err: "doesn't match the principal pattern"},
+		{name: "pattern must match the start", pattern: `(\w+)@corp\.com`, replacement: "$1", identity: "evil/bob@corp.com", err: "doesn't match the principal pattern"},
+		{name: "pattern with alternatives", pattern: `(\w+)@corp\.com|(\w+)@old\.corp\.com`, replacement: "$1$2", identity: "bob@old.corp.com", expected: "bob"},
+		{name: "pattern giving an invalid principal", pattern: `(.+)@corp\.com`, replacement: "$1", identity: "bob smith@corp.com", err: "not a valid account name"},
+		{name: "pattern ambiguous with the table", pattern: `(\w+)\.\w+@example\.com`, replacement: "$1", identity: "carol.jones@example.com", err: "ambiguous"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mapper, err := NewPrincipalMapper(test.claim, test.pattern, test.replacement, test.domains, table)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mapper.Reserve("sshizzle-breakglass", "breakglass")
+
+			principal, err := mapper.Principal(&FunctionInvocation{ClientPrincipalName: test.identity, Claims: test.claims})
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if principal != test.expected {
+				t.Fatalf("got principal %s, expected %s", principal, test.expected)
+			}
+		})
+	}
+}
+
+func TestPrincipalNilMapper(t *testing.T) {
+	var mapper *PrincipalMapper
+	principal, err := mapper.Principal(&FunctionInvocation{ClientPrincipalName: "alice@example.com"})
+	if err != nil || principal != "alice" {
+		t.Fatalf("got principal %s and error %v, expected alice", principal, err)
+	}
+	if _, err := mapper.Principal(&FunctionInvocation{ClientPrincipalName: "a_b.com#EXT#@tenant.onmicrosoft.com"}); err == nil {
+		t.Fatal("expected guest identity to be refused")
+	}
+}
+
+func TestNewPrincipalMapper(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		domains []string
+		table   map[string]string
+		err     string
+	}{
+		{name: "invalid pattern", pattern: "(", err: "invalid principal pattern"},
+		{name: "same prefix", domains: []string{"example.com", "example.org"}, err: "have the same prefix"},
+		{name: "invalid principal in the table", table: map[string]string{"alice@example.com": "alice smith"}, err: "invalid principal"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewPrincipalMapper("", test.pattern, "", test.domains, test.table)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestLoadPrincipalTable(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected map[string]string
+		err      string
+	}{
+		{
+			name:     "table",
+			content:  "# guests\nA_B.com#EXT#@tenant.onmicrosoft.com guest-ab\n\ncarol@example.com carol\n",
+			expected: map[string]string{"a_b.com#ext#@tenant.onmicrosoft.com": "guest-ab", "carol@example.com": "carol"},
+		},
+		{name: "missing principal", content: "carol@example.com\n", err: "line 1 of principal table"},
+		{name: "two principals", content: "carol@example.com carol\nCAROL@example.com csmith\n", err: "more than one principal"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "principals")
+			if err := os.WriteFile(path, []byte(test.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			table, err := LoadPrincipalTable(path)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(table) != len(test.expected) {
+				t.Fatalf("got %d entries, expected %d", len(table), len(test.expected))
+			}
+			for identity, principal := range test.expected {
+				if table[identity] != principal {
+					t.Errorf("got principal %s for %s, expected %s", table[identity], identity, principal)
+				}
+			}
+		})
+	}
+}
@@ -1,8 +1,12 @@
 package signer
 
 import (
+	"context"
+	"crypto"
 	"crypto/rand"
+	"crypto/rsa"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"math"
 	"math/big"
@@ -10,8 +14,8 @@ import (
 	"strings"
 	"time"
 
-	"github.com/Azure/azure-sdk-for-go/services/keyvault/v7.0/keyvault"
-	"github.com/thalesgroup/sshizzle/internal/azure"
+	"github.com/thalesgroup/sshizzle/internal/breakglass"
+	"github.com/thalesgroup/sshizzle/internal/justification"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -36,10 +40,161 @@ type FunctionInvocation struct {
 	ClientPrincipalID   string
 	ClientPrincipalName string
 	ClientIP            string
+	// Claims about the signed in user from the identity provider
+	Claims map[string][]string
+	// Principal is the user's own certificate principal, see PrincipalMapper
+	Principal string
 }
 
-// SignCertificate takes a public key and returns a signed SSH cert
-func SignCertificate(invocationDetail *FunctionInvocation, keyvaultClient *keyvault.BaseClient, keyvaultName string, keyName string, pubKey ssh.PublicKey) (*ssh.Certificate, error) {
+// CASigner signs certificates with the CA's RSA key, such as an azure.KeyVaultSigner or
+// vault.TransitSigner
+type CASigner interface {
+	crypto.Signer
+	// PublicKey returns the public key, fetching it from the key store if it isn't cached
+	PublicKey(ctx context.Context) (*rsa.PublicKey, error)
+	// KeyVersion identifies the version of the key returned by Public, so certificates can be
+	// traced across key rotations
+	KeyVersion() string
+	// CurrentKey returns a signer using only the current version of the key, and that version,
+	// so the version recorded in a certificate is the one that signed it even if the cached
+	// key is refreshed meanwhile
+	CurrentKey(ctx context.Context) (crypto.Signer, string, error)
+}
+
+// CertificateOptions customise the certificates issued by SignCertificates
+type CertificateOptions struct {
+	// Principals to issue the certificates for in addition to the user's own, which the
+	// caller must have checked the user is allowed
+	Principals []string
+	// ApprovalID and ApprovedBy record who approved the principals, if approval was required
+	ApprovalID string
+	ApprovedBy string
+	// Justification given by the user for the certificates, such as a change ticket
+	Justification string
+	// SourceAddress restricts where the certificates can be used from, as a comma separated
+	// list of addresses and CIDRs. They can be used from anywhere if empty
+	SourceAddress string
+}
+
+// SignCertificates takes a list of public keys and returns a signed SSH cert for each, all
+// issued under the same principals and validity period by caSigner
+func SignCertificates(invocationDetail *FunctionInvocation, caSigner CASigner, pubKeys []ssh.PublicKey, opts CertificateOptions) ([]*ssh.Certificate, error) {
+	// Set the certificate principal to the signed in user, plus any others requested
+	username := invocationDetail.Principal
+	if username == "" {
+		return nil, errors.New("no principal for the signed in user")
+	}
+	principals := []string{username}
+	for _, principal := range opts.Principals {
+		if principal != username {
+			principals = append(principals, principal)
+		}
+	}
+
+	// Get the current time and generate the validFrom and ValidTo
+	now := time.Now()
+	validFrom := now.Add(time.Second * -15)
+	validTo := now.Add(time.Minute * 2)
+
+	// Create an SSHAlgorithmSigner with an RSA, SHA256 algorithm, using one version of the key
+	// for every certificate
+	keySigner, keyVersion, err := caSigner.CurrentKey(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	sshAlgorithmSigner, err := NewAlgorithmSignerFromSigner(keySigner, ssh.SigAlgoRSASHA2256)
+	if err != nil {
+		return nil, err
+	}
+
+	certificates := make([]*ssh.Certificate, 0, len(pubKeys))
+	for _, pubKey := range pubKeys {
+		keyID := certificateKeyID(invocationDetail, strings.Join(principals, ","), pubKey, validTo, keyVersion)
+		if opts.ApprovalID != "" {
+			keyID += fmt.Sprintf(" approval[%s] approved_by[%s]", opts.ApprovalID, opts.ApprovedBy)
+		}
+		if opts.Justification != "" {
+			keyID += fmt.Sprintf(" justification[%s]", opts.Justification)
+		}
+		certificate, err := signCertificate(sshAlgorithmSigner, keyID, principals, validFrom, validTo, pubKey, opts.SourceAddress)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, certificate)
+	}
+
+	// Record a single audit event for everything issued by this request
+	event := NewAuditEvent(invocationDetail, username, certificates)
+	event.CAKeyVersion = keyVersion
+	event.ApprovalID = opts.ApprovalID
+	event.ApprovedBy = opts.ApprovedBy
+	event.Justification = opts.Justification
+	LogAuditEvent(event)
+
+	return certificates, nil
+}
+
+// SignBreakGlassCertificate signs a public key for emergency access when the usual sign in is
+// unavailable. The certificate is issued for the break-glass principal, and its KeyId starts
+// with breakglass.KeyIDPrefix and records the approvers and reason. It can only be used from
+// sourceAddress, if given
+func SignBreakGlassCertificate(invocationDetail *FunctionInvocation, caSigner CASigner, pubKey ssh.PublicKey, principal string, validity time.Duration, reason string, approvers []string, sourceAddress string) (*ssh.Certificate, error) {
+	// The reason is recorded in the KeyId, so mustn't be able to forge the fields after it
+	if err := justification.CheckFormat("reason", reason); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	validFrom := now.Add(time.Second * -15)
+	validTo := now.Add(validity)
+
+	keySigner, keyVersion, err := caSigner.CurrentKey(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	sshAlgorithmSigner, err := NewAlgorithmSignerFromSigner(keySigner, ssh.SigAlgoRSASHA2256)
+	if err != nil {
+		return nil, err
+	}
+
+	keyID := fmt.Sprintf("%s approvers[%s] reason[%s] %s",
+		breakglass.KeyIDPrefix,
+		strings.Join(approvers, ","),
+		reason,
+		certificateKeyID(invocationDetail, principal, pubKey, validTo, keyVersion),
+	)
+	certificate, err := signCertificate(sshAlgorithmSigner, keyID, []string{principal}, validFrom, validTo, pubKey, sourceAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	event := NewAuditEvent(invocationDetail, principal, []*ssh.Certificate{certificate})
+	event.CAKeyVersion = keyVersion
+	event.BreakGlass = true
+	event.Reason = reason
+	event.Approvers = approvers
+	LogAuditEvent(event)
+
+	return certificate, nil
+}
+
+// certificateKeyID returns a Key ID which [loosely] follows the Netflix BLESS format:
+// https://github.com/Netflix/bless
+func certificateKeyID(invocationDetail *FunctionInvocation, username string, pubKey ssh.PublicKey, validTo time.Time, caKeyVersion string) string {
+	return fmt.Sprintf("request[%s] for[%s] from[%s] command[%s] ssh_key[%s] ca[%s] ca_key_version[%s] valid_to[%s]",
+		invocationDetail.InvocationID,
+		username,
+		invocationDetail.ClientIP,
+		"", // Force command
+		ssh.FingerprintSHA256(pubKey),
+		os.Getenv("WEBSITE_DEPLOYMENT_ID"),
+		caKeyVersion,
+		validTo.Format("2006/01/02 15:04:05"),
+	)
+}
+
+// signCertificate signs a single public key with the CA
+func signCertificate(caSigner ssh.Signer, keyID string, principals []string, validFrom time.Time, validTo time.Time, pubKey ssh.PublicKey, sourceAddress string) (*ssh.Certificate, error) {
 	// Generate a nonce
 	bytes := make([]byte, 32)
 	nonce := make([]byte, len(bytes)*2)
@@ -54,14 +209,6 @@ func SignCertificate(invocationDetail *FunctionInvocation, keyvaultClient *keyva
 		return nil, err
 	}
 
-	// Set the certificate principal to the signed in user
-	username := strings.Split(invocationDetail.ClientPrincipalName, "@")[0]
-
-	// Get the current time and generate the validFrom and ValidTo
-	now := time.Now()
-	validFrom := now.Add(time.Second * -15)
-	validTo := now.Add(time.Minute * 2)
-
 	// Convert the extensions slice to a map
 	extensions := make(map[string]string, len(supportedExtensions))
 	for _, ext := range supportedExtensions {
@@ -70,28 +217,18 @@ func SignCertificate(invocationDetail *FunctionInvocation, keyvaultClient *keyva
 
 	criticalOptions := make(map[string]string)
 	// criticalOptions["force-command"] = "echo Hello, SSHizzle!"
-	// criticalOptions["source-address"] = "192.168.0.0/24"
+	if sourceAddress != "" {
+		criticalOptions["source-address"] = sourceAddress
+	}
 
-	// Key ID to [loosely] follow Netflix BLESS format: https://github.com/Netflix/bless
-	keyID := fmt.Sprintf("request[%s] for[%s] from[%s] command[%s] ssh_key[%s] ca[%s] valid_to[%s]",
-		invocationDetail.InvocationID,
-		username,
-		invocationDetail.ClientIP,
-		"", // Force command
-		ssh.FingerprintSHA256(pubKey),
-		os.Getenv("WEBSITE_DEPLOYMENT_ID"),
-		validTo.Format("2006/01/02 15:04:05"),
-	)
 	// Create a certificate with all of our details
 	certificate := ssh.Certificate{
-		Nonce:    nonce,
-		Key:      pubKey,
-		Serial:   serial.Uint64(),
-		CertType: ssh.UserCert,
-		KeyId:    keyID,
-		ValidPrincipals: []string{
-			username,
-		},
+		Nonce:           nonce,
+		Key:             pubKey,
+		Serial:          serial.Uint64(),
+		CertType:        ssh.UserCert,
+		KeyId:           keyID,
+		ValidPrincipals: principals,
 		Permissions: ssh.Permissions{
 			CriticalOptions: criticalOptions,
 			Extensions:      extensions,
@@ -100,17 +237,8 @@ func SignCertificate(invocationDetail *FunctionInvocation, keyvaultClient *keyva
 		ValidBefore: uint64(validTo.Unix()),
 	}
 
-	// Create a "KeyVaultSigner" which returns a crypto.Signer that interfaces with Azure Key Vault
-	keyvaultSigner := azure.NewKeyVaultSigner(keyvaultClient, keyvaultName, keyName)
-
-	// Create an SSHAlgorithmSigner with an RSA, SHA256 algorithm
-	sshAlgorithmSigner, err := NewAlgorithmSignerFromSigner(keyvaultSigner, ssh.SigAlgoRSASHA2256)
-	if err != nil {
-		return nil, err
-	}
-
 	// Sign the certificate!
-	if err := certificate.SignCert(rand.Reader, sshAlgorithmSigner); err != nil {
+	if err := certificate.SignCert(rand.Reader, caSigner); err != nil {
 		return nil, err
 	}
 
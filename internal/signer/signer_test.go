@@ -0,0 +1,111 @@
+package signer
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// rotatingSigner is a CASigner whose key is rotated to a new version as soon as the current
+// version has been read, as if the cache were refreshed during a request
+type rotatingSigner struct {
+	keys    map[string]*rsa.PrivateKey
+	current string
+}
+
+func (s *rotatingSigner) Public() crypto.PublicKey {
+	return &s.keys[s.current].PublicKey
+}
+
+func (s *rotatingSigner) PublicKey(ctx context.Context) (*rsa.PublicKey, error) {
+	return &s.keys[s.current].PublicKey, nil
+}
+
+func (s *rotatingSigner) KeyVersion() string {
+	version := s.current
+	s.current = "v2"
+	return version
+}
+
+func (s *rotatingSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return s.keys[s.current].Sign(rand, digest, opts)
+}
+
+func (s *rotatingSigner) CurrentKey(ctx context.Context) (crypto.Signer, string, error) {
+	version := s.current
+	s.current = "v2"
+	return s.keys[version], version, nil
+}
+
+func newRotatingSigner(t *testing.T) *rotatingSigner {
+	t.Helper()
+	s := &rotatingSigner{keys: make(map[string]*rsa.PrivateKey), current: "v1"}
+	for _, version := range []string{"v1", "v2"} {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.keys[version] = key
+	}
+	return s
+}
+
+// checkSignedBy checks the certificate records and was signed by version v1 of the key
+func checkSignedBy(t *testing.T, caSigner *rotatingSigner, certificate *ssh.Certificate) {
+	t.Helper()
+	if !strings.Contains(certificate.KeyId, "ca_key_version[v1]") {
+		t.Errorf("KeyId %s doesn't record version v1", certificate.KeyId)
+	}
+	caKey, err := ssh.NewPublicKey(&caSigner.keys["v1"].PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checker := ssh.CertChecker{IsUserAuthority: func(auth ssh.PublicKey) bool {
+		return string(auth.Marshal()) == string(caKey.Marshal())
+	}}
+	if err := checker.CheckCert(certificate.ValidPrincipals[0], certificate); err != nil {
+		t.Errorf("certificate isn't signed by version v1: %s", err)
+	}
+}
+
+func TestSignCertificatesKeyVersion(t *testing.T) {
+	caSigner := newRotatingSigner(t)
+	var pubKeys []ssh.PublicKey
+	for i := 0; i < 2; i++ {
+		publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sshKey, err := ssh.NewPublicKey(publicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubKeys = append(pubKeys, sshKey)
+	}
+
+	certificates, err := SignCertificates(&FunctionInvocation{Principal: "alice"}, caSigner, pubKeys, CertificateOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(certificates) != 2 {
+		t.Fatalf("got %d certificates, expected 2", len(certificates))
+	}
+	for _, certificate := range certificates {
+		checkSignedBy(t, caSigner, certificate)
+	}
+
+	caSigner = newRotatingSigner(t)
+	certificate, err := SignBreakGlassCertificate(&FunctionInvocation{}, caSigner, pubKeys[0], "sshizzle-breakglass", time.Hour, "outage", []string{"SHA256:a"}, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	checkSignedBy(t, caSigner, certificate)
+}
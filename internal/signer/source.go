@@ -0,0 +1,71 @@
+package signer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// SourceAddressClient is replaced by the client's IP address in a source address list
+const SourceAddressClient = "client"
+
+// ClientIP returns the client's IP address from an X-Forwarded-For header. App Service appends
+// the address it received the request from, with a port, e.g. "203.0.113.5:51234" or
+// "[2001:db8::1]:51234", so only the last entry is trusted. "" is returned if it isn't valid
+func ClientIP(forwardedFor string) string {
+	entries := strings.Split(forwardedFor, ",")
+	entry := strings.TrimSpace(entries[len(entries)-1])
+	if host, _, err := net.SplitHostPort(entry); err == nil {
+		entry = host
+	}
+	ip := net.ParseIP(strings.Trim(entry, "[]"))
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// ParseSourceAddresses checks a list of addresses and CIDRs certificates can be used from,
+// which can include SourceAddressClient, returning them in canonical form
+func ParseSourceAddresses(addresses []string) ([]string, error) {
+	parsed := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		if address == SourceAddressClient {
+			parsed = append(parsed, address)
+			continue
+		}
+		if _, network, err := net.ParseCIDR(address); err == nil {
+			parsed = append(parsed, network.String())
+			continue
+		}
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid source address '%s', must be an IP address, CIDR or '%s'", address, SourceAddressClient)
+		}
+		parsed = append(parsed, ip.String())
+	}
+	return parsed, nil
+}
+
+// SourceAddress returns the value of the source-address critical option for a list parsed
+// by ParseSourceAddresses, or "" if the list is empty
+func SourceAddress(addresses []string, clientIP string) (string, error) {
+	options := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		if address == SourceAddressClient {
+			ip := net.ParseIP(clientIP)
+			if ip == nil {
+				return "", errors.New("unable to determine the client's IP address")
+			}
+			// Bind certificates to exactly this address
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			address = fmt.Sprintf("%s/%d", ip.String(), bits)
+		}
+		options = append(options, address)
+	}
+	return strings.Join(options, ","), nil
+}
@@ -0,0 +1,107 @@
+package signer
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name         string
+		forwardedFor string
+		expected     string
+	}{
+		{name: "IPv4 with a port", forwardedFor: "203.0.113.5:51234", expected: "203.0.113.5"},
+		{name: "IPv4 without a port", forwardedFor: "203.0.113.5", expected: "203.0.113.5"},
+		{name: "bracketed IPv6 with a port", forwardedFor: "[2001:db8::1]:51234", expected: "2001:db8::1"},
+		{name: "bracketed IPv6 without a port", forwardedFor: "[2001:db8::1]", expected: "2001:db8::1"},
+		{name: "bare IPv6", forwardedFor: "2001:db8::1", expected: "2001:db8::1"},
+		{name: "IPv6 in canonical form", forwardedFor: "[2001:0db8:0000::0001]:443", expected: "2001:db8::1"},
+		{name: "IPv4-mapped IPv6", forwardedFor: "[::ffff:203.0.113.5]:51234", expected: "203.0.113.5"},
+		{name: "last of several entries", forwardedFor: "198.51.100.7, 10.0.0.1:1234, 203.0.113.5:51234", expected: "203.0.113.5"},
+		{name: "spoofed first entry ignored", forwardedFor: "[2001:db8::dead]:1, [2001:db8::1]:51234", expected: "2001:db8::1"},
+		{name: "empty", forwardedFor: "", expected: ""},
+		{name: "trailing comma", forwardedFor: "203.0.113.5,", expected: ""},
+		{name: "garbage", forwardedFor: "not-an-address", expected: ""},
+		{name: "garbage with a port", forwardedFor: "example.com:443", expected: ""},
+		{name: "garbage last entry", forwardedFor: "203.0.113.5, unknown", expected: ""},
+		{name: "out of range IPv4", forwardedFor: "203.0.113.256:1", expected: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if ip := ClientIP(test.forwardedFor); ip != test.expected {
+				t.Errorf("got %q, expected %q", ip, test.expected)
+			}
+		})
+	}
+}
+
+func TestParseSourceAddresses(t *testing.T) {
+	tests := []struct {
+		name      string
+		addresses []string
+		expected  []string
+		err       string
+	}{
+		{
+			name:      "addresses and CIDRs",
+			addresses: []string{"203.0.113.0/24", "2001:0db8::/32", "198.51.100.7", "client"},
+			expected:  []string{"203.0.113.0/24", "2001:db8::/32", "198.51.100.7", "client"},
+		},
+		{name: "CIDR with host bits", addresses: []string{"203.0.113.5/24"}, expected: []string{"203.0.113.0/24"}},
+		{name: "invalid", addresses: []string{"203.0.113.0/33"}, err: "invalid source address"},
+		{name: "hostname", addresses: []string{"example.com"}, err: "invalid source address"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parsed, err := ParseSourceAddresses(test.addresses)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(parsed, test.expected) {
+				t.Errorf("got %v, expected %v", parsed, test.expected)
+			}
+		})
+	}
+}
+
+func TestSourceAddress(t *testing.T) {
+	tests := []struct {
+		name      string
+		addresses []string
+		clientIP  string
+		expected  string
+		err       string
+	}{
+		{name: "none", expected: ""},
+		{name: "fixed", addresses: []string{"203.0.113.0/24", "2001:db8::/32"}, expected: "203.0.113.0/24,2001:db8::/32"},
+		{name: "IPv4 client", addresses: []string{"10.0.0.0/8", "client"}, clientIP: "203.0.113.5", expected: "10.0.0.0/8,203.0.113.5/32"},
+		{name: "IPv6 client", addresses: []string{"client"}, clientIP: "2001:db8::1", expected: "2001:db8::1/128"},
+		{name: "unknown client", addresses: []string{"client"}, clientIP: "", err: "unable to determine"},
+		{name: "unknown client not needed", addresses: []string{"10.0.0.0/8"}, clientIP: "", expected: "10.0.0.0/8"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sourceAddress, err := SourceAddress(test.addresses, test.clientIP)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if sourceAddress != test.expected {
+				t.Errorf("got %q, expected %q", sourceAddress, test.expected)
+			}
+		})
+	}
+}
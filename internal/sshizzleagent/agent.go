@@ -1,12 +1,15 @@
 package sshizzleagent
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
-	"encoding/json"
 	"errors"
-	"io/ioutil"
+	"fmt"
 	"log"
-	"path/filepath"
+	"net"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/thalesgroup/sshizzle/internal/azure"
@@ -16,100 +19,332 @@ import (
 	"golang.org/x/oauth2"
 )
 
+// Agent is an sshizzle agent which can serve connections from SSH clients
+type Agent interface {
+	agent.ExtendedAgent
+	// ServeConn serves the agent protocol on a single client connection
+	ServeConn(conn net.Conn) error
+}
+
 type sshizzleAgent struct {
-	signer      ssh.Signer
-	certificate *ssh.Certificate
-	config      *config.SSHizzleConfig
-	token       *oauth2.Token
-	state       string
-}
-
-// NewSSHizzleAgent returns a new Agent with a signer and cert
-func NewSSHizzleAgent(c *config.SSHizzleConfig) agent.Agent {
-	// Create a pointer to an empty (invalid) token
-	token := &oauth2.Token{}
-	// Get the path to the sshizzle token cache
-	tokenFile, err := config.GetSSHizzleTokenFile()
-	if err == nil {
-		// Read the file if we got the path okay
-		data, err := ioutil.ReadFile(filepath.Clean(tokenFile))
-		if err == nil {
-			// If we were able to read the file, unmarshal it into `token`
-			err = json.Unmarshal(data, token)
-		}
-	}
+	signers []ssh.Signer
+	config  *config.SSHizzleConfig
+	state   string
+
+	// Connections are served concurrently, so mu guards the fields below, and renewMu makes
+	// connections wait for a renewal already in progress rather than start their own
+	mu           sync.Mutex
+	renewMu      sync.Mutex
+	certificates []*ssh.Certificate
+	token        *oauth2.Token
+	// retryAfter is when sshizzle-ca said we could request certificates again
+	retryAfter time.Time
+	// approvalID is the CA's approval request for the privileged principals, if any
+	approvalID string
+	// waiting is set while the agent polls the CA in the background for a decision on the
+	// approval request
+	waiting *approvalWait
+}
+
+// approvalWait stops the background polling for an approval
+type approvalWait struct {
+	cancel context.CancelFunc
+}
+
+// NewSSHizzleAgent returns a new Agent with a set of signers, each of which will be issued a cert
+func NewSSHizzleAgent(c *config.SSHizzleConfig) Agent {
+	// Start with the cached token, if there is one
+	token := LoadToken()
 
 	// Return a new sshizzleAgent
 	return &sshizzleAgent{
-		signer:      c.Signer,
-		certificate: &ssh.Certificate{},
-		config:      c,
-		state:       "",
-		token:       token,
+		signers:      c.Signers,
+		certificates: make([]*ssh.Certificate, len(c.Signers)),
+		config:       c,
+		state:        "",
+		token:        token,
 	}
 }
 
-// RemoveAll clears the current certificate and identity token (including refresh token)
+// LogoutExtension is the agent extension used by `sshizzle-agent -logout` to ask a running
+// agent to forget its certificate and tokens, and erase the token cache on disk
+const LogoutExtension = "logout@sshizzle"
+
+// RemoveAll clears the current certificates and identity token (including refresh token)
+// held in memory, like `ssh-add -D`. The token cache on disk is left alone, see Logout
 func (a *sshizzleAgent) RemoveAll() error {
-	a.certificate = &ssh.Certificate{}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.certificates = make([]*ssh.Certificate, len(a.signers))
 	a.token = &oauth2.Token{}
+	// Stop waiting for an approval made with the old token
+	if a.waiting != nil {
+		a.waiting.cancel()
+		a.waiting = nil
+	}
+	a.approvalID = ""
 	return nil
 }
 
-// Remove has the same functionality as RemoveAll
+// Remove clears the certificate matching key, like `ssh-add -d`. The certificate will be
+// renewed the next time identities are listed
 func (a *sshizzleAgent) Remove(key ssh.PublicKey) error {
-	return a.RemoveAll()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, certificate := range a.certificates {
+		if certificate != nil && bytes.Equal(key.Marshal(), certificate.Marshal()) {
+			a.certificates[i] = nil
+			return nil
+		}
+	}
+	return errors.New("key not found in sshizzle-agent")
 }
 
-// List returns the identities, but also signs the certificate using sshizzle-ca if expired.
+// Logout clears the current certificate and identity token, and erases the token cache
+// so that the user must sign in again
+func (a *sshizzleAgent) Logout() error {
+	if err := a.RemoveAll(); err != nil {
+		return err
+	}
+	return Logout()
+}
+
+// List returns the identities, but also signs the certificates using sshizzle-ca if expired.
 func (a *sshizzleAgent) List() ([]*agent.Key, error) {
-	now := time.Now().Unix()
-	before := int64(a.certificate.ValidBefore)
 	var ids []*agent.Key
 	// Print something in the log so we can check the agent is being used
 	log.Println("Agent invoked, trying to get credentials")
 
-	// Check if certificate is valid, if not, try to renew it
-	if a.certificate.ValidBefore != uint64(ssh.CertTimeInfinity) && (now >= before || before < 0) {
-		// Validate our current token, and request a new one if its invalid
-		token, err := Authenticate(a.token, a.config.OauthConfig)
-		if err != nil {
+	// Only one connection renews the certificates, the others wait for it
+	a.renewMu.Lock()
+	defer a.renewMu.Unlock()
+
+	// Check if certificates are valid, if not, try to renew them all in one request
+	if a.certificatesExpired() {
+		// Don't hammer the CA if it has asked us to back off, or while we're already polling
+		// it for an approval
+		a.mu.Lock()
+		wait := time.Until(a.retryAfter)
+		waiting, approvalID := a.waiting != nil, a.approvalID
+		a.mu.Unlock()
+		if wait > 0 {
+			err := fmt.Errorf("sshizzle-ca is rate limiting requests, try again in %s", wait.Round(time.Second))
+			log.Println(err.Error())
 			return ids, err
 		}
-		// Refresh the agent's token in case it changed
-		a.token = token
-
-		// Get the public key of this agent's signer
-		publicKey := a.signer.PublicKey()
-		// Invoke the Azure Function to get (hopefully) a signed certificate!
-		certificate, err := azure.InvokeSignFunction(&publicKey, a.config.FuncHost, a.config.OauthConfig, a.token)
+		if waiting {
+			return ids, &azure.InvokeError{Err: azure.ErrApprovalPending, Message: fmt.Sprintf("request %s", approvalID)}
+		}
+		certificates, err := a.renewCertificates(context.Background(), true)
+		// If the CA rejected our token, sign in again and have one more go
+		if errors.Is(err, azure.ErrAuthExpired) {
+			log.Println("Token rejected by sshizzle-ca, signing in again")
+			a.mu.Lock()
+			a.token = &oauth2.Token{}
+			a.mu.Unlock()
+			certificates, err = a.renewCertificates(context.Background(), true)
+		}
+		a.checkRetryAfter(err)
+		// Don't hold up the client while someone decides, try again once they have
+		if errors.Is(err, azure.ErrApprovalPending) {
+			a.awaitApproval()
+		}
 		if err != nil {
+			log.Println(err.Error())
 			return ids, err
 		}
-		// Output the key ID to the logs
-		log.Printf("New certificate acquired with ID: %s", certificate.KeyId)
-		// Update the agent's stored certificate
-		a.certificate = certificate
+		// Output the key IDs to the logs
+		for _, certificate := range certificates {
+			log.Printf("New certificate acquired with ID: %s", certificate.KeyId)
+		}
+		// Update the agent's stored certificates
+		a.mu.Lock()
+		a.certificates = certificates
+		a.mu.Unlock()
 	}
 	// Setup the list of identities and return it
-	ids = append(ids, &agent.Key{
-		Format:  a.certificate.Type(),
-		Blob:    a.certificate.Marshal(),
-		Comment: a.certificate.KeyId,
-	})
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, certificate := range a.certificates {
+		// Removed since they were renewed
+		if certificate == nil {
+			continue
+		}
+		ids = append(ids, &agent.Key{
+			Format:  certificate.Type(),
+			Blob:    certificate.Marshal(),
+			Comment: certificate.KeyId,
+		})
+	}
 	return ids, nil
 }
 
+// checkRetryAfter records when the CA asked us to wait until before trying again, if it did
+func (a *sshizzleAgent) checkRetryAfter(err error) {
+	var invokeErr *azure.InvokeError
+	if errors.As(err, &invokeErr) && invokeErr.RetryAfter > 0 {
+		a.mu.Lock()
+		a.retryAfter = time.Now().Add(invokeErr.RetryAfter)
+		a.mu.Unlock()
+	}
+}
+
+// awaitApproval polls the CA in the background until the pending approval request is
+// decided or expires, storing the certificates if it's approved. Meanwhile clients are told
+// the request is pending, and RemoveAll stops the polling
+func (a *sshizzleAgent) awaitApproval() {
+	ctx, cancel := context.WithCancel(context.Background())
+	waiting := &approvalWait{cancel: cancel}
+	a.mu.Lock()
+	a.waiting = waiting
+	a.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		certificates, err := a.renewCertificates(ctx, false)
+		a.checkRetryAfter(err)
+
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		// Dropped by RemoveAll while we were waiting
+		if a.waiting != waiting {
+			return
+		}
+		a.waiting = nil
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		for _, certificate := range certificates {
+			log.Printf("New certificate acquired with ID: %s", certificate.KeyId)
+		}
+		a.certificates = certificates
+	}()
+}
+
+// certificatesExpired reports whether any of the agent's certificates are missing or expired
+func (a *sshizzleAgent) certificatesExpired() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now().Unix()
+	for _, certificate := range a.certificates {
+		if certificate == nil {
+			return true
+		}
+		before := int64(certificate.ValidBefore)
+		if certificate.ValidBefore != uint64(ssh.CertTimeInfinity) && (now >= before || before < 0) {
+			return true
+		}
+	}
+	return false
+}
+
+// renewCertificates authenticates the user if required, then requests a new certificate for
+// each of the agent's signers. If approval is needed, azure.ErrApprovalPending is returned
+// straight away when noWait is set, otherwise the CA is polled until ctx is done
+func (a *sshizzleAgent) renewCertificates(ctx context.Context, noWait bool) ([]*ssh.Certificate, error) {
+	a.mu.Lock()
+	token, approvalID := a.token, a.approvalID
+	a.mu.Unlock()
+	// RemoveAll cancels before forgetting the token, so don't ask the user to sign in again
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	// Validate our current token, and request a new one if its invalid
+	token, err := Authenticate(token, a.config.OauthConfig)
+	if err != nil {
+		return nil, err
+	}
+	// Refresh the agent's token in case it changed
+	a.mu.Lock()
+	a.token = token
+	a.mu.Unlock()
+
+	// Get the public keys of this agent's signers
+	publicKeys := make([]ssh.PublicKey, 0, len(a.signers))
+	for _, signer := range a.signers {
+		publicKeys = append(publicKeys, signer.PublicKey())
+	}
+	// Invoke the Azure Function to get (hopefully) signed certificates!
+	opts := azure.DefaultInvokeOptions
+	opts.Timeout = a.config.CATimeout
+	opts.MaxRetries = a.config.CARetries
+	opts.IDToken = a.config.IDToken
+	opts.NoWait = noWait
+	opts.OnPending = func(approval *azure.FunctionApproval) {
+		log.Printf("Waiting for approval of request %s for %s, expires at %s\n",
+			approval.ID, strings.Join(approval.Principals, ","), time.Unix(approval.ExpiresAt, 0).Format(time.Kitchen))
+	}
+	request := &azure.SignRequest{
+		PublicKeys:    publicKeys,
+		Principals:    a.config.Principals,
+		ApprovalID:    approvalID,
+		Justification: a.config.Justification,
+	}
+	certificates, err := azure.InvokeSignFunction(ctx, request, a.config.FuncHost, a.config.OauthConfig, token, opts)
+	// Reuse the approval for privileged principals until it expires, unless RemoveAll
+	// cancelled the request
+	a.mu.Lock()
+	if ctx.Err() == nil {
+		a.approvalID = request.ApprovalID
+	}
+	a.mu.Unlock()
+	return certificates, err
+}
+
+// signerFor returns the signer for a key, which may be one of our certificates
+func (a *sshizzleAgent) signerFor(key ssh.PublicKey) (ssh.Signer, error) {
+	if certificate, ok := key.(*ssh.Certificate); ok {
+		key = certificate.Key
+	}
+	for _, signer := range a.signers {
+		if bytes.Equal(key.Marshal(), signer.PublicKey().Marshal()) {
+			return signer, nil
+		}
+	}
+	return nil, errors.New("key not found in sshizzle-agent")
+}
+
 // Signs a challenge required to authenticate with an SSH host
 func (a *sshizzleAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
-	return a.signer.Sign(rand.Reader, data)
+	return a.SignWithFlags(key, data, 0)
+}
+
+// SignWithFlags signs a challenge using the algorithm requested by the client, allowing
+// rsa-sha2-256 and rsa-sha2-512 signatures to be used with RSA keys
+func (a *sshizzleAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	signer, err := a.signerFor(key)
+	if err != nil {
+		return nil, err
+	}
+	algorithmSigner, ok := signer.(ssh.AlgorithmSigner)
+	if !ok || signer.PublicKey().Type() != ssh.KeyAlgoRSA {
+		return signer.Sign(rand.Reader, data)
+	}
+	switch {
+	case flags&agent.SignatureFlagRsaSha256 != 0:
+		return algorithmSigner.SignWithAlgorithm(rand.Reader, data, ssh.KeyAlgoRSASHA256)
+	case flags&agent.SignatureFlagRsaSha512 != 0:
+		return algorithmSigner.SignWithAlgorithm(rand.Reader, data, ssh.KeyAlgoRSASHA512)
+	default:
+		return signer.Sign(rand.Reader, data)
+	}
+}
+
+// Extension handles sshizzle specific requests from sshizzle-agent clients
+func (a *sshizzleAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	switch extensionType {
+	case LogoutExtension:
+		return nil, a.Logout()
+	default:
+		return nil, agent.ErrExtensionUnsupported
+	}
 }
 
-// Signers list our current signers which there is only one.
+// Signers list our current signers, one for each key type
 func (a *sshizzleAgent) Signers() ([]ssh.Signer, error) {
-	return []ssh.Signer{
-		a.signer,
-	}, nil
+	return a.signers, nil
 }
 
 // ErrUnsupported is a generic error to be returned when unsupported agent methods are called
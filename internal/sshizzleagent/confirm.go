@@ -0,0 +1,84 @@
+package sshizzleagent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Confirmation modes, set with SSHIZZLE_CONFIRM
+const (
+	ConfirmAskpass = "askpass"
+	ConfirmNotify  = "notify"
+)
+
+// Time to wait for the user to respond to a confirmation prompt before denying
+const confirmTimeout = 60 * time.Second
+
+// confirm asks the user to approve a signature using the mode specified, returning true
+// only if the user explicitly approves
+func confirm(mode string, prompt string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), confirmTimeout)
+	defer cancel()
+
+	var approved bool
+	var err error
+	switch mode {
+	case ConfirmAskpass:
+		approved, err = confirmAskpass(ctx, prompt)
+	case ConfirmNotify:
+		approved, err = confirmNotify(ctx, prompt)
+	default:
+		err = fmt.Errorf("unknown confirmation mode '%s'", mode)
+	}
+	if err != nil {
+		log.Println(fmt.Errorf("confirmation failed, denying signature: %s", err.Error()))
+		return false
+	}
+	return approved
+}
+
+// confirmAskpass prompts using SSH_ASKPASS in confirm mode, in the same way as
+// `ssh-agent` handles keys added with `ssh-add -c`
+// #nosec
+func confirmAskpass(ctx context.Context, prompt string) (bool, error) {
+	askpass := os.Getenv("SSH_ASKPASS")
+	if askpass == "" {
+		askpass = "ssh-askpass"
+	}
+	cmd := exec.CommandContext(ctx, askpass, prompt)
+	cmd.Env = append(os.Environ(), "SSH_ASKPASS_PROMPT=confirm")
+	output, err := cmd.Output()
+	if err != nil {
+		// Askpass exits non-zero when the user declines
+		if _, ok := err.(*exec.ExitError); ok {
+			return false, nil
+		}
+		return false, err
+	}
+	answer := strings.TrimSpace(string(output))
+	return answer == "" || strings.EqualFold(answer, "yes"), nil
+}
+
+// confirmNotify prompts using a desktop notification with approve and deny actions
+// #nosec
+func confirmNotify(ctx context.Context, prompt string) (bool, error) {
+	cmd := exec.CommandContext(ctx, "notify-send",
+		"--wait",
+		"--urgency=critical",
+		"--app-name=sshizzle-agent",
+		"--action=approve=Approve",
+		"--action=deny=Deny",
+		"SSHizzle signature request",
+		prompt,
+	)
+	output, err := cmd.Output()
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(output)) == "approve", nil
+}
@@ -0,0 +1,89 @@
+package sshizzleagent
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// ErrDenied is returned when the user declines a signature confirmation prompt
+var ErrDenied = errors.New("signature request denied by user")
+
+// connAgent wraps the sshizzleAgent with details of a single client connection
+type connAgent struct {
+	*sshizzleAgent
+	peer  string
+	binds []*sessionBind
+}
+
+// ServeConn serves the agent protocol on a single client connection until it's closed
+func (a *sshizzleAgent) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+	return agent.ServeAgent(&connAgent{
+		sshizzleAgent: a,
+		peer:          describePeer(conn),
+	}, conn)
+}
+
+// Sign asks for confirmation if required, then signs the challenge
+func (c *connAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return c.SignWithFlags(key, data, 0)
+}
+
+// SignWithFlags asks for confirmation if required, then signs the challenge
+func (c *connAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	if err := c.checkDestination(data); err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	if c.config.Confirm != "" && !confirm(c.config.Confirm, c.confirmPrompt(key)) {
+		return nil, ErrDenied
+	}
+	return c.sshizzleAgent.SignWithFlags(key, data, flags)
+}
+
+// ErrForwardedLogout is returned when a logout is requested over a forwarded connection
+var ErrForwardedLogout = errors.New("refusing to logout over a forwarded connection")
+
+// Extension tracks session binds for this connection, passing other requests to the agent.
+// Logging out is only allowed locally, so a remote host the agent is forwarded to can't sign
+// the user out
+func (c *connAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	if extensionType == LogoutExtension && len(c.binds) > 0 {
+		log.Println(ErrForwardedLogout.Error())
+		return nil, ErrForwardedLogout
+	}
+	if extensionType != SessionBindExtension {
+		return c.sshizzleAgent.Extension(extensionType, contents)
+	}
+	bind, err := parseSessionBind(contents)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	if err := c.addSessionBind(bind); err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	return nil, nil
+}
+
+// confirmPrompt describes a signature request to the user
+func (c *connAgent) confirmPrompt(key ssh.PublicKey) string {
+	peer := c.peer
+	if peer == "" {
+		peer = "an unknown process"
+	}
+	prompt := fmt.Sprintf("Allow %s to use key %s", peer, ssh.FingerprintSHA256(key))
+	if cert, ok := key.(*ssh.Certificate); ok {
+		prompt = fmt.Sprintf("Allow %s to use key %s (%s)", peer, ssh.FingerprintSHA256(cert.Key), cert.KeyId)
+	}
+	if destination := c.destination(); destination != nil {
+		prompt += fmt.Sprintf(" to authenticate to host %s", ssh.FingerprintSHA256(destination))
+	}
+	return prompt + "?"
+}
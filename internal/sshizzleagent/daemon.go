@@ -0,0 +1,163 @@
+package sshizzleagent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DaemonEnv is set in the environment of an agent process started by Daemonize
+const DaemonEnv = "SSHIZZLE_AGENT_DAEMON"
+
+// Shell syntaxes supported when printing environment variable exports
+const (
+	ShellBourne = "sh"
+	ShellCsh    = "csh"
+)
+
+// Time to wait for a daemonized agent to start listening, or a killed agent to exit
+const daemonTimeout = 5 * time.Second
+
+// IsDaemon reports whether this process was started in the background by Daemonize
+func IsDaemon() bool {
+	return os.Getenv(DaemonEnv) == "1"
+}
+
+// GetPidFile returns the path to the pidfile for the agent listening on socket
+func GetPidFile(socket string) string {
+	return socket + ".pid"
+}
+
+// WritePidFile records the pid of the current process alongside the socket
+func WritePidFile(socket string) error {
+	pid := []byte(strconv.Itoa(os.Getpid()) + "\n")
+	if err := ioutil.WriteFile(GetPidFile(socket), pid, 0600); err != nil {
+		return fmt.Errorf("error writing pidfile: %s", err.Error())
+	}
+	return nil
+}
+
+// Daemonize starts a copy of the current executable in the background, detached from the
+// terminal with output sent to logFile. It waits for the new agent to listen on socket
+// and returns its pid
+func Daemonize(socket string, logFile string) (int, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return 0, fmt.Errorf("error finding agent executable: %s", err.Error())
+	}
+
+	// Don't start another agent on a socket that's already in use
+	if err := removeStaleSocket(socket); err != nil {
+		return 0, err
+	}
+
+	// Send all output of the daemon to the log file
+	// #nosec
+	logOutput, err := os.OpenFile(logFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, fmt.Errorf("error opening log file: %s", err.Error())
+	}
+	defer logOutput.Close()
+
+	// Start the agent again without any arguments in a new session
+	// #nosec
+	cmd := exec.Command(executable)
+	cmd.Env = append(os.Environ(), DaemonEnv+"=1")
+	cmd.Stdout = logOutput
+	cmd.Stderr = logOutput
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("error starting agent: %s", err.Error())
+	}
+
+	// Catch the agent exiting before it manages to listen
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	// Wait for the agent to write its pidfile, which happens once it's listening
+	deadline := time.Now().Add(daemonTimeout)
+	for time.Now().Before(deadline) {
+		select {
+		case err := <-exited:
+			return 0, fmt.Errorf("agent exited during startup (%v), see %s", err, logFile)
+		default:
+		}
+		if pid, err := readPidFile(socket); err == nil && pid == cmd.Process.Pid {
+			return pid, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return 0, fmt.Errorf("timed out waiting for agent to listen on %s, see %s", socket, logFile)
+}
+
+// readPidFile returns the pid recorded for the agent listening on socket
+func readPidFile(socket string) (int, error) {
+	data, err := ioutil.ReadFile(filepath.Clean(GetPidFile(socket)))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// Kill stops the agent listening on socket using the pid from its pidfile. Only agents
+// started by Daemonize have a pidfile, so other agents, such as an ssh-agent found through
+// SSH_AGENT_PID, are never killed. The socket and pidfile are removed, and the pid of the
+// killed agent returned
+func Kill(socket string) (int, error) {
+	// Read the pid of the running agent
+	pid, err := readPidFile(socket)
+	if err != nil || pid < 1 {
+		return 0, fmt.Errorf("no running agent found for %s", socket)
+	}
+
+	// Ask the agent to shut down, and wait for it to exit
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return 0, err
+	}
+	if err := process.Signal(syscall.SIGTERM); err != nil {
+		return 0, fmt.Errorf("error killing agent with pid %d: %s", pid, err.Error())
+	}
+	deadline := time.Now().Add(daemonTimeout)
+	for process.Signal(syscall.Signal(0)) == nil {
+		if time.Now().After(deadline) {
+			return 0, fmt.Errorf("timed out waiting for agent with pid %d to exit", pid)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// Clean up anything the agent left behind
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return pid, fmt.Errorf("error removing socket: %s", err.Error())
+	}
+	if err := os.Remove(GetPidFile(socket)); err != nil && !os.IsNotExist(err) {
+		return pid, fmt.Errorf("error removing pidfile: %s", err.Error())
+	}
+	return pid, nil
+}
+
+// ExportCommands returns shell commands in the style of `ssh-agent -s/-c` which point
+// SSH clients at the agent
+func ExportCommands(shell string, socket string, pid int) string {
+	if shell == ShellCsh {
+		return fmt.Sprintf("setenv SSH_AUTH_SOCK %s;\nsetenv SSH_AGENT_PID %d;\necho Agent pid %d;\n", socket, pid, pid)
+	}
+	return fmt.Sprintf("SSH_AUTH_SOCK=%s; export SSH_AUTH_SOCK;\nSSH_AGENT_PID=%d; export SSH_AGENT_PID;\necho Agent pid %d;\n", socket, pid, pid)
+}
+
+// UnsetCommands returns shell commands in the style of `ssh-agent -k` which remove the
+// variables set by ExportCommands
+func UnsetCommands(shell string, pid int) string {
+	if shell == ShellCsh {
+		return fmt.Sprintf("unsetenv SSH_AUTH_SOCK;\nunsetenv SSH_AGENT_PID;\necho Agent pid %d killed;\n", pid)
+	}
+	return fmt.Sprintf("unset SSH_AUTH_SOCK;\nunset SSH_AGENT_PID;\necho Agent pid %d killed;\n", pid)
+}
@@ -10,6 +10,7 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"runtime"
 	"time"
 
@@ -49,7 +50,7 @@ func Authenticate(token *oauth2.Token, config *oauth2.Config) (*oauth2.Token, er
 		}
 
 		// Catch interrupt/kill signals to exit nicely
-		sigs := make(chan os.Signal)
+		sigs := make(chan os.Signal, 1)
 		signal.Notify(sigs, os.Interrupt, os.Kill)
 
 		// Take the current time
@@ -58,7 +59,7 @@ func Authenticate(token *oauth2.Token, config *oauth2.Config) (*oauth2.Token, er
 		for !token.Valid() {
 			// Check if we've been waiting longer than 60s
 			if time.Now().Unix() > now.Add(60*time.Second).Unix() {
-				return nil, fmt.Errorf("azure AD authentication timed out after 60s, try again")
+				return nil, fmt.Errorf("authentication timed out after 60s, try again")
 			}
 			// Check for user input/interrupt
 			select {
@@ -72,6 +73,24 @@ func Authenticate(token *oauth2.Token, config *oauth2.Config) (*oauth2.Token, er
 	return token, nil
 }
 
+// LoadToken returns the token from the token cache, or an empty (invalid) token if there
+// isn't one
+func LoadToken() *oauth2.Token {
+	// Create a pointer to an empty (invalid) token
+	token := &oauth2.Token{}
+	// Get the path to the sshizzle token cache
+	tokenFile, err := config.GetSSHizzleTokenFile()
+	if err == nil {
+		// Read the file if we got the path okay
+		data, err := ioutil.ReadFile(filepath.Clean(tokenFile))
+		if err == nil {
+			// If we were able to read the file, unmarshal it into `token`
+			_ = json.Unmarshal(data, token)
+		}
+	}
+	return token
+}
+
 // Handler for the response from requesting a new token
 func handleLoginCallback(token *oauth2.Token, oauth *oauth2.Config, state string) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -113,6 +132,20 @@ func handleLoginCallback(token *oauth2.Token, oauth *oauth2.Config, state string
 	}
 }
 
+// Logout erases the token cache so the next authentication requires the user to sign in.
+// Azure AD doesn't offer a revocation endpoint for refresh tokens, so the token is only
+// removed locally, and will expire according to the tenant's token lifetime policy
+func Logout() error {
+	tokenFile, err := config.GetSSHizzleTokenFile()
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(tokenFile); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing token cache at %s: %s", tokenFile, err.Error())
+	}
+	return nil
+}
+
 // openURL attempts to open a URL in a browser in an OS-agnostic way
 // #nosec
 func openURL(url string) (err error) {
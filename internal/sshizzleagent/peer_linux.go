@@ -0,0 +1,39 @@
+package sshizzleagent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// describePeer returns the pid and command line of the process connected to conn
+func describePeer(conn net.Conn) string {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return ""
+	}
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return ""
+	}
+
+	// Fetch the credentials of the process on the other end of the socket
+	var cred *syscall.Ucred
+	var credErr error
+	err = rawConn.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || credErr != nil {
+		return ""
+	}
+
+	// Arguments in /proc/<pid>/cmdline are separated by null bytes
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", cred.Pid))
+	if err != nil {
+		return fmt.Sprintf("pid %d", cred.Pid)
+	}
+	command := strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+	return fmt.Sprintf("pid %d (%s)", cred.Pid, command)
+}
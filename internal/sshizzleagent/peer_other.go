@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package sshizzleagent
+
+import "net"
+
+// describePeer is only supported on Linux
+func describePeer(conn net.Conn) string {
+	return ""
+}
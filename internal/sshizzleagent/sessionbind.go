@@ -0,0 +1,128 @@
+package sshizzleagent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SessionBindExtension is sent by OpenSSH 8.9+ clients to bind an agent connection to the
+// SSH session it's being used for, see PROTOCOL.agent in the OpenSSH source
+const SessionBindExtension = "session-bind@openssh.com"
+
+// Maximum number of hops tracked per connection, matching OpenSSH's ssh-agent
+const maxSessionBinds = 16
+
+// sessionBind records one hop of the path an agent connection has been forwarded along
+type sessionBind struct {
+	hostKey    ssh.PublicKey
+	sessionID  []byte
+	forwarding bool
+}
+
+// sessionBindMsg is the body of a session-bind@openssh.com extension request
+type sessionBindMsg struct {
+	HostKey      []byte
+	SessionID    []byte
+	Signature    []byte
+	IsForwarding bool
+}
+
+// parseSessionBind parses and verifies a session-bind@openssh.com request. The host must
+// have signed the session identifier with its host key
+func parseSessionBind(contents []byte) (*sessionBind, error) {
+	var msg sessionBindMsg
+	if err := ssh.Unmarshal(contents, &msg); err != nil {
+		return nil, fmt.Errorf("error parsing session-bind request: %s", err.Error())
+	}
+	hostKey, err := ssh.ParsePublicKey(msg.HostKey)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing session-bind host key: %s", err.Error())
+	}
+	signature := &ssh.Signature{}
+	if err := ssh.Unmarshal(msg.Signature, signature); err != nil {
+		return nil, fmt.Errorf("error parsing session-bind signature: %s", err.Error())
+	}
+	if err := hostKey.Verify(msg.SessionID, signature); err != nil {
+		return nil, fmt.Errorf("invalid session-bind signature from %s: %s", ssh.FingerprintSHA256(hostKey), err.Error())
+	}
+	return &sessionBind{
+		hostKey:    hostKey,
+		sessionID:  msg.SessionID,
+		forwarding: msg.IsForwarding,
+	}, nil
+}
+
+// addSessionBind records a verified session bind for this connection
+func (c *connAgent) addSessionBind(bind *sessionBind) error {
+	for _, existing := range c.binds {
+		if bytes.Equal(existing.sessionID, bind.sessionID) {
+			// Clients may repeat a bind, but it must be for the same host
+			if !bytes.Equal(existing.hostKey.Marshal(), bind.hostKey.Marshal()) {
+				return errors.New("session-bind for existing session with a different host key")
+			}
+			return nil
+		}
+	}
+	// Once bound for authentication, the connection can't be bound to anything else
+	if len(c.binds) > 0 && !c.binds[len(c.binds)-1].forwarding {
+		return errors.New("session-bind on connection already bound for authentication")
+	}
+	if len(c.binds) >= maxSessionBinds {
+		return errors.New("too many session-binds on connection")
+	}
+	c.binds = append(c.binds, bind)
+	return nil
+}
+
+// destination returns the host key of the host this connection is authenticating to, or
+// nil if it isn't known
+func (c *connAgent) destination() ssh.PublicKey {
+	if len(c.binds) == 0 || c.binds[len(c.binds)-1].forwarding {
+		return nil
+	}
+	return c.binds[len(c.binds)-1].hostKey
+}
+
+// checkDestination enforces the configured destination constraints before signing. Every
+// host in the chain must be permitted, and the data being signed must be for the session
+// that the connection was bound to
+func (c *connAgent) checkDestination(data []byte) error {
+	// Without any constraints the agent can be used from anywhere
+	if len(c.config.Destinations) == 0 {
+		return nil
+	}
+	if len(c.binds) == 0 {
+		return errors.New("refusing to sign without session-bind information, a newer ssh client is required")
+	}
+	last := c.binds[len(c.binds)-1]
+	if last.forwarding {
+		return errors.New("refusing to sign on a forwarded connection without a known destination")
+	}
+
+	// Check every hop, including the final destination, is permitted
+	for _, bind := range c.binds {
+		if !c.destinationAllowed(bind.hostKey) {
+			return fmt.Errorf("refusing to sign for host %s, not a permitted destination", ssh.FingerprintSHA256(bind.hostKey))
+		}
+	}
+
+	// A user authentication request starts with the session identifier
+	sessionID := ssh.Marshal(struct{ ID []byte }{last.sessionID})
+	if !bytes.HasPrefix(data, sessionID) {
+		return errors.New("refusing to sign data for a session the connection isn't bound to")
+	}
+	return nil
+}
+
+// destinationAllowed reports whether the host key is a permitted destination
+func (c *connAgent) destinationAllowed(hostKey ssh.PublicKey) bool {
+	for _, allowed := range c.config.Destinations {
+		if bytes.Equal(allowed.Marshal(), hostKey.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,224 @@
+package sshizzleagent
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"github.com/thalesgroup/sshizzle/internal/config"
+	"golang.org/x/crypto/ssh"
+)
+
+// newHostKey returns a signer for a new ed25519 host key
+func newHostKey(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// sessionBindRequest returns the body of a session-bind request for sessionID, signed by signer
+func sessionBindRequest(t *testing.T, hostKey ssh.PublicKey, signer ssh.Signer, sessionID []byte, forwarding bool) []byte {
+	t.Helper()
+	signature, err := signer.Sign(rand.Reader, sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ssh.Marshal(sessionBindMsg{
+		HostKey:      hostKey.Marshal(),
+		SessionID:    sessionID,
+		Signature:    ssh.Marshal(signature),
+		IsForwarding: forwarding,
+	})
+}
+
+func TestParseSessionBind(t *testing.T) {
+	host := newHostKey(t)
+	other := newHostKey(t)
+	sessionID := []byte("session-id")
+
+	tests := []struct {
+		name     string
+		contents []byte
+		err      string
+	}{
+		{"valid", sessionBindRequest(t, host.PublicKey(), host, sessionID, false), ""},
+		{"valid forwarding", sessionBindRequest(t, host.PublicKey(), host, sessionID, true), ""},
+		{"garbage", []byte("garbage"), "error parsing session-bind request"},
+		{"bad host key", ssh.Marshal(sessionBindMsg{HostKey: []byte("key"), SessionID: sessionID}), "error parsing session-bind host key"},
+		{"bad signature", ssh.Marshal(sessionBindMsg{HostKey: host.PublicKey().Marshal(), SessionID: sessionID, Signature: []byte("sig")}), "error parsing session-bind signature"},
+		{"signed by another host", sessionBindRequest(t, host.PublicKey(), other, sessionID, false), "invalid session-bind signature"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bind, err := parseSessionBind(test.contents)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if string(bind.hostKey.Marshal()) != string(host.PublicKey().Marshal()) || string(bind.sessionID) != string(sessionID) {
+				t.Fatal("session bind doesn't match the request")
+			}
+		})
+	}
+}
+
+func TestAddSessionBind(t *testing.T) {
+	hostA := newHostKey(t).PublicKey()
+	hostB := newHostKey(t).PublicKey()
+
+	tests := []struct {
+		name  string
+		binds []*sessionBind
+		err   string
+	}{
+		{
+			name:  "forwarded then authenticating",
+			binds: []*sessionBind{{hostA, []byte("1"), true}, {hostB, []byte("2"), false}},
+		},
+		{
+			name:  "repeated bind",
+			binds: []*sessionBind{{hostA, []byte("1"), false}, {hostA, []byte("1"), false}},
+		},
+		{
+			name:  "repeated session with a different host key",
+			binds: []*sessionBind{{hostA, []byte("1"), true}, {hostB, []byte("1"), true}},
+			err:   "different host key",
+		},
+		{
+			name:  "rebind after authentication",
+			binds: []*sessionBind{{hostA, []byte("1"), false}, {hostB, []byte("2"), false}},
+			err:   "already bound for authentication",
+		},
+		{
+			name:  "rebind forwarding after authentication",
+			binds: []*sessionBind{{hostA, []byte("1"), false}, {hostB, []byte("2"), true}},
+			err:   "already bound for authentication",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &connAgent{}
+			var err error
+			for _, bind := range test.binds {
+				if err = c.addSessionBind(bind); err != nil {
+					break
+				}
+			}
+			if test.err == "" && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Fatalf("expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestAddSessionBindHopLimit(t *testing.T) {
+	host := newHostKey(t).PublicKey()
+	c := &connAgent{}
+	for i := 0; i < maxSessionBinds; i++ {
+		if err := c.addSessionBind(&sessionBind{host, []byte{byte(i)}, true}); err != nil {
+			t.Fatalf("hop %d: unexpected error: %s", i, err)
+		}
+	}
+	err := c.addSessionBind(&sessionBind{host, []byte{maxSessionBinds}, true})
+	if err == nil || !strings.Contains(err.Error(), "too many session-binds") {
+		t.Fatalf("expected hop limit error, got %v", err)
+	}
+}
+
+func TestCheckDestination(t *testing.T) {
+	allowed := newHostKey(t).PublicKey()
+	denied := newHostKey(t).PublicKey()
+	sessionID := []byte("session-id")
+	// A user authentication request starts with the session identifier
+	data := append(ssh.Marshal(struct{ ID []byte }{sessionID}), []byte("userauth request")...)
+
+	tests := []struct {
+		name         string
+		destinations []ssh.PublicKey
+		binds        []*sessionBind
+		data         []byte
+		err          string
+	}{
+		{
+			name: "no constraints",
+			data: data,
+		},
+		{
+			name:         "allowed destination",
+			destinations: []ssh.PublicKey{allowed},
+			binds:        []*sessionBind{{allowed, sessionID, false}},
+			data:         data,
+		},
+		{
+			name:         "allowed through an allowed hop",
+			destinations: []ssh.PublicKey{allowed},
+			binds:        []*sessionBind{{allowed, []byte("hop"), true}, {allowed, sessionID, false}},
+			data:         data,
+		},
+		{
+			name:         "no session bind",
+			destinations: []ssh.PublicKey{allowed},
+			data:         data,
+			err:          "without session-bind information",
+		},
+		{
+			name:         "forwarded without destination",
+			destinations: []ssh.PublicKey{allowed},
+			binds:        []*sessionBind{{allowed, sessionID, true}},
+			data:         data,
+			err:          "without a known destination",
+		},
+		{
+			name:         "denied destination",
+			destinations: []ssh.PublicKey{allowed},
+			binds:        []*sessionBind{{denied, sessionID, false}},
+			data:         data,
+			err:          "not a permitted destination",
+		},
+		{
+			name:         "denied hop",
+			destinations: []ssh.PublicKey{allowed},
+			binds:        []*sessionBind{{denied, []byte("hop"), true}, {allowed, sessionID, false}},
+			data:         data,
+			err:          "not a permitted destination",
+		},
+		{
+			name:         "data for another session",
+			destinations: []ssh.PublicKey{allowed},
+			binds:        []*sessionBind{{allowed, sessionID, false}},
+			data:         ssh.Marshal(struct{ ID []byte }{[]byte("other-session")}),
+			err:          "isn't bound to",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &connAgent{
+				sshizzleAgent: &sshizzleAgent{config: &config.SSHizzleConfig{Destinations: test.destinations}},
+				binds:         test.binds,
+			}
+			err := c.checkDestination(test.data)
+			if test.err == "" && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Fatalf("expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package sshizzleagent
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// First file descriptor passed by systemd socket activation
+// https://www.freedesktop.org/software/systemd/man/sd_listen_fds.html
+const listenFdsStart = 3
+
+// Listen returns a listener for the agent. If the agent was started by systemd socket
+// activation, the inherited socket is used, otherwise a new Unix socket is created at
+// the path specified. The boolean result reports whether the socket was inherited
+func Listen(socket string) (net.Listener, bool, error) {
+	// Check if systemd has passed us a listener
+	listener, err := systemdListener()
+	if err != nil {
+		return nil, false, err
+	}
+	if listener != nil {
+		return listener, true, nil
+	}
+
+	// Ensure the socket directory exists and is only accessible by this user
+	if err := socketDir(filepath.Dir(socket)); err != nil {
+		return nil, false, err
+	}
+
+	// Ensure the socket isn't held by another running agent, and clean it up if stale
+	if err := removeStaleSocket(socket); err != nil {
+		return nil, false, err
+	}
+
+	// Create a new Unix socket and listen
+	syscall.Umask(0077)
+	listener, err = net.Listen("unix", socket)
+	if err != nil {
+		return nil, false, fmt.Errorf("error listening on socket: %s", err.Error())
+	}
+	return listener, false, nil
+}
+
+// socketDir creates the directory for the socket, and checks it's owned by this user and only
+// accessible by them. The directory may be in a shared location like $TMPDIR, so another user
+// could have created it first
+func socketDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("error creating socket directory: %s", err.Error())
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return fmt.Errorf("error checking socket directory: %s", err.Error())
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("socket directory %s is not a directory", dir)
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("socket directory %s is not owned by the current user", dir)
+	}
+	if info.Mode().Perm() != 0700 {
+		return fmt.Errorf("socket directory %s must only be accessible by the current user (mode 0700), not %#o", dir, info.Mode().Perm())
+	}
+	return nil
+}
+
+// systemdListener returns the listener passed via systemd socket activation (LISTEN_FDS),
+// or nil if the agent wasn't socket activated
+func systemdListener() (net.Listener, error) {
+	// Only use the file descriptors if they were intended for this process
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, nil
+	}
+
+	// Unset the variables so they aren't inherited by any child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	// The agent only serves a single socket, so take the first file descriptor
+	syscall.CloseOnExec(listenFdsStart)
+	file := os.NewFile(uintptr(listenFdsStart), "LISTEN_FD_3")
+	defer file.Close()
+
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("error using systemd socket: %s", err.Error())
+	}
+	return listener, nil
+}
+
+// removeStaleSocket checks if a socket already exists at the path specified. If another
+// agent is listening on it an error is returned, otherwise the stale socket is removed
+func removeStaleSocket(socket string) error {
+	info, err := os.Lstat(socket)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error checking socket %s: %s", socket, err.Error())
+	}
+	// Don't remove anything that isn't a socket
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s already exists and is not a socket", socket)
+	}
+
+	// Try to connect to the socket to see if an agent is still running
+	conn, err := net.DialTimeout("unix", socket, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("socket %s already exists and an agent is listening on it", socket)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("error checking socket %s: %s", socket, err.Error())
+	}
+
+	// Nothing is listening, so the socket is stale
+	if err := os.Remove(socket); err != nil {
+		return fmt.Errorf("error removing stale socket %s: %s", socket, err.Error())
+	}
+	return nil
+}
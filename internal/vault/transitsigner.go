@@ -0,0 +1,407 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Timeout for all calls to Vault
+const RequestTimeout = 20 * time.Second
+
+// PublicKeyTTL is how long the public key is cached before it's fetched from Vault again
+const PublicKeyTTL = time.Hour
+
+// DefaultMount is the path the transit secrets engine is usually mounted at
+const DefaultMount = "transit"
+
+// Config locates a key in the transit secrets engine of a Vault server
+type Config struct {
+	// Address of the Vault server, e.g. https://vault.example.com:8200
+	Address string
+	// Token authenticating with Vault, which needs the read capability on transit/keys/<key>
+	// and update on transit/sign/<key>/*
+	Token string
+	// Namespace of the transit engine, for Vault Enterprise
+	Namespace string
+	// Mount path of the transit engine, defaulting to DefaultMount
+	Mount string
+	// Key is the name of the RSA key
+	Key string
+	// Version of the key to use, or 0 for the latest
+	Version int
+}
+
+// ConfigFromEnv reads a Config from the environment variables used by the Vault CLI, VAULT_ADDR,
+// VAULT_TOKEN and VAULT_NAMESPACE, and VAULT_TRANSIT_MOUNT, VAULT_TRANSIT_KEY and
+// VAULT_KEY_VERSION. The token is read from ~/.vault-token if VAULT_TOKEN isn't set
+func ConfigFromEnv() (*Config, error) {
+	c := &Config{
+		Address:   os.Getenv("VAULT_ADDR"),
+		Token:     os.Getenv("VAULT_TOKEN"),
+		Namespace: os.Getenv("VAULT_NAMESPACE"),
+		Mount:     os.Getenv("VAULT_TRANSIT_MOUNT"),
+		Key:       os.Getenv("VAULT_TRANSIT_KEY"),
+	}
+	if c.Token == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			if token, err := ioutil.ReadFile(home + "/.vault-token"); err == nil {
+				c.Token = strings.TrimSpace(string(token))
+			}
+		}
+	}
+	if version := os.Getenv("VAULT_KEY_VERSION"); version != "" {
+		v, err := strconv.Atoi(version)
+		if err != nil || v < 1 {
+			return nil, fmt.Errorf("invalid VAULT_KEY_VERSION '%s', must be a positive number", version)
+		}
+		c.Version = v
+	}
+	return c, nil
+}
+
+// TransitSigner signs with an RSA key in the transit secrets engine of a HashiCorp Vault server
+type TransitSigner struct {
+	crypto.Signer
+	client *http.Client
+	config Config
+
+	// The public key is cached so it's only fetched occasionally, and signatures can be
+	// verified against it. keyVersion is the version it belongs to, which is used to sign
+	mu         sync.Mutex
+	publicKey  *rsa.PublicKey
+	keyVersion int
+	fetchedAt  time.Time
+}
+
+// NewTransitSigner returns a TransitSigner for the key in config. It should be reused, so the
+// public key is cached
+func NewTransitSigner(config Config) (*TransitSigner, error) {
+	if config.Address == "" {
+		return nil, errors.New("Vault address must be set")
+	}
+	if _, err := url.Parse(config.Address); err != nil {
+		return nil, errors.Wrap(err, "invalid Vault address")
+	}
+	if config.Token == "" {
+		return nil, errors.New("Vault token must be set")
+	}
+	if config.Key == "" {
+		return nil, errors.New("Vault transit key name must be set")
+	}
+	if config.Mount == "" {
+		config.Mount = DefaultMount
+	}
+	config.Address = strings.TrimSuffix(config.Address, "/")
+	config.Mount = strings.Trim(config.Mount, "/")
+	return &TransitSigner{
+		client: &http.Client{Timeout: RequestTimeout},
+		config: config,
+	}, nil
+}
+
+// Public returns the public key of the Vault key, or nil if it can't be fetched
+func (s *TransitSigner) Public() crypto.PublicKey {
+	publicKey, err := s.PublicKey(context.Background())
+	if err != nil {
+		return nil
+	}
+	return publicKey
+}
+
+// PublicKey returns the cached public key, fetching it from Vault if it's older than PublicKeyTTL
+func (s *TransitSigner) PublicKey(ctx context.Context) (*rsa.PublicKey, error) {
+	publicKey, _, err := s.cachedKey(ctx)
+	return publicKey, err
+}
+
+// KeyVersion returns the version of the cached public key, which signatures are made with. It's
+// empty until the public key has been fetched
+func (s *TransitSigner) KeyVersion() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.keyVersion == 0 {
+		return ""
+	}
+	return strconv.Itoa(s.keyVersion)
+}
+
+// cachedKey returns the cached public key and its version, fetching them from Vault if they're
+// older than PublicKeyTTL
+func (s *TransitSigner) cachedKey(ctx context.Context) (*rsa.PublicKey, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.publicKey != nil && time.Since(s.fetchedAt) < PublicKeyTTL {
+		return s.publicKey, s.keyVersion, nil
+	}
+	publicKey, keyVersion, err := s.fetchPublicKey(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	s.publicKey = publicKey
+	s.keyVersion = keyVersion
+	s.fetchedAt = time.Now()
+	return publicKey, keyVersion, nil
+}
+
+// keyResponse is the response to reading a transit key
+type keyResponse struct {
+	Data struct {
+		Type          string `json:"type"`
+		LatestVersion int    `json:"latest_version"`
+		Keys          map[string]struct {
+			PublicKey string `json:"public_key"`
+		} `json:"keys"`
+	} `json:"data"`
+}
+
+// fetchPublicKey gets the public key and its version from Vault
+func (s *TransitSigner) fetchPublicKey(ctx context.Context) (*rsa.PublicKey, int, error) {
+	var key keyResponse
+	if err := s.do(ctx, http.MethodGet, "keys/"+url.PathEscape(s.config.Key), nil, &key); err != nil {
+		return nil, 0, errors.Wrap(err, "failed to get public key from Vault")
+	}
+	if !strings.HasPrefix(key.Data.Type, "rsa-") {
+		return nil, 0, fmt.Errorf("key in Vault is a %s key, not an RSA key", key.Data.Type)
+	}
+
+	version := s.config.Version
+	if version == 0 {
+		version = key.Data.LatestVersion
+	}
+	versionKey, ok := key.Data.Keys[strconv.Itoa(version)]
+	if !ok {
+		return nil, 0, fmt.Errorf("version %d of the key isn't available in Vault", version)
+	}
+
+	rsaKey, err := parsePublicKey(versionKey.PublicKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	return rsaKey, version, nil
+}
+
+// PublicKeys returns the public keys of the versions of the key Vault still has, newest first,
+// for hosts to trust while the key is rotated. Only the pinned version is returned if there is
+// one. They're always fetched from Vault, rather than cached
+func (s *TransitSigner) PublicKeys(ctx context.Context) ([]*rsa.PublicKey, error) {
+	if s.config.Version != 0 {
+		publicKey, _, err := s.fetchPublicKey(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return []*rsa.PublicKey{publicKey}, nil
+	}
+
+	var key keyResponse
+	if err := s.do(ctx, http.MethodGet, "keys/"+url.PathEscape(s.config.Key), nil, &key); err != nil {
+		return nil, errors.Wrap(err, "failed to get public keys from Vault")
+	}
+	if !strings.HasPrefix(key.Data.Type, "rsa-") {
+		return nil, fmt.Errorf("key in Vault is a %s key, not an RSA key", key.Data.Type)
+	}
+	// Versions below min_decryption_version are archived, and not listed
+	versions := make([]int, 0, len(key.Data.Keys))
+	for version := range key.Data.Keys {
+		if v, err := strconv.Atoi(version); err == nil {
+			versions = append(versions, v)
+		}
+	}
+	if len(versions) == 0 {
+		return nil, errors.New("key in Vault has no versions available")
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+
+	publicKeys := make([]*rsa.PublicKey, 0, len(versions))
+	for _, version := range versions {
+		publicKey, err := parsePublicKey(key.Data.Keys[strconv.Itoa(version)].PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		publicKeys = append(publicKeys, publicKey)
+	}
+	return publicKeys, nil
+}
+
+// parsePublicKey decodes an RSA public key from Vault, which is PEM encoded PKIX
+func parsePublicKey(encoded string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(encoded))
+	if block == nil {
+		return nil, errors.New("failed to decode public key from Vault")
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse public key from Vault")
+	}
+	rsaKey, ok := publicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("key in Vault is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// signRequest and signResponse are the bodies of a transit sign request
+type signRequest struct {
+	Input              string `json:"input"`
+	Prehashed          bool   `json:"prehashed"`
+	SignatureAlgorithm string `json:"signature_algorithm"`
+	KeyVersion         int    `json:"key_version"`
+}
+
+type signResponse struct {
+	Data struct {
+		Signature string `json:"signature"`
+	} `json:"data"`
+}
+
+// hashAlgorithms are the names Vault uses for the hashes supported
+var hashAlgorithms = map[crypto.Hash]string{
+	crypto.SHA256: "sha2-256",
+	crypto.SHA384: "sha2-384",
+	crypto.SHA512: "sha2-512",
+}
+
+// CurrentKey returns a signer using only the version of the key that's currently cached, and
+// that version, so the version recorded with a signature is always the one that made it
+func (s *TransitSigner) CurrentKey(ctx context.Context) (crypto.Signer, string, error) {
+	publicKey, keyVersion, err := s.cachedKey(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	return &keyVersionSigner{signer: s, publicKey: publicKey, keyVersion: keyVersion}, strconv.Itoa(keyVersion), nil
+}
+
+// keyVersionSigner signs with one version of the key in Vault
+type keyVersionSigner struct {
+	signer     *TransitSigner
+	publicKey  *rsa.PublicKey
+	keyVersion int
+}
+
+// Public returns the public key of the version
+func (k *keyVersionSigner) Public() crypto.PublicKey {
+	return k.publicKey
+}
+
+// Sign a digest with the version of the key
+func (k *keyVersionSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return k.signer.sign(k.publicKey, k.keyVersion, digest, opts)
+}
+
+// Sign a digest with the private key in Vault
+func (s *TransitSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	// Sign with the version of the key we're handing out the public key of
+	publicKey, keyVersion, err := s.cachedKey(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return s.sign(publicKey, keyVersion, digest, opts)
+}
+
+// sign signs a digest with a version of the key, checking the signature with its public key
+func (s *TransitSigner) sign(publicKey *rsa.PublicKey, keyVersion int, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hashAlgorithm, ok := hashAlgorithms[opts.HashFunc()]
+	if !ok {
+		return nil, fmt.Errorf("hash %s is not supported by Vault", opts.HashFunc().String())
+	}
+
+	var response signResponse
+	err := s.do(context.Background(), http.MethodPost, "sign/"+url.PathEscape(s.config.Key)+"/"+hashAlgorithm, &signRequest{
+		Input:              base64.StdEncoding.EncodeToString(digest),
+		Prehashed:          true,
+		SignatureAlgorithm: "pkcs1v15",
+		KeyVersion:         keyVersion,
+	}, &response)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to sign with Vault")
+	}
+
+	// Signatures are of the form vault:v<version>:<base64 signature>
+	parts := strings.SplitN(response.Data.Signature, ":", 3)
+	if len(parts) != 3 || parts[0] != "vault" {
+		return nil, errors.New("unexpected signature format from Vault")
+	}
+	signature, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("failed to decode signature result from Vault")
+	}
+
+	// Check the signature matches the public key we're handing out, in case the response was
+	// corrupted or the key has been replaced
+	if err := rsa.VerifyPKCS1v15(publicKey, opts.HashFunc(), digest, signature); err != nil {
+		// Fetch the key again next time
+		s.mu.Lock()
+		s.publicKey = nil
+		s.mu.Unlock()
+		return nil, errors.New("signature from Vault doesn't match the cached public key")
+	}
+
+	// Success!
+	return signature, nil
+}
+
+// do makes a request to the transit engine, decoding the JSON response into out
+func (s *TransitSigner) do(ctx context.Context, method string, path string, in interface{}, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, RequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("%s/v1/%s/%s", s.config.Address, s.config.Mount, path), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", s.config.Token)
+	req.Header.Set("X-Vault-Request", "true")
+	if s.config.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", s.config.Namespace)
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		// Vault describes what went wrong in a list of errors
+		var failure struct {
+			Errors []string `json:"errors"`
+		}
+		if json.Unmarshal(data, &failure) == nil && len(failure.Errors) > 0 {
+			return fmt.Errorf("Vault returned %d: %s", res.StatusCode, strings.Join(failure.Errors, ", "))
+		}
+		return fmt.Errorf("Vault returned %d", res.StatusCode)
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,329 @@
+package vault
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeVault serves the parts of the transit secrets engine used by TransitSigner
+type fakeVault struct {
+	t        *testing.T
+	keyType  string
+	keys     map[int]*rsa.PrivateKey
+	latest   int
+	archived int
+	// signature, if set, replaces the signature returned by sign requests
+	signature string
+	// signedVersions records the key_version of each sign request
+	signedVersions []int
+}
+
+// newFakeVault returns a fake Vault with versions of an RSA key, and a TransitSigner using it
+func newFakeVault(t *testing.T, versions int, config Config) (*fakeVault, *TransitSigner) {
+	t.Helper()
+	v := &fakeVault{t: t, keyType: "rsa-2048", keys: make(map[int]*rsa.PrivateKey), latest: versions}
+	for version := 1; version <= versions; version++ {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v.keys[version] = key
+	}
+	server := httptest.NewServer(v)
+	t.Cleanup(server.Close)
+
+	config.Address = server.URL + "/"
+	config.Token = "s.token"
+	if config.Key == "" {
+		config.Key = "sshizzle"
+	}
+	signer, err := NewTransitSigner(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v, signer
+}
+
+func (v *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Vault-Token") != "s.token" {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"errors":["permission denied"]}`))
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/v1/transit/keys/sshizzle":
+		response := map[string]interface{}{}
+		keys := map[string]interface{}{}
+		for version, key := range v.keys {
+			if version <= v.archived {
+				continue
+			}
+			der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+			if err != nil {
+				v.t.Error(err)
+			}
+			keys[strconv.Itoa(version)] = map[string]string{
+				"public_key": string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+			}
+		}
+		response["data"] = map[string]interface{}{
+			"type":           v.keyType,
+			"latest_version": v.latest,
+			"keys":           keys,
+		}
+		_ = json.NewEncoder(w).Encode(response)
+
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/transit/sign/sshizzle/sha2-256":
+		var request signRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			v.t.Error(err)
+		}
+		if !request.Prehashed || request.SignatureAlgorithm != "pkcs1v15" {
+			v.t.Errorf("unexpected sign request %+v", request)
+		}
+		v.signedVersions = append(v.signedVersions, request.KeyVersion)
+		digest, err := base64.StdEncoding.DecodeString(request.Input)
+		if err != nil {
+			v.t.Error(err)
+		}
+		signature, err := rsa.SignPKCS1v15(rand.Reader, v.keys[request.KeyVersion], crypto.SHA256, digest)
+		if err != nil {
+			v.t.Error(err)
+		}
+		encoded := fmt.Sprintf("vault:v%d:%s", request.KeyVersion, base64.StdEncoding.EncodeToString(signature))
+		if v.signature != "" {
+			encoded = v.signature
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]string{"signature": encoded},
+		})
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"errors":[]}`))
+	}
+}
+
+func TestFetchPublicKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		version  int
+		keyType  string
+		token    string
+		expected int
+		err      string
+	}{
+		{name: "latest version", expected: 3},
+		{name: "pinned version", version: 2, expected: 2},
+		{name: "missing version", version: 4, err: "version 4 of the key isn't available"},
+		{name: "not an RSA key", keyType: "ed25519", err: "not an RSA key"},
+		{name: "Vault error", token: "s.wrong", err: "Vault returned 403: permission denied"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vault, signer := newFakeVault(t, 3, Config{Version: test.version})
+			if test.keyType != "" {
+				vault.keyType = test.keyType
+			}
+			if test.token != "" {
+				signer.config.Token = test.token
+			}
+
+			publicKey, version, err := signer.fetchPublicKey(context.Background())
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if version != test.expected {
+				t.Fatalf("got version %d, expected %d", version, test.expected)
+			}
+			if !publicKey.Equal(&vault.keys[test.expected].PublicKey) {
+				t.Fatal("public key doesn't match the key version")
+			}
+		})
+	}
+}
+
+func TestSign(t *testing.T) {
+	vault, signer := newFakeVault(t, 2, Config{})
+	digest := sha256.Sum256([]byte("data"))
+
+	signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := rsa.VerifyPKCS1v15(&vault.keys[2].PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+		t.Fatalf("signature doesn't verify with the latest key: %s", err)
+	}
+	if len(vault.signedVersions) != 1 || vault.signedVersions[0] != 2 {
+		t.Fatalf("signed with versions %v, expected the latest", vault.signedVersions)
+	}
+	if signer.KeyVersion() != "2" {
+		t.Fatalf("got key version %q, expected 2", signer.KeyVersion())
+	}
+
+	if _, err := signer.Sign(rand.Reader, digest[:], crypto.SHA1); err == nil || !strings.Contains(err.Error(), "not supported") {
+		t.Fatalf("expected unsupported hash error, got %v", err)
+	}
+}
+
+func TestCurrentKey(t *testing.T) {
+	vault, signer := newFakeVault(t, 2, Config{})
+	keySigner, version, err := signer.CurrentKey(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if version != "2" {
+		t.Fatalf("got version %s, expected 2", version)
+	}
+
+	// The key is rotated and the cache refreshed after the version was recorded
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vault.keys[3] = key
+	vault.latest = 3
+	signer.mu.Lock()
+	signer.publicKey = nil
+	signer.mu.Unlock()
+	if _, err := signer.PublicKey(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	digest := sha256.Sum256([]byte("data"))
+	signature, err := keySigner.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := rsa.VerifyPKCS1v15(&vault.keys[2].PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+		t.Fatalf("signature wasn't made with the version returned: %s", err)
+	}
+	if !keySigner.Public().(*rsa.PublicKey).Equal(&vault.keys[2].PublicKey) {
+		t.Fatal("public key isn't the version returned")
+	}
+}
+
+func TestSignSSH(t *testing.T) {
+	// Signatures must be marshalled as SSH signatures which verify with the CA public key
+	vault, signer := newFakeVault(t, 1, Config{})
+	sshSigner, err := ssh.NewSignerFromSigner(signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	algorithmSigner, ok := sshSigner.(ssh.AlgorithmSigner)
+	if !ok {
+		t.Fatal("signer doesn't support choosing the algorithm")
+	}
+	data := []byte("certificate")
+	signature, err := algorithmSigner.SignWithAlgorithm(rand.Reader, data, ssh.KeyAlgoRSASHA256)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if signature.Format != ssh.KeyAlgoRSASHA256 {
+		t.Fatalf("got signature format %s", signature.Format)
+	}
+	publicKey, err := ssh.NewPublicKey(&vault.keys[1].PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := publicKey.Verify(data, signature); err != nil {
+		t.Fatalf("SSH signature doesn't verify: %s", err)
+	}
+}
+
+func TestSignBadResponse(t *testing.T) {
+	tests := []struct {
+		name      string
+		signature string
+		err       string
+	}{
+		{"not a Vault signature", "signature", "unexpected signature format"},
+		{"missing version", "vault:c2ln", "unexpected signature format"},
+		{"bad base64", "vault:v1:!!!", "failed to decode signature result"},
+		{"wrong signature", "vault:v1:" + base64.StdEncoding.EncodeToString(make([]byte, 256)), "doesn't match the cached public key"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vault, signer := newFakeVault(t, 1, Config{})
+			vault.signature = test.signature
+			digest := sha256.Sum256([]byte("data"))
+			_, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+
+	// A signature that doesn't verify means the public key is fetched again
+	vault, signer := newFakeVault(t, 1, Config{})
+	vault.signature = "vault:v1:" + base64.StdEncoding.EncodeToString(make([]byte, 256))
+	digest := sha256.Sum256([]byte("data"))
+	if _, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256); err == nil {
+		t.Fatal("expected error")
+	}
+	signer.mu.Lock()
+	cached := signer.publicKey
+	signer.mu.Unlock()
+	if cached != nil {
+		t.Fatal("public key still cached after a bad signature")
+	}
+}
+
+func TestPublicKeys(t *testing.T) {
+	tests := []struct {
+		name     string
+		version  int
+		archived int
+		expected []int
+	}{
+		{name: "all versions newest first", expected: []int{3, 2, 1}},
+		{name: "archived versions aren't listed", archived: 1, expected: []int{3, 2}},
+		{name: "pinned version only", version: 2, expected: []int{2}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vault, signer := newFakeVault(t, 3, Config{Version: test.version})
+			vault.archived = test.archived
+
+			publicKeys, err := signer.PublicKeys(context.Background())
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(publicKeys) != len(test.expected) {
+				t.Fatalf("got %d public keys, expected %d", len(publicKeys), len(test.expected))
+			}
+			for i, version := range test.expected {
+				if !publicKeys[i].Equal(&vault.keys[version].PublicKey) {
+					t.Errorf("public key %d isn't version %d", i, version)
+				}
+			}
+		})
+	}
+
+	vault, signer := newFakeVault(t, 1, Config{})
+	vault.archived = 1
+	if _, err := signer.PublicKeys(context.Background()); err == nil || !strings.Contains(err.Error(), "no versions") {
+		t.Fatalf("expected no versions error, got %v", err)
+	}
+}
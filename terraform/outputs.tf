@@ -11,6 +11,10 @@ output "app-sshizzle-ca" {
   value = azuread_application.app-sshizzle-ca.application_id
 }
 
+output "environment" {
+  value = var.environment
+}
+
 output "function-hostname" {
   value = azurerm_function_app.func-sshizzle.default_hostname
 }
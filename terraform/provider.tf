@@ -1,8 +1,10 @@
 provider "azurerm" {
-  version = "~>2.28.0"
+  version     = "~>2.28.0"
+  environment = var.environment
   features {}
 }
 
 provider "azuread" {
-  version = "~>1.0.0"
-}
\ No newline at end of file
+  version     = "~>1.0.0"
+  environment = var.environment
+}
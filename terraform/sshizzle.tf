@@ -1,6 +1,14 @@
 locals {
   // Generate name in advance to avoid cyclic dependency
   keyvault_name = "${var.prefix}-kv-sshizzle"
+
+  // App Service domain and Azure AD token issuer of each cloud
+  clouds = {
+    public       = { sites_suffix = "azurewebsites.net", issuer = "https://sts.windows.net" }
+    usgovernment = { sites_suffix = "azurewebsites.us", issuer = "https://login.microsoftonline.us" }
+    china        = { sites_suffix = "chinacloudsites.cn", issuer = "https://sts.chinacloudapi.cn" }
+  }
+  function_url = "https://func-sshizzle-${lower(random_id.function-id.b64_url)}.${local.clouds[var.environment].sites_suffix}"
 }
 
 // Create a resource group
@@ -102,9 +110,9 @@ resource "azuread_application" "app-sshizzle-agent" {
 resource "azuread_application" "app-sshizzle-ca" {
   name                       = "app-sshizzle-ca"
   owners                     = [data.azurerm_client_config.current.object_id]
-  homepage                   = "https://func-sshizzle-${lower(random_id.function-id.b64_url)}.azurewebsites.net"
-  identifier_uris            = ["https://func-sshizzle-${lower(random_id.function-id.b64_url)}.azurewebsites.net"]
-  reply_urls                 = ["https://func-sshizzle-${lower(random_id.function-id.b64_url)}.azurewebsites.net/.auth/login/aad/callback"]
+  homepage                   = local.function_url
+  identifier_uris            = [local.function_url]
+  reply_urls                 = ["${local.function_url}/.auth/login/aad/callback"]
   type                       = "webapp/api"
   available_to_other_tenants = false
 
@@ -153,23 +161,55 @@ resource "azurerm_function_app" "func-sshizzle" {
   client_affinity_enabled = true
   enable_builtin_logging  = true
 
-  // Force users to sign in with Azure AD before they can invoke the function
+  // Force users to sign in with Azure AD before they can invoke the function. If break-glass
+  // certificates are enabled, anonymous requests are passed through so the break-glass
+  // function can be reached without Azure AD, and the other functions reject them instead
   auth_settings {
     enabled                       = true
     default_provider              = "AzureActiveDirectory"
-    issuer                        = "https://sts.windows.net/${data.azurerm_client_config.current.tenant_id}/"
+    issuer                        = "${local.clouds[var.environment].issuer}/${data.azurerm_client_config.current.tenant_id}/"
     token_store_enabled           = true
-    unauthenticated_client_action = "RedirectToLoginPage"
+    unauthenticated_client_action = var.break_glass_keys == "" ? "RedirectToLoginPage" : "AllowAnonymous"
 
     active_directory {
       client_id         = azuread_application.app-sshizzle-ca.application_id
       client_secret     = azuread_application_password.apppw-sshizzle-ca.id
-      allowed_audiences = ["https://func-sshizzle-${lower(random_id.function-id.b64_url)}.azurewebsites.net"]
+      allowed_audiences = [local.function_url]
     }
   }
 
   app_settings = {
     KV_NAME = local.keyvault_name
+    // Limits are shared between function instances using the function's storage account
+    RATE_LIMIT_PRINCIPAL = var.rate_limit_principal
+    RATE_LIMIT_IP        = var.rate_limit_ip
+    RATE_LIMIT_STORE     = "table"
+    // Every issued certificate is recorded in the function's storage account
+    LEDGER_STORE   = "table"
+    LEDGER_READERS = join(",", concat([var.login_email], var.ledger_readers))
+    // Webhooks notified of issued and denied certificates
+    NOTIFY_WEBHOOKS = var.notify_webhooks
+    // Offline keys that can approve emergency certificates, each request used once across instances
+    BREAK_GLASS_KEYS      = var.break_glass_keys
+    BREAK_GLASS_THRESHOLD = var.break_glass_threshold
+    BREAK_GLASS_STORE     = "table"
+    // Privileged principals are only issued once someone else approves the request
+    APPROVAL_PRINCIPALS = join(",", var.approval_principals)
+    APPROVERS           = join(",", var.approvers)
+    APPROVAL_STORE      = "table"
+    // Reasons users must give for certificates, recorded in them
+    JUSTIFICATION_PATTERN    = var.justification_pattern
+    JUSTIFICATION_PRINCIPALS = join(",", var.justification_principals)
+    // How users' own principals are derived from their identity
+    USERNAME_CLAIM       = var.username_claim
+    USERNAME_PATTERN     = var.username_pattern
+    USERNAME_REPLACEMENT = var.username_replacement
+    USERNAME_DOMAINS     = join(",", var.username_domains)
+    // Addresses certificates can be used from
+    SOURCE_ADDRESS = join(",", var.source_address)
+    // Cloud containing the Key Vault
+    AZ_ENVIRONMENT = var.environment
+    KV_KEY_VERSION = var.ca_key_version
   }
 
   identity {
@@ -13,8 +13,110 @@ variable "prefix" {
   description  = "Azure name prefix"
 }
 
+variable "environment" {
+  type        = string
+  description = "Azure cloud to deploy to: public, usgovernment or china"
+  default     = "public"
+}
+
 variable "ca_key_size" {
   type        = number
   description = "Size in bits of the RSA CA key (2048, 3072, or 4096)"
   default     = 4096
 }
+
+variable "rate_limit_principal" {
+  type        = string
+  description = "Maximum certificate requests per user, as <requests>/<window> (e.g. 10/1m). Empty to disable"
+  default     = "10/1m"
+}
+
+variable "rate_limit_ip" {
+  type        = string
+  description = "Maximum certificate requests per source IP, as <requests>/<window> (e.g. 30/1m). Empty to disable"
+  default     = "30/1m"
+}
+
+variable "ledger_readers" {
+  type        = list(string)
+  description = "Additional Azure AD principal names or object IDs allowed to query the certificate ledger"
+  default     = []
+}
+
+variable "notify_webhooks" {
+  type        = string
+  description = "JSON array of webhooks notified when certificates are issued or denied. Empty to disable"
+  default     = ""
+}
+
+variable "break_glass_keys" {
+  type        = string
+  description = "Public keys, in authorized_keys format separated by semicolons, that can approve break-glass certificates. Empty to disable"
+  default     = ""
+}
+
+variable "break_glass_threshold" {
+  type        = number
+  description = "Number of break-glass keys that must approve each break-glass certificate"
+  default     = 1
+}
+
+variable "approval_principals" {
+  type        = list(string)
+  description = "Additional principals users can request certificates for, each needing approval"
+  default     = []
+}
+
+variable "approvers" {
+  type        = list(string)
+  description = "Azure AD principal names of users who can approve requests for additional principals"
+  default     = []
+}
+
+variable "justification_pattern" {
+  type        = string
+  description = "Regular expression justifications, such as change tickets, must match. Empty to accept any"
+  default     = ""
+}
+
+variable "justification_principals" {
+  type        = list(string)
+  description = "Glob patterns for principals which can only be issued with a justification"
+  default     = []
+}
+
+variable "username_claim" {
+  type        = string
+  description = "Claim users' principals are derived from. Empty to use their principal name"
+  default     = ""
+}
+
+variable "username_pattern" {
+  type        = string
+  description = "Regular expression users' whole identities must match, rewritten with username_replacement to give their principal"
+  default     = ""
+}
+
+variable "username_replacement" {
+  type        = string
+  description = "Replacement for username_pattern, e.g. \"$1\""
+  default     = ""
+}
+
+variable "username_domains" {
+  type        = list(string)
+  description = "Domains users can sign in from, optionally with a prefix for their principals, e.g. \"partner.com=p-\". Empty to accept any domain"
+  default     = []
+}
+
+variable "source_address" {
+  type        = list(string)
+  description = "IP addresses and CIDRs certificates can be used from, including \"client\" for the requester's address. Empty to allow any"
+  default     = []
+}
+
+variable "ca_key_version" {
+  type        = string
+  description = "Version of the CA key to sign certificates with. Empty to use the latest"
+  default     = ""
+}
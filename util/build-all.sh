@@ -14,3 +14,6 @@ GOOS=windows GOARCH=386 go build -o "${PROJECT_ROOT}/bin/sshizzle-ca.exe" "${PRO
 go build -o "${PROJECT_ROOT}/bin/sshizzle-agent" "${PROJECT_ROOT}/cmd/sshizzle-agent/sshizzle-agent.go"
 go build -o "${PROJECT_ROOT}/bin/sshizzle-host" "${PROJECT_ROOT}/cmd/sshizzle-host/sshizzle-host.go"
 go build -o "${PROJECT_ROOT}/bin/sshizzle-convert" "${PROJECT_ROOT}/cmd/sshizzle-convert/sshizzle-convert.go"
+go build -o "${PROJECT_ROOT}/bin/sshizzle-ledger" "${PROJECT_ROOT}/cmd/sshizzle-ledger/sshizzle-ledger.go"
+go build -o "${PROJECT_ROOT}/bin/sshizzle-breakglass" "${PROJECT_ROOT}/cmd/sshizzle-breakglass/sshizzle-breakglass.go"
+go build -o "${PROJECT_ROOT}/bin/sshizzle-approve" "${PROJECT_ROOT}/cmd/sshizzle-approve/sshizzle-approve.go"
@@ -35,6 +35,9 @@ mkdir -p "${SCRIPT_DIR}/build/bin"
 cp "${PROJECT_ROOT}/host.json" "${SCRIPT_DIR}/build/host.json"
 cp "${PROJECT_ROOT}/bin/sshizzle-ca.exe" "${SCRIPT_DIR}/build/bin/sshizzle-ca.exe"
 cp -r "${PROJECT_ROOT}/sign-agent-key" "${SCRIPT_DIR}/build/sign-agent-key"
+cp -r "${PROJECT_ROOT}/lookup-certificates" "${SCRIPT_DIR}/build/lookup-certificates"
+cp -r "${PROJECT_ROOT}/break-glass" "${SCRIPT_DIR}/build/break-glass"
+cp -r "${PROJECT_ROOT}/approvals" "${SCRIPT_DIR}/build/approvals"
 
 # Zip up the deploy folder
 cd "${SCRIPT_DIR}/build" || exit 1
@@ -47,6 +50,7 @@ cd "${PROJECT_ROOT}/terraform"
 AZ_TENANT_ID=$(terraform output -json | jq -r '."tenant-id".value')
 AZ_CLIENT_ID=$(terraform output -json | jq -r '."app-sshizzle-agent".value')
 AZ_FUNC_HOST=$(terraform output -json | jq -r '."function-hostname".value')
+AZ_ENVIRONMENT=$(terraform output -json | jq -r '."environment".value')
 SERVER_IP=$(terraform output -json | jq -r '."test-server-ip".value')
 ADMIN_USER=$(terraform output -json | jq -r '."admin-user".value')
 cd "${PROJECT_ROOT}" || exit 1
@@ -62,6 +66,7 @@ cat <<-EOF > "${PROJECT_ROOT}/.env"
 AZ_TENANT_ID="${AZ_TENANT_ID}"
 AZ_CLIENT_ID="${AZ_CLIENT_ID}"
 AZ_FUNC_HOST="${AZ_FUNC_HOST}"
+AZ_ENVIRONMENT="${AZ_ENVIRONMENT}"
 EOF
 
 echo "Add the following to your ~/.ssh/config to access the VM:"
@@ -70,7 +75,7 @@ cat <<-EOF
 Host sshizzle-vm
   Hostname ${SERVER_IP}
   User ${ADMIN_USER}
-  IdentityAgent /tmp/sshizzle.sock
+  IdentityAgent \${XDG_RUNTIME_DIR}/sshizzle/agent.sock
 
 EOF
 